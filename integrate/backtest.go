@@ -0,0 +1,410 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Strategy receives market data and order updates and trades through the
+// Broker it is handed: a PaperBroker in a backtest, IntegrateOrders live.
+type Strategy interface {
+	OnBar(b Broker, bar Bar)
+	OnTick(b Broker, t Tick)
+	OnOrderUpdate(b Broker, u OrderUpdate)
+}
+
+// FillModel returns the prices a bar is replayed through before the
+// strategy sees it. Orders placed in OnBar first meet the next bar's path.
+type FillModel func(bar Bar) []float64
+
+// FillAtOpen replays only the open, so orders fill at the next bar's open
+// and resting orders only fill if the open crosses them.
+func FillAtOpen(bar Bar) []float64 {
+	return []float64{bar.Open}
+}
+
+// FillOHLC replays open, the extreme nearer the open, the other extreme and
+// the close, so resting limit and stop orders can fill inside the bar.
+func FillOHLC(bar Bar) []float64 {
+	if bar.Open-bar.Low < bar.High-bar.Open {
+		return []float64{bar.Open, bar.Low, bar.High, bar.Close}
+	}
+	return []float64{bar.Open, bar.High, bar.Low, bar.Close}
+}
+
+// ChargeModel returns brokerage and statutory charges for one fill.
+// ChargeCalculator implements it with date-effective rate tables.
+type ChargeModel interface {
+	Charges(f Fill) float64
+}
+
+// chargeLedger charges the fills of each order together, so brokerage
+// charged per order or capped per order is not charged again on every
+// partial fill. Each fill costs the charges on its order's fills so far
+// less what the earlier ones cost.
+type chargeLedger struct {
+	orders  map[string]Fill
+	charged map[string]float64
+}
+
+func (l *chargeLedger) charge(m ChargeModel, f Fill) float64 {
+	if f.OrderID == "" {
+		return m.Charges(f)
+	}
+	if l.orders == nil {
+		l.orders = make(map[string]Fill)
+		l.charged = make(map[string]float64)
+	}
+	order := mergeFill(l.orders[f.OrderID], f)
+	l.orders[f.OrderID] = order
+	total := m.Charges(order)
+	charges := total - l.charged[f.OrderID]
+	l.charged[f.OrderID] = total
+	return charges
+}
+
+// mergeFill returns f with the quantity and average price of order, the
+// earlier fills of the same order, added in.
+func mergeFill(order, f Fill) Fill {
+	if order.Quantity == 0 {
+		return f
+	}
+	qty := order.Quantity + f.Quantity
+	f.Price = (order.Price*float64(order.Quantity) + f.Price*float64(f.Quantity)) / float64(qty)
+	f.Quantity = qty
+	return f
+}
+
+// FlatCharges charges fixed rates on turnover. Rates are fractions, so
+// 0.001 is 0.1%.
+type FlatCharges struct {
+	BrokeragePerOrder float64
+	BrokerageRate     float64
+	MaxBrokerage      float64
+	STTSellRate       float64
+	TransactionRate   float64
+	StampDutyBuyRate  float64
+	SEBIRate          float64
+	GSTRate           float64
+}
+
+// Charges implements ChargeModel.
+func (c FlatCharges) Charges(f Fill) float64 {
+	turnover := f.Price * float64(f.Quantity)
+
+	brokerage := c.BrokeragePerOrder + turnover*c.BrokerageRate
+	if c.MaxBrokerage > 0 && brokerage > c.MaxBrokerage {
+		brokerage = c.MaxBrokerage
+	}
+	transaction := turnover * c.TransactionRate
+	sebi := turnover * c.SEBIRate
+
+	total := brokerage + transaction + sebi + (brokerage+transaction+sebi)*c.GSTRate
+	if f.OrderType == OrderTypeSell {
+		total += turnover * c.STTSellRate
+	} else {
+		total += turnover * c.StampDutyBuyRate
+	}
+	return total
+}
+
+// EquityPoint is the marked-to-market account value after one bar or tick.
+// Drawdown is the fall from the previous peak as a fraction of the peak.
+type EquityPoint struct {
+	Time     time.Time
+	Equity   float64
+	Drawdown float64
+}
+
+// BacktestTrade is a round trip matched from fills first in, first out.
+// PnL is before charges.
+type BacktestTrade struct {
+	Exchange      string
+	TradingSymbol string
+	ProductType   string
+	Side          string
+	Quantity      int
+	EntryTime     time.Time
+	EntryPrice    float64
+	ExitTime      time.Time
+	ExitPrice     float64
+	PnL           float64
+}
+
+// BacktestResult is the outcome of a backtest.
+type BacktestResult struct {
+	Equity             []EquityPoint
+	Trades             []BacktestTrade
+	Fills              []Fill
+	GrossPnL           float64
+	Charges            float64
+	NetPnL             float64
+	MaxDrawdown        float64
+	MaxDrawdownPercent float64
+	Sharpe             float64
+	WinRate            float64
+}
+
+// Backtester replays bars or ticks through a Strategy with orders routed
+// to a PaperBroker. Sharpe is annualised with PeriodsPerYear, which should
+// match the bar interval: 252 for daily bars, 252*375 for NSE minute bars.
+type Backtester struct {
+	Capital        float64
+	Fill           FillModel
+	Slippage       float64
+	Charges        ChargeModel
+	MarginRates    map[string]float64
+	PeriodsPerYear float64
+	logging        bool
+}
+
+// NewBacktester initializes a backtester for daily bars with the OHLC fill
+// model and no charges.
+func NewBacktester(capital float64, logging bool) *Backtester {
+	return &Backtester{
+		Capital:        capital,
+		Fill:           FillOHLC,
+		MarginRates:    DefaultPaperMarginRates,
+		PeriodsPerYear: 252,
+		logging:        logging,
+	}
+}
+
+// backtestRun is the state of one run.
+type backtestRun struct {
+	bt      *Backtester
+	broker  *PaperBroker
+	clock   time.Time
+	marks   map[string]float64
+	fills   []Fill
+	charges float64
+	ledger  chargeLedger
+	peak    float64
+	result  *BacktestResult
+}
+
+func (bt *Backtester) newRun(s Strategy) *backtestRun {
+	run := &backtestRun{
+		bt:     bt,
+		marks:  make(map[string]float64),
+		peak:   bt.Capital,
+		result: &BacktestResult{},
+	}
+	run.broker = NewPaperBroker(nil, bt.Capital, false)
+	run.broker.Slippage = bt.Slippage
+	run.broker.MarginRates = bt.MarginRates
+	run.broker.now = func() time.Time { return run.clock }
+	run.broker.OnOrderUpdate = func(u OrderUpdate) {
+		s.OnOrderUpdate(run.broker, u)
+	}
+	return run
+}
+
+// Run replays bars, which may cover several instruments, in order of their
+// end time. Bars need Exchange and TradingSymbol set.
+func (bt *Backtester) Run(ctx context.Context, s Strategy, bars []Bar) (*BacktestResult, error) {
+	if bt.Fill == nil {
+		return nil, errors.New("backtester has no fill model")
+	}
+	bars = append([]Bar(nil), bars...)
+	sort.SliceStable(bars, func(i, j int) bool { return bars[i].End.Before(bars[j].End) })
+
+	run := bt.newRun(s)
+	for i, bar := range bars {
+		if i%256 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		run.clock = bar.Start
+		for _, price := range bt.Fill(bar) {
+			run.broker.ApplyTick(Tick{
+				Exchange:      bar.Exchange,
+				Token:         bar.Token,
+				TradingSymbol: bar.TradingSymbol,
+				LTP:           price,
+				Time:          bar.Start,
+			})
+		}
+		run.broker.clearMarket(bar.Exchange, bar.TradingSymbol)
+
+		run.clock = bar.End
+		run.marks[paperKey(bar.Exchange, bar.TradingSymbol)] = bar.Close
+		run.record(bar.End)
+		s.OnBar(run.broker, bar)
+	}
+	return run.finish(), nil
+}
+
+// RunTicks replays ticks in the order given. Orders placed in OnTick can
+// fill against the same tick.
+func (bt *Backtester) RunTicks(ctx context.Context, s Strategy, ticks []Tick) (*BacktestResult, error) {
+	run := bt.newRun(s)
+	for i, t := range ticks {
+		if i%256 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		run.clock = t.Time
+		run.broker.ApplyTick(t)
+		run.marks[paperKey(t.Exchange, t.TradingSymbol)] = t.LTP
+		run.record(t.Time)
+		s.OnTick(run.broker, t)
+	}
+	return run.finish(), nil
+}
+
+// record charges new fills and appends a point to the equity curve.
+func (run *backtestRun) record(at time.Time) {
+	fills := run.broker.fillsSince(len(run.fills))
+	for _, f := range fills {
+		if run.bt.Charges != nil {
+			run.charges += run.ledger.charge(run.bt.Charges, f)
+		}
+	}
+	run.fills = append(run.fills, fills...)
+
+	equity := run.bt.Capital - run.charges
+	r, _ := run.broker.Positions()
+	for _, row := range responseRows(r, "positions") {
+		p := parsePositionRow(row)
+		equity += p.RealizedPnL
+		if mark, ok := run.marks[paperKey(p.Exchange, p.TradingSymbol)]; ok && p.NetQuantity != 0 {
+			equity += (mark - p.NetAveragePrice) * float64(p.NetQuantity)
+		}
+	}
+
+	if equity > run.peak {
+		run.peak = equity
+	}
+	dd := 0.0
+	if run.peak > 0 {
+		dd = (run.peak - equity) / run.peak
+	}
+	res := run.result
+	res.Equity = append(res.Equity, EquityPoint{Time: at, Equity: equity, Drawdown: dd})
+	if run.peak-equity > res.MaxDrawdown {
+		res.MaxDrawdown = run.peak - equity
+	}
+	if dd > res.MaxDrawdownPercent {
+		res.MaxDrawdownPercent = dd
+	}
+}
+
+func (run *backtestRun) finish() *BacktestResult {
+	res := run.result
+	res.Fills = run.fills
+	res.Trades = roundTrips(run.fills)
+	res.Charges = run.charges
+	if n := len(res.Equity); n > 0 {
+		res.NetPnL = res.Equity[n-1].Equity - run.bt.Capital
+	}
+	res.GrossPnL = res.NetPnL + res.Charges
+	res.Sharpe = sharpe(res.Equity, run.bt.PeriodsPerYear)
+
+	wins := 0
+	for _, t := range res.Trades {
+		if t.PnL > 0 {
+			wins++
+		}
+	}
+	if len(res.Trades) > 0 {
+		res.WinRate = float64(wins) / float64(len(res.Trades))
+	}
+
+	if run.bt.logging {
+		logger.Printf("backtest: %d bars, %d trades, net %.2f, max drawdown %.2f%%, sharpe %.2f, win rate %.1f%%",
+			len(res.Equity), len(res.Trades), res.NetPnL, res.MaxDrawdownPercent*100, res.Sharpe, res.WinRate*100)
+	}
+	return res
+}
+
+// roundTrips pairs fills into closed trades per instrument and product.
+func roundTrips(fills []Fill) []BacktestTrade {
+	type lot struct {
+		fill Fill
+		qty  int
+	}
+	open := make(map[string][]lot)
+
+	var trades []BacktestTrade
+	for _, f := range fills {
+		key := paperKey(f.Exchange, f.TradingSymbol) + "|" + f.ProductType
+		lots := open[key]
+		qty := f.Quantity
+
+		for qty > 0 && len(lots) > 0 && lots[0].fill.OrderType != f.OrderType {
+			entry := &lots[0]
+			n := qty
+			if entry.qty < n {
+				n = entry.qty
+			}
+
+			pnl := (f.Price - entry.fill.Price) * float64(n)
+			side := OrderTypeBuy
+			if entry.fill.OrderType == OrderTypeSell {
+				pnl = -pnl
+				side = OrderTypeSell
+			}
+			trades = append(trades, BacktestTrade{
+				Exchange:      f.Exchange,
+				TradingSymbol: f.TradingSymbol,
+				ProductType:   f.ProductType,
+				Side:          side,
+				Quantity:      n,
+				EntryTime:     entry.fill.Time,
+				EntryPrice:    entry.fill.Price,
+				ExitTime:      f.Time,
+				ExitPrice:     f.Price,
+				PnL:           pnl,
+			})
+
+			qty -= n
+			entry.qty -= n
+			if entry.qty == 0 {
+				lots = lots[1:]
+			}
+		}
+		if qty > 0 {
+			lots = append(lots, lot{fill: f, qty: qty})
+		}
+		open[key] = lots
+	}
+	return trades
+}
+
+// sharpe returns the annualised Sharpe ratio of per-point equity returns,
+// with a zero risk-free rate.
+func sharpe(equity []EquityPoint, periodsPerYear float64) float64 {
+	if len(equity) < 3 {
+		return 0
+	}
+	returns := make([]float64, 0, len(equity)-1)
+	for i := 1; i < len(equity); i++ {
+		if prev := equity[i-1].Equity; prev != 0 {
+			returns = append(returns, equity[i].Equity/prev-1)
+		}
+	}
+
+	mean := 0.0
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+
+	variance := 0.0
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	std := math.Sqrt(variance / float64(len(returns)-1))
+	if std == 0 {
+		return 0
+	}
+	return mean / std * math.Sqrt(periodsPerYear)
+}
@@ -0,0 +1,348 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Candle is one OHLCV row of HistoricalData. Time is the candle start in IST.
+type Candle struct {
+	Time         time.Time
+	Open         float64
+	High         float64
+	Low          float64
+	Close        float64
+	Volume       int
+	OpenInterest int
+}
+
+// parseCandle converts a HistoricalData row. Tick rows are rejected.
+func parseCandle(m map[string]interface{}) (Candle, bool) {
+	t, ok := m["datetime"].(time.Time)
+	if !ok || t.IsZero() {
+		return Candle{}, false
+	}
+	return Candle{
+		Time:         asIST(t),
+		Open:         fieldFloat(m, "open"),
+		High:         fieldFloat(m, "high"),
+		Low:          fieldFloat(m, "low"),
+		Close:        fieldFloat(m, "close"),
+		Volume:       fieldInt(m, "volume"),
+		OpenInterest: fieldInt(m, "oi"),
+	}, true
+}
+
+// HistoricalCandles collects HistoricalData for a minute or day timeframe
+// into typed candles.
+func (ic *IntegrateData) HistoricalCandles(exchange, tradingSymbol, timeframe string, start, end time.Time) ([]Candle, error) {
+	if timeframe == TimeframeTypeTick {
+		return nil, errors.New("candles are not available for the tick timeframe")
+	}
+
+	rows, errs, err := ic.HistoricalData(exchange, tradingSymbol, timeframe, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var candles []Candle
+	for row := range rows {
+		if c, ok := parseCandle(row); ok {
+			candles = append(candles, c)
+		}
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return candles, nil
+}
+
+// Bar is a live candle built from ticks. End is clipped to the session close.
+type Bar struct {
+	Exchange      string
+	Token         string
+	TradingSymbol string
+	Start         time.Time
+	End           time.Time
+	Open          float64
+	High          float64
+	Low           float64
+	Close         float64
+	Volume        int
+	OpenInterest  int
+	Ticks         int
+}
+
+// BarBuilder aggregates ticks into fixed interval bars aligned to the
+// exchange session open, so with a 5 minute interval on NSE the bars start
+// at 09:15, 09:20 and so on. OnUpdate receives the bar in progress after
+// every tick and OnClose receives each bar once it is complete.
+type BarBuilder struct {
+	Interval time.Duration
+	OnUpdate func(Bar)
+	OnClose  func(Bar)
+
+	mu   sync.Mutex
+	bars map[InstrumentToken]*barState
+}
+
+type barState struct {
+	bar        Bar
+	active     bool
+	lastVolume int
+	// firstTick is the time of the first live tick in bar, zero for a bar
+	// seeded only from candles.
+	firstTick time.Time
+}
+
+// NewBarBuilder initializes a builder for bars of the given interval.
+func NewBarBuilder(interval time.Duration) (*BarBuilder, error) {
+	if interval <= 0 {
+		return nil, errors.New("bar interval must be positive")
+	}
+	return &BarBuilder{
+		Interval: interval,
+		bars:     make(map[InstrumentToken]*barState),
+	}, nil
+}
+
+// bounds returns the bar that t falls in.
+func (b *BarBuilder) bounds(session TradingSession, t time.Time) (time.Time, time.Time) {
+	open := session.OpenOn(t)
+	start := open.Add(t.Sub(open) / b.Interval * b.Interval)
+	end := start.Add(b.Interval)
+	if close := session.CloseOn(t); end.After(close) {
+		end = close
+	}
+	return start, end
+}
+
+func (b *BarBuilder) state(key InstrumentToken) *barState {
+	st := b.bars[key]
+	if st == nil {
+		st = &barState{}
+		b.bars[key] = st
+	}
+	return st
+}
+
+// AddTick folds a tick into the current bar of its instrument. Ticks outside
+// the session and ticks older than the current bar are ignored.
+func (b *BarBuilder) AddTick(t Tick) {
+	if t.LTP == 0 {
+		return
+	}
+	session := SessionFor(t.Exchange)
+	ts := t.Time.In(IST)
+	if !session.Contains(ts) {
+		return
+	}
+	start, end := b.bounds(session, ts)
+	key := InstrumentToken{Exchange: t.Exchange, Token: t.Token}
+
+	var closed *Bar
+
+	b.mu.Lock()
+	st := b.state(key)
+	if st.active && start.Before(st.bar.Start) {
+		b.mu.Unlock()
+		return
+	}
+
+	// Tick volume is cumulative for the day; the bar gets the difference.
+	volume := 0
+	switch {
+	case t.Volume == 0:
+		volume = t.LastTradeQuantity
+	case st.lastVolume == 0:
+		volume = t.LastTradeQuantity
+	case t.Volume >= st.lastVolume:
+		volume = t.Volume - st.lastVolume
+	default:
+		volume = t.Volume
+	}
+	if t.Volume > 0 {
+		st.lastVolume = t.Volume
+	}
+
+	if st.active && !start.Equal(st.bar.Start) {
+		c := st.bar
+		closed = &c
+		st.active = false
+	}
+
+	if !st.active {
+		st.bar = Bar{
+			Exchange:      t.Exchange,
+			Token:         t.Token,
+			TradingSymbol: t.TradingSymbol,
+			Start:         start,
+			End:           end,
+			Open:          t.LTP,
+			High:          t.LTP,
+			Low:           t.LTP,
+		}
+		st.active = true
+		st.firstTick = ts
+	} else if st.firstTick.IsZero() {
+		st.firstTick = ts
+	}
+	bar := &st.bar
+	if t.LTP > bar.High {
+		bar.High = t.LTP
+	}
+	if t.LTP < bar.Low {
+		bar.Low = t.LTP
+	}
+	bar.Close = t.LTP
+	bar.Volume += volume
+	if t.OpenInterest > 0 {
+		bar.OpenInterest = t.OpenInterest
+	}
+	bar.Ticks++
+	update := *bar
+	b.mu.Unlock()
+
+	if closed != nil && b.OnClose != nil {
+		b.OnClose(*closed)
+	}
+	if b.OnUpdate != nil {
+		b.OnUpdate(update)
+	}
+}
+
+// CloseExpired closes every bar whose interval has ended by now. Run calls
+// it on a timer so bars close even when no further tick arrives.
+func (b *BarBuilder) CloseExpired(now time.Time) {
+	var closed []Bar
+
+	b.mu.Lock()
+	for _, st := range b.bars {
+		if st.active && !now.Before(st.bar.End) {
+			closed = append(closed, st.bar)
+			st.active = false
+		}
+	}
+	b.mu.Unlock()
+
+	if b.OnClose == nil {
+		return
+	}
+	for _, bar := range closed {
+		b.OnClose(bar)
+	}
+}
+
+// Current returns the bar in progress for an instrument.
+func (b *BarBuilder) Current(exchange, token string) (Bar, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.bars[InstrumentToken{Exchange: exchange, Token: token}]
+	if st == nil || !st.active {
+		return Bar{}, false
+	}
+	return st.bar, true
+}
+
+// Run feeds ticks into the builder until ctx is done or ticks is closed.
+func (b *BarBuilder) Run(ctx context.Context, ticks <-chan Tick) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t, ok := <-ticks:
+			if !ok {
+				return
+			}
+			b.AddTick(t)
+		case now := <-ticker.C:
+			b.CloseExpired(now)
+		}
+	}
+}
+
+// Seed builds the bar in progress at now from HistoricalData minute candles,
+// so a restart in the middle of a session does not start with a partial
+// first bar. Ticks already fed in for the bar take precedence: candles from
+// the minute of the first tick onwards are dropped so their volume is not
+// counted twice. Ticks counts only live ticks, so it stays 0 for a bar built
+// from candles alone.
+func (b *BarBuilder) Seed(data *IntegrateData, exchange, tradingSymbol string, now time.Time) error {
+	session := SessionFor(exchange)
+	now = now.In(IST)
+	if !session.Contains(now) {
+		return nil
+	}
+
+	token, err := data.getToken(exchange, tradingSymbol)
+	if err != nil {
+		return err
+	}
+	start, end := b.bounds(session, now)
+
+	candles, err := data.HistoricalCandles(exchange, tradingSymbol, TimeframeTypeMin, start, now)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.state(InstrumentToken{Exchange: exchange, Token: token})
+	live := st.active && st.bar.Start.Equal(start) && !st.firstTick.IsZero()
+	cutoff := end
+	if live {
+		cutoff = st.firstTick.Truncate(time.Minute)
+	}
+
+	seed := Bar{Exchange: exchange, Token: token, TradingSymbol: tradingSymbol, Start: start, End: end}
+	n := 0
+	for _, c := range candles {
+		if c.Time.Before(start) || !c.Time.Before(cutoff) {
+			continue
+		}
+		if n == 0 {
+			seed.Open, seed.High, seed.Low = c.Open, c.High, c.Low
+		}
+		if c.High > seed.High {
+			seed.High = c.High
+		}
+		if c.Low < seed.Low {
+			seed.Low = c.Low
+		}
+		seed.Close = c.Close
+		seed.Volume += c.Volume
+		seed.OpenInterest = c.OpenInterest
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if live {
+		// The ticks cover the bar from cutoff on; the candles cover the rest.
+		if st.bar.High > seed.High {
+			seed.High = st.bar.High
+		}
+		if st.bar.Low < seed.Low {
+			seed.Low = st.bar.Low
+		}
+		seed.Close = st.bar.Close
+		seed.Volume += st.bar.Volume
+		seed.Ticks = st.bar.Ticks
+		if st.bar.OpenInterest > 0 {
+			seed.OpenInterest = st.bar.OpenInterest
+		}
+	} else {
+		st.firstTick = time.Time{}
+	}
+	st.bar = seed
+	st.active = true
+	return nil
+}
@@ -0,0 +1,264 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Constants for basket leg ordering
+const (
+	LegOrderBuysFirst  = "BUYS_FIRST"
+	LegOrderSellsFirst = "SELLS_FIRST"
+	LegOrderAsGiven    = "AS_GIVEN"
+)
+
+// Defaults for basket unwinding
+const (
+	defaultUnwindPoll    = 500 * time.Millisecond
+	defaultUnwindTimeout = 30 * time.Second
+)
+
+// InsufficientMarginError is returned when the account cannot fund a basket.
+type InsufficientMarginError struct {
+	Required  float64
+	Available float64
+}
+
+func (e *InsufficientMarginError) Error() string {
+	return fmt.Sprintf("insufficient margin: required %.2f, available %.2f", e.Required, e.Available)
+}
+
+var errLegSkipped = errors.New("not placed because an earlier leg failed")
+
+// BasketLegResult is the outcome of placing one leg.
+type BasketLegResult struct {
+	Leg     OrderRequest
+	OrderID string
+	Err     error
+}
+
+// BasketResult reports a basket placement.
+type BasketResult struct {
+	RequiredMargin  float64
+	AvailableMargin float64
+	Legs            []BasketLegResult
+}
+
+// Placed returns the legs that reached the broker.
+func (r *BasketResult) Placed() []BasketLegResult {
+	var placed []BasketLegResult
+	for _, l := range r.Legs {
+		if l.Err == nil {
+			placed = append(placed, l)
+		}
+	}
+	return placed
+}
+
+// Failed returns the legs that failed or were skipped.
+func (r *BasketResult) Failed() []BasketLegResult {
+	var failed []BasketLegResult
+	for _, l := range r.Legs {
+		if l.Err != nil {
+			failed = append(failed, l)
+		}
+	}
+	return failed
+}
+
+// Basket places a multi-leg strategy as a unit. The margin for the whole
+// basket is checked against Limits() before any leg is sent, and legs are
+// placed in LegOrder so that hedges go in first.
+type Basket struct {
+	orders   *IntegrateOrders
+	Legs     []OrderRequest
+	LegOrder string
+	logging  bool
+}
+
+// NewBasket initializes an empty basket that places buys before sells.
+func NewBasket(orders *IntegrateOrders, logging bool) *Basket {
+	return &Basket{orders: orders, LegOrder: LegOrderBuysFirst, logging: logging}
+}
+
+// Add appends legs to the basket.
+func (b *Basket) Add(legs ...OrderRequest) *Basket {
+	b.Legs = append(b.Legs, legs...)
+	return b
+}
+
+// ordered returns the legs in placement order.
+func (b *Basket) ordered() []OrderRequest {
+	legs := append([]OrderRequest(nil), b.Legs...)
+	first := ""
+	switch b.LegOrder {
+	case LegOrderBuysFirst:
+		first = OrderTypeBuy
+	case LegOrderSellsFirst:
+		first = OrderTypeSell
+	default:
+		return legs
+	}
+	sort.SliceStable(legs, func(i, j int) bool {
+		return legs[i].OrderType == first && legs[j].OrderType != first
+	})
+	return legs
+}
+
+// CheckMargin returns the margin required for the basket and the funds
+// available, or an *InsufficientMarginError if the basket cannot be funded.
+func (b *Basket) CheckMargin() (float64, float64, error) {
+	if len(b.Legs) == 0 {
+		return 0, 0, errors.New("basket is empty")
+	}
+	required, err := b.orders.RequiredMargin(b.Legs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("margin check failed: %w", err)
+	}
+	limits, err := b.orders.AccountLimits()
+	if err != nil {
+		return required, 0, fmt.Errorf("limits check failed: %w", err)
+	}
+	available := limits.Available()
+	if available < required {
+		return required, available, &InsufficientMarginError{Required: required, Available: available}
+	}
+	return required, available, nil
+}
+
+// Place checks margin and then places every leg in order. Placement stops
+// at the first failed leg; the remaining legs are reported as skipped. Each
+// leg is tagged, and a leg whose outcome is unknown, such as one that timed
+// out, is looked up in Orders() by its tag. Use Unwind to reverse the legs
+// that were placed.
+func (b *Basket) Place(ctx context.Context) (*BasketResult, error) {
+	required, available, err := b.CheckMargin()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BasketResult{RequiredMargin: required, AvailableMargin: available}
+	failed := false
+	for _, leg := range b.ordered() {
+		res := BasketLegResult{Leg: leg}
+		if failed {
+			res.Err = errLegSkipped
+			result.Legs = append(result.Legs, res)
+			continue
+		}
+
+		if leg.Tag == "" {
+			leg.Tag = newClientTag(defaultTagPrefix)
+			res.Leg = leg
+		}
+		r, err := b.orders.WithContext(ctx).PlaceOrderRequest(leg)
+		if err == nil {
+			if res.OrderID, err = orderIDFrom(r); err != nil {
+				err = fmt.Errorf("%w: %v", errNoOrderID, err)
+			}
+		}
+		if err != nil && isAmbiguous(err) {
+			if id, found, _ := b.lookup(ctx, leg); found {
+				res.OrderID, err = id, nil
+			}
+		}
+		res.Err = err
+		if res.Err != nil {
+			failed = true
+		}
+		if b.logging {
+			logger.Printf("basket leg %s %s qty %d: order %s err %v", leg.OrderType, leg.TradingSymbol, leg.Quantity, res.OrderID, res.Err)
+		}
+		result.Legs = append(result.Legs, res)
+	}
+
+	if failed {
+		return result, fmt.Errorf("basket incomplete: %d of %d legs failed", len(result.Failed()), len(result.Legs))
+	}
+	return result, nil
+}
+
+// Unwind compensates for a partly placed basket. Pending legs are cancelled
+// and, once each has reached a final state, its filled quantity is closed
+// with a market order under market protection. Legs whose outcome was
+// unknown are looked up again by tag and unwound if they reached the
+// broker. It returns one result per placed or unknown leg describing the
+// compensating action.
+func (b *Basket) Unwind(ctx context.Context, result *BasketResult) []BasketLegResult {
+	var out []BasketLegResult
+	for _, leg := range result.Legs {
+		if leg.Err != nil {
+			if !isAmbiguous(leg.Err) {
+				continue
+			}
+			id, found, err := b.lookup(ctx, leg.Leg)
+			if !found {
+				if err == nil {
+					err = fmt.Errorf("leg %s not found in order book", leg.Leg.Tag)
+				}
+				out = append(out, BasketLegResult{Leg: leg.Leg, Err: fmt.Errorf("leg outcome unknown: %v: %w", leg.Err, err)})
+				continue
+			}
+			leg.OrderID, leg.Err = id, nil
+		}
+		out = append(out, b.unwindLeg(ctx, leg))
+	}
+	return out
+}
+
+// lookup searches Orders() for a leg by the tag it was sent with. It runs
+// even if ctx is done, as the leg may be live.
+func (b *Basket) lookup(ctx context.Context, leg OrderRequest) (string, bool, error) {
+	if b.logging {
+		logger.Printf("basket leg %s %s: outcome unknown, searching order book", leg.TradingSymbol, leg.Tag)
+	}
+	g := NewOrderGuard(b.orders, b.logging)
+	return g.FindByTag(context.WithoutCancel(ctx), *tagRemarks(leg.Remarks, leg.Tag))
+}
+
+func (b *Basket) unwindLeg(ctx context.Context, leg BasketLegResult) BasketLegResult {
+	res := BasketLegResult{Leg: leg.Leg, OrderID: leg.OrderID}
+
+	state, err := orderState(ctx, b.orders, leg.OrderID)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if !isTerminalStatus(state.Status) {
+		if _, err := b.orders.WithContext(ctx).CancelOrder(leg.OrderID); err != nil {
+			res.Err = fmt.Errorf("cancel %s: %w", leg.OrderID, err)
+			return res
+		}
+		// Fills can land until the cancel is confirmed, so the quantity
+		// to close is read from the final state.
+		if state, err = awaitTerminal(ctx, b.orders, leg.OrderID, defaultUnwindPoll, defaultUnwindTimeout); err != nil {
+			res.Err = err
+			return res
+		}
+	}
+	if state.FilledQuantity == 0 {
+		return res
+	}
+
+	protection := killSwitchMarketProtection
+	reverse := OrderRequest{
+		Exchange:         leg.Leg.Exchange,
+		OrderType:        Opposite(leg.Leg.OrderType),
+		PriceType:        PriceTypeMarket,
+		ProductType:      leg.Leg.ProductType,
+		Quantity:         state.FilledQuantity,
+		TradingSymbol:    leg.Leg.TradingSymbol,
+		MarketProtection: &protection,
+		Validity:         ValidityTypeDay,
+	}
+	r, err := b.orders.WithContext(ctx).PlaceOrderRequest(reverse)
+	if err == nil {
+		res.OrderID, err = orderIDFrom(r)
+	}
+	res.Leg = reverse
+	res.Err = err
+	return res
+}
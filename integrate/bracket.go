@@ -0,0 +1,463 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Constants for bracket status
+const (
+	BracketStatusPending   = "PENDING"
+	BracketStatusActive    = "ACTIVE"
+	BracketStatusClosed    = "CLOSED"
+	BracketStatusCancelled = "CANCELLED"
+	BracketStatusFailed    = "FAILED"
+)
+
+// defaultBracketSyncInterval is used by Run when no positive interval is
+// given.
+const defaultBracketSyncInterval = 5 * time.Second
+
+// Bracket is an entry order with exits placed once it fills: an OCO of
+// target and stoploss for a bracket, or an SL-MARKET order for a cover
+// order, which has no target.
+type Bracket struct {
+	EntryID  string
+	Entry    OrderRequest
+	Target   float64
+	StopLoss float64
+	Status   string
+	Filled   int
+	AlertID  string
+	StopID   string
+	Err      error
+
+	// ocoSent is set once an OCO has been sent, so a response without an
+	// alert id is looked up before another OCO is placed.
+	ocoSent bool
+}
+
+// Cover reports whether the bracket only has a stoploss.
+func (b Bracket) Cover() bool {
+	return b.Target == 0
+}
+
+// bracketState holds one bracket. op is held while its orders are sent,
+// so exits are changed one at a time; mu only guards reads and writes of
+// bracket and is never held across a request.
+type bracketState struct {
+	op      sync.Mutex
+	mu      sync.Mutex
+	bracket Bracket
+}
+
+func (st *bracketState) get() Bracket {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.bracket
+}
+
+func (st *bracketState) set(b Bracket) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.bracket = b
+}
+
+// BracketManager emulates bracket and cover orders for INTRADAY and NORMAL
+// products. Entries are followed through an OrderTracker; as the entry
+// fills, the exits are placed for the filled quantity and resized with each
+// partial fill. If the entry is cancelled after a partial fill, the exits
+// stay in place for the filled quantity.
+type BracketManager struct {
+	orders   *IntegrateOrders
+	tracker  *OrderTracker
+	OnChange func(Bracket)
+	logging  bool
+
+	mu       sync.Mutex
+	brackets map[string]*bracketState
+}
+
+// NewBracketManager initializes a manager. tracker must be fed order
+// updates, for example with tracker.Run or tracker.Poll.
+func NewBracketManager(orders *IntegrateOrders, tracker *OrderTracker, logging bool) *BracketManager {
+	return &BracketManager{
+		orders:   orders,
+		tracker:  tracker,
+		logging:  logging,
+		brackets: make(map[string]*bracketState),
+	}
+}
+
+// alertIDFrom extracts the alert id from a GTT or OCO response.
+func alertIDFrom(r map[string]interface{}) (string, error) {
+	id := fieldString(r, "alert_id")
+	if id == "" {
+		return "", errors.New("alert_id missing from response")
+	}
+	return id, nil
+}
+
+func validateBracket(entry OrderRequest, target, stoploss float64) error {
+	if entry.ProductType != ProductTypeIntraday && entry.ProductType != ProductTypeNormal {
+		return errors.New("bracket orders are only supported for INTRADAY and NORMAL products")
+	}
+	if stoploss <= 0 {
+		return errors.New("stoploss price is required")
+	}
+	ref := entry.Price
+	long := entry.OrderType == OrderTypeBuy
+	if target > 0 {
+		if long && target <= stoploss {
+			return errors.New("target must be above stoploss for a BUY bracket")
+		}
+		if !long && target >= stoploss {
+			return errors.New("target must be below stoploss for a SELL bracket")
+		}
+		if ref > 0 && ((long && target <= ref) || (!long && target >= ref)) {
+			return errors.New("target must be beyond the entry price")
+		}
+	}
+	if ref > 0 && ((long && stoploss >= ref) || (!long && stoploss <= ref)) {
+		return errors.New("stoploss must be on the losing side of the entry price")
+	}
+	return nil
+}
+
+// PlaceBracket places entry and, as it fills, an OCO of target and stoploss
+// on the opposite side. It returns the entry order id.
+func (m *BracketManager) PlaceBracket(ctx context.Context, entry OrderRequest, target, stoploss float64) (string, error) {
+	if target <= 0 {
+		return "", errors.New("target price is required")
+	}
+	return m.place(ctx, entry, target, stoploss)
+}
+
+// PlaceCover places entry and, as it fills, an SL-MARKET stoploss order on
+// the opposite side. It returns the entry order id.
+func (m *BracketManager) PlaceCover(ctx context.Context, entry OrderRequest, stoploss float64) (string, error) {
+	return m.place(ctx, entry, 0, stoploss)
+}
+
+func (m *BracketManager) place(ctx context.Context, entry OrderRequest, target, stoploss float64) (string, error) {
+	if err := validateBracket(entry, target, stoploss); err != nil {
+		return "", err
+	}
+	r, err := m.orders.WithContext(ctx).PlaceOrderRequest(entry)
+	if err != nil {
+		return "", err
+	}
+	id, err := orderIDFrom(r)
+	if err != nil {
+		return "", err
+	}
+
+	st := &bracketState{bracket: Bracket{
+		EntryID:  id,
+		Entry:    entry,
+		Target:   target,
+		StopLoss: stoploss,
+		Status:   BracketStatusPending,
+	}}
+	m.mu.Lock()
+	m.brackets[id] = st
+	m.mu.Unlock()
+	m.tracker.Register(id)
+
+	if m.logging {
+		logger.Printf("bracket %s: entry %s %d %s placed", id, entry.OrderType, entry.Quantity, entry.TradingSymbol)
+	}
+
+	// A market entry can fill before the tracker knows the order, so its
+	// state is fetched once now.
+	if u, err := orderState(ctx, m.orders, id); err == nil {
+		u.OrderID = id
+		m.tracker.Apply(u)
+	}
+	return id, nil
+}
+
+// Get returns the current state of a bracket.
+func (m *BracketManager) Get(entryID string) (Bracket, bool) {
+	m.mu.Lock()
+	st, ok := m.brackets[entryID]
+	m.mu.Unlock()
+	if !ok {
+		return Bracket{}, false
+	}
+
+	return st.get(), true
+}
+
+// Run handles entry transitions from the tracker until ctx is done, and
+// checks every interval whether the exits of active brackets are gone. An
+// interval <= 0 checks every five seconds.
+func (m *BracketManager) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultBracketSyncInterval
+	}
+	transitions, unsubscribe := m.tracker.Subscribe(256)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tr := <-transitions:
+			m.handle(ctx, tr)
+		case <-ticker.C:
+			if err := m.sync(ctx); err != nil && m.logging {
+				logger.Printf("bracket sync failed: %v", err)
+			}
+		}
+	}
+}
+
+// handle places or resizes exits after a change of the entry order.
+func (m *BracketManager) handle(ctx context.Context, tr OrderTransition) {
+	m.mu.Lock()
+	st, ok := m.brackets[tr.OrderID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	filled := tr.Update.FilledQuantity
+	if o, ok := m.tracker.Get(tr.OrderID); ok && o.FilledQuantity() > filled {
+		filled = o.FilledQuantity()
+	}
+
+	st.op.Lock()
+	defer st.op.Unlock()
+	b := st.get()
+	if b.Status == BracketStatusCancelled || b.Status == BracketStatusClosed {
+		return
+	}
+	if filled > b.Filled {
+		if err := m.resize(ctx, &b, filled); err != nil {
+			b.Status = BracketStatusFailed
+			b.Err = err
+			if m.logging {
+				logger.Printf("bracket %s: exits for %d not placed: %v", b.EntryID, filled, err)
+			}
+		} else {
+			b.Filled = filled
+			b.Status = BracketStatusActive
+		}
+	}
+	if (tr.To == OrderStatusCancelled || tr.To == OrderStatusRejected) && b.Filled == 0 {
+		b.Status = BracketStatusCancelled
+		if tr.To == OrderStatusRejected {
+			b.Status = BracketStatusFailed
+			b.Err = fmt.Errorf("entry rejected: %s", tr.Update.Message)
+		}
+	}
+	st.set(b)
+
+	m.changed(b)
+}
+
+// resize places the exits for qty, or modifies them if they exist.
+// Callers hold the bracket's op lock.
+func (m *BracketManager) resize(ctx context.Context, b *Bracket, qty int) error {
+	orders := m.orders.WithContext(ctx)
+	side := Opposite(b.Entry.OrderType)
+	e := b.Entry
+
+	if b.Cover() {
+		if b.StopID != "" {
+			trigger := b.StopLoss
+			_, err := orders.ModifyOrder(OrderParams{
+				Exchange:      e.Exchange,
+				OrderID:       b.StopID,
+				OrderType:     side,
+				PriceType:     PriceTypeSlMkt,
+				ProductType:   e.ProductType,
+				Quantity:      qty,
+				TradingSymbol: e.TradingSymbol,
+				TriggerPrice:  &trigger,
+				Validity:      ValidityTypeDay,
+			})
+			return err
+		}
+		trigger := b.StopLoss
+		r, err := orders.PlaceOrderRequest(OrderRequest{
+			Exchange:      e.Exchange,
+			OrderType:     side,
+			PriceType:     PriceTypeSlMkt,
+			ProductType:   e.ProductType,
+			Quantity:      qty,
+			TradingSymbol: e.TradingSymbol,
+			Remarks:       e.Remarks,
+			TriggerPrice:  &trigger,
+			Validity:      ValidityTypeDay,
+		})
+		if err != nil {
+			return err
+		}
+		if b.StopID, err = orderIDFrom(r); err != nil {
+			return err
+		}
+		m.tracker.Register(b.StopID)
+		return nil
+	}
+
+	if b.AlertID == "" && b.ocoSent {
+		id, err := m.findOCO(ctx, b)
+		if err != nil {
+			return fmt.Errorf("looking up earlier oco: %w", err)
+		}
+		b.AlertID = id
+	}
+	if b.AlertID != "" {
+		_, err := orders.ModifyOCOOrder(e.Exchange, b.AlertID, side, e.TradingSymbol, qty, b.StopLoss, qty, b.Target, e.Remarks)
+		return err
+	}
+	b.ocoSent = true
+	r, err := orders.PlaceOCOOrder(e.Exchange, side, e.TradingSymbol, qty, b.StopLoss, qty, b.Target, e.Remarks)
+	if err != nil {
+		return err
+	}
+	b.AlertID, err = alertIDFrom(r)
+	return err
+}
+
+// findOCO returns the id of a pending OCO in GTTOrders() with the exits of
+// b, or "" if there is none.
+func (m *BracketManager) findOCO(ctx context.Context, b *Bracket) (string, error) {
+	r, err := m.orders.WithContext(ctx).GTTOrders()
+	if err != nil {
+		return "", err
+	}
+	remarks := ""
+	if b.Entry.Remarks != nil {
+		remarks = *b.Entry.Remarks
+	}
+	for _, row := range responseRows(r, "pendingGTTOrderBook") {
+		a := parseGTTRow(row)
+		if a.Kind == GTTKindOCO && a.Exchange == b.Entry.Exchange && a.TradingSymbol == b.Entry.TradingSymbol &&
+			a.OrderType == Opposite(b.Entry.OrderType) && a.StoplossPrice == b.StopLoss && a.TargetPrice == b.Target &&
+			a.Remarks == remarks {
+			return a.AlertID, nil
+		}
+	}
+	return "", nil
+}
+
+// Cancel cancels the entry if it is still open and removes the exits.
+func (m *BracketManager) Cancel(ctx context.Context, entryID string) error {
+	m.mu.Lock()
+	st, ok := m.brackets[entryID]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("bracket %s not found", entryID)
+	}
+
+	st.op.Lock()
+	defer st.op.Unlock()
+	b := st.get()
+	orders := m.orders.WithContext(ctx)
+	var errs []error
+
+	if o, ok := m.tracker.Get(entryID); !ok || !isTerminalStatus(o.Status) {
+		if _, err := orders.CancelOrder(entryID); err != nil {
+			errs = append(errs, fmt.Errorf("entry: %w", err))
+		}
+	}
+	if b.AlertID == "" && b.ocoSent {
+		id, err := m.findOCO(ctx, &b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("looking up oco: %w", err))
+		}
+		b.AlertID = id
+	}
+	if b.AlertID != "" {
+		if _, err := orders.CancelOCOOrder(b.AlertID); err != nil {
+			errs = append(errs, fmt.Errorf("oco %s: %w", b.AlertID, err))
+		}
+	}
+	if b.StopID != "" {
+		if _, err := orders.CancelOrder(b.StopID); err != nil {
+			errs = append(errs, fmt.Errorf("stoploss %s: %w", b.StopID, err))
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err == nil {
+		b.Status = BracketStatusCancelled
+	}
+	st.set(b)
+
+	if m.logging {
+		logger.Printf("bracket %s: cancelled (err=%v)", entryID, err)
+	}
+	m.changed(b)
+	return err
+}
+
+// sync marks active brackets closed once their exit is no longer pending.
+func (m *BracketManager) sync(ctx context.Context) error {
+	m.mu.Lock()
+	all := make([]*bracketState, 0, len(m.brackets))
+	for _, st := range m.brackets {
+		all = append(all, st)
+	}
+	m.mu.Unlock()
+
+	var active []*bracketState
+	for _, st := range all {
+		if st.get().Status == BracketStatusActive {
+			active = append(active, st)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+
+	r, err := m.orders.WithContext(ctx).GTTOrders()
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]bool)
+	for _, row := range responseRows(r, "pendingGTTOrderBook") {
+		pending[fieldString(row, "alert_id")] = true
+	}
+
+	for _, st := range active {
+		// op waits out a resize or cancel in progress, whose result
+		// decides whether the bracket is still open.
+		st.op.Lock()
+		b := st.get()
+		closed := false
+		if b.Status == BracketStatusActive {
+			if b.Cover() {
+				o, ok := m.tracker.Get(b.StopID)
+				closed = ok && isTerminalStatus(o.Status)
+			} else {
+				closed = b.AlertID != "" && !pending[b.AlertID]
+			}
+		}
+		if closed {
+			b.Status = BracketStatusClosed
+			st.set(b)
+		}
+		st.op.Unlock()
+
+		if closed {
+			m.changed(b)
+		}
+	}
+	return nil
+}
+
+func (m *BracketManager) changed(b Bracket) {
+	if m.OnChange != nil {
+		m.OnChange(b)
+	}
+}
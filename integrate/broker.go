@@ -0,0 +1,21 @@
+package integrate
+
+// Broker is the set of order routes shared by IntegrateOrders and
+// PaperBroker, so the same strategy code can trade live or on paper.
+// Responses have the shape of the Integrate API in both cases.
+type Broker interface {
+	PlaceOrderRequest(req OrderRequest) (map[string]interface{}, error)
+	ModifyOrder(params OrderParams) (map[string]interface{}, error)
+	CancelOrder(orderID string) (map[string]interface{}, error)
+	Order(orderID string) (map[string]interface{}, error)
+	Orders() (map[string]interface{}, error)
+	Trades() (map[string]interface{}, error)
+	Positions() (map[string]interface{}, error)
+	Holdings() (map[string]interface{}, error)
+	Limits() (map[string]interface{}, error)
+}
+
+var (
+	_ Broker = (*IntegrateOrders)(nil)
+	_ Broker = (*PaperBroker)(nil)
+)
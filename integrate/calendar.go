@@ -0,0 +1,121 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TradingCalendar knows the weekends and exchange holidays. Holidays are
+// kept per exchange as IST calendar days.
+type TradingCalendar struct {
+	mu       sync.RWMutex
+	holidays map[string]map[string]bool
+}
+
+// NewTradingCalendar initializes a calendar with weekends as the only
+// closed days.
+func NewTradingCalendar() *TradingCalendar {
+	return &TradingCalendar{holidays: make(map[string]map[string]bool)}
+}
+
+func calendarDay(t time.Time) string {
+	return t.In(IST).Format("2006-01-02")
+}
+
+func isWeekday(day time.Time) bool {
+	wd := day.In(IST).Weekday()
+	return wd != time.Saturday && wd != time.Sunday
+}
+
+// AddHoliday marks days as closed on exchange.
+func (c *TradingCalendar) AddHoliday(exchange string, days ...time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.holidays[exchange] == nil {
+		c.holidays[exchange] = make(map[string]bool)
+	}
+	for _, d := range days {
+		c.holidays[exchange][calendarDay(d)] = true
+	}
+}
+
+// LoadHolidays reads a JSON file mapping exchanges to lists of
+// YYYY-MM-DD dates, such as {"NSE": ["2024-01-26", "2024-03-08"]}.
+func (c *TradingCalendar) LoadHolidays(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string][]string
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid holiday file %s: %w", path, err)
+	}
+
+	for exchange, dates := range file {
+		days := make([]time.Time, 0, len(dates))
+		for _, s := range dates {
+			d, err := time.ParseInLocation("2006-01-02", s, IST)
+			if err != nil {
+				return fmt.Errorf("invalid holiday %q for %s: %w", s, exchange, err)
+			}
+			days = append(days, d)
+		}
+		c.AddHoliday(exchange, days...)
+	}
+	return nil
+}
+
+// IsTradingDay reports whether exchange is open on the IST day of t.
+// A nil calendar only knows weekends.
+func (c *TradingCalendar) IsTradingDay(exchange string, t time.Time) bool {
+	if !isWeekday(t) {
+		return false
+	}
+	if c == nil {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.holidays[exchange][calendarDay(t)]
+}
+
+// NextTradingDay returns midnight IST of the first trading day after the
+// day of t.
+func (c *TradingCalendar) NextTradingDay(exchange string, t time.Time) time.Time {
+	day := istMidnight(t)
+	for {
+		day = istMidnight(day.Add(36 * time.Hour))
+		if c.IsTradingDay(exchange, day) {
+			return day
+		}
+	}
+}
+
+// IsOpen reports whether the session of exchange is running at t.
+func (c *TradingCalendar) IsOpen(exchange string, t time.Time) bool {
+	return c.IsTradingDay(exchange, t) && SessionFor(exchange).Contains(t)
+}
+
+// NextOpen returns t if the session of exchange is running at t, otherwise
+// the next session open after t.
+func (c *TradingCalendar) NextOpen(exchange string, t time.Time) time.Time {
+	s := SessionFor(exchange)
+	if c.IsTradingDay(exchange, t) {
+		if s.Contains(t) {
+			return t
+		}
+		if t.Before(s.OpenOn(t)) {
+			return s.OpenOn(t)
+		}
+	}
+	return s.OpenOn(c.NextTradingDay(exchange, t))
+}
+
+// TradingDayFunc adapts the calendar for Runtime.TradingDay.
+func (c *TradingCalendar) TradingDayFunc(exchange string) func(day time.Time) bool {
+	return func(day time.Time) bool { return c.IsTradingDay(exchange, day) }
+}
@@ -0,0 +1,97 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CachedCandles returns HistoricalCandles from a JSON file under dir,
+// fetching and writing the file on the first call. The file name is built
+// from the request, so a different range is fetched separately. Ranges
+// that end after the last completed session are fetched but not cached,
+// as more candles may follow.
+func (ic *IntegrateData) CachedCandles(dir, exchange, tradingSymbol, timeframe string, start, end time.Time) ([]Candle, error) {
+	name := fmt.Sprintf("%s_%s_%s_%s_%s.json",
+		exchange,
+		strings.NewReplacer("/", "-", " ", "-").Replace(tradingSymbol),
+		timeframe,
+		start.In(IST).Format("200601021504"),
+		end.In(IST).Format("200601021504"))
+	path := filepath.Join(dir, name)
+
+	if data, err := os.ReadFile(path); err == nil {
+		var candles []Candle
+		if err := json.Unmarshal(data, &candles); err != nil {
+			return nil, fmt.Errorf("invalid candle cache %s: %w", path, err)
+		}
+		for i := range candles {
+			candles[i].Time = candles[i].Time.In(IST)
+		}
+		return candles, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	candles, err := ic.HistoricalCandles(exchange, tradingSymbol, timeframe, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if end.After(lastSessionClose(exchange, time.Now())) {
+		return candles, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(candles)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if ic.logging {
+		logger.Printf("cached %d candles in %s", len(candles), path)
+	}
+	return candles, nil
+}
+
+// lastSessionClose returns the close of the latest session of exchange
+// that has ended by now.
+func lastSessionClose(exchange string, now time.Time) time.Time {
+	session := SessionFor(exchange)
+	close := session.CloseOn(now)
+	if close.After(now) {
+		close = session.CloseOn(istMidnight(now).Add(-time.Hour))
+	}
+	return close
+}
+
+// CandleBars converts candles of one instrument into bars of the given
+// interval, for replay through a Backtester.
+func CandleBars(exchange, tradingSymbol string, interval time.Duration, candles []Candle) []Bar {
+	bars := make([]Bar, len(candles))
+	for i, c := range candles {
+		bars[i] = Bar{
+			Exchange:      exchange,
+			TradingSymbol: tradingSymbol,
+			Start:         c.Time,
+			End:           c.Time.Add(interval),
+			Open:          c.Open,
+			High:          c.High,
+			Low:           c.Low,
+			Close:         c.Close,
+			Volume:        c.Volume,
+			OpenInterest:  c.OpenInterest,
+			Ticks:         1,
+		}
+	}
+	return bars
+}
@@ -0,0 +1,382 @@
+package integrate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Constants for charge segments
+const (
+	SegmentEquityDelivery   = "EQ_DELIVERY"
+	SegmentEquityIntraday   = "EQ_INTRADAY"
+	SegmentEquityFutures    = "EQ_FUTURES"
+	SegmentEquityOptions    = "EQ_OPTIONS"
+	SegmentCurrencyFutures  = "CUR_FUTURES"
+	SegmentCurrencyOptions  = "CUR_OPTIONS"
+	SegmentCommodityFutures = "COM_FUTURES"
+	SegmentCommodityOptions = "COM_OPTIONS"
+)
+
+// ChargeTrade is one trade to compute charges for. Segment may be left
+// empty to derive it from the exchange, product type and symbol.
+type ChargeTrade struct {
+	Exchange      string
+	Segment       string
+	TradingSymbol string
+	ProductType   string
+	OrderType     string
+	Quantity      int
+	Price         float64
+	Time          time.Time
+}
+
+// ChargeBreakdown is the charges on one trade or the sum over several.
+// STT holds CTT for commodity trades.
+type ChargeBreakdown struct {
+	Turnover        float64
+	Brokerage       float64
+	STT             float64
+	ExchangeCharges float64
+	SEBIFees        float64
+	StampDuty       float64
+	GST             float64
+}
+
+// Total returns the sum of all charges.
+func (c ChargeBreakdown) Total() float64 {
+	return c.Brokerage + c.STT + c.ExchangeCharges + c.SEBIFees + c.StampDuty + c.GST
+}
+
+// sub returns c less o.
+func (c ChargeBreakdown) sub(o ChargeBreakdown) ChargeBreakdown {
+	return ChargeBreakdown{
+		Turnover:        c.Turnover - o.Turnover,
+		Brokerage:       paise(c.Brokerage - o.Brokerage),
+		STT:             paise(c.STT - o.STT),
+		ExchangeCharges: paise(c.ExchangeCharges - o.ExchangeCharges),
+		SEBIFees:        paise(c.SEBIFees - o.SEBIFees),
+		StampDuty:       paise(c.StampDuty - o.StampDuty),
+		GST:             paise(c.GST - o.GST),
+	}
+}
+
+// Add returns the sum of two breakdowns.
+func (c ChargeBreakdown) Add(o ChargeBreakdown) ChargeBreakdown {
+	return ChargeBreakdown{
+		Turnover:        c.Turnover + o.Turnover,
+		Brokerage:       c.Brokerage + o.Brokerage,
+		STT:             c.STT + o.STT,
+		ExchangeCharges: c.ExchangeCharges + o.ExchangeCharges,
+		SEBIFees:        c.SEBIFees + o.SEBIFees,
+		StampDuty:       c.StampDuty + o.StampDuty,
+		GST:             c.GST + o.GST,
+	}
+}
+
+// ChargeRates are the rates of one segment. Rates are fractions of
+// turnover, so 0.001 is 0.1%. Brokerage is BrokerageRate of turnover
+// capped at BrokerageMax, or BrokerageFlat per trade when BrokerageRate is
+// zero. Exchange transaction rates are per exchange.
+type ChargeRates struct {
+	BrokerageFlat float64
+	BrokerageRate float64
+	BrokerageMax  float64
+	STTBuyRate    float64
+	STTSellRate   float64
+	ExchangeRates map[string]float64
+	SEBIRate      float64
+	StampBuyRate  float64
+}
+
+// ChargeTable is a version of the rates, in force from Effective until the
+// next version.
+type ChargeTable struct {
+	Version   string
+	Effective time.Time
+	GSTRate   float64
+	Segments  map[string]ChargeRates
+}
+
+// sebiRate is SEBI's turnover fee of Rs 10 per crore.
+const sebiRate = 10.0 / 1e7
+
+// DefaultChargeTables are the statutory rates since April 2023 and after
+// the October 2024 revision of STT on derivatives and exchange charges.
+// Brokerage is that of a typical discount plan, Rs 20 or 0.03% per
+// executed order and free delivery; set your own plan's rates.
+var DefaultChargeTables = []ChargeTable{
+	{
+		Version:   "2023-04",
+		Effective: time.Date(2023, 4, 1, 0, 0, 0, 0, IST),
+		GSTRate:   0.18,
+		Segments: map[string]ChargeRates{
+			SegmentEquityDelivery: {
+				STTBuyRate: 0.001, STTSellRate: 0.001,
+				ExchangeRates: map[string]float64{ExchangeTypeNSE: 0.0000325, ExchangeTypeBSE: 0.0000375},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00015,
+			},
+			SegmentEquityIntraday: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.00025,
+				ExchangeRates: map[string]float64{ExchangeTypeNSE: 0.0000325, ExchangeTypeBSE: 0.0000375},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+			SegmentEquityFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.000125,
+				ExchangeRates: map[string]float64{ExchangeTypeNFO: 0.000019},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00002,
+			},
+			SegmentEquityOptions: {
+				BrokerageFlat: 20, STTSellRate: 0.000625,
+				ExchangeRates: map[string]float64{ExchangeTypeNFO: 0.0005},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+			SegmentCurrencyFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20,
+				ExchangeRates: map[string]float64{ExchangeTypeCDS: 0.000009},
+				SEBIRate:      sebiRate, StampBuyRate: 0.000001,
+			},
+			SegmentCurrencyOptions: {
+				BrokerageFlat: 20,
+				ExchangeRates: map[string]float64{ExchangeTypeCDS: 0.00035},
+				SEBIRate:      sebiRate, StampBuyRate: 0.000001,
+			},
+			SegmentCommodityFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.0001,
+				ExchangeRates: map[string]float64{ExchangeTypeMCX: 0.000021},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00002,
+			},
+			SegmentCommodityOptions: {
+				BrokerageFlat: 20, STTSellRate: 0.0005,
+				ExchangeRates: map[string]float64{ExchangeTypeMCX: 0.0005},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+		},
+	},
+	{
+		Version:   "2024-10",
+		Effective: time.Date(2024, 10, 1, 0, 0, 0, 0, IST),
+		GSTRate:   0.18,
+		Segments: map[string]ChargeRates{
+			SegmentEquityDelivery: {
+				STTBuyRate: 0.001, STTSellRate: 0.001,
+				ExchangeRates: map[string]float64{ExchangeTypeNSE: 0.0000297, ExchangeTypeBSE: 0.0000375},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00015,
+			},
+			SegmentEquityIntraday: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.00025,
+				ExchangeRates: map[string]float64{ExchangeTypeNSE: 0.0000297, ExchangeTypeBSE: 0.0000375},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+			SegmentEquityFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.0002,
+				ExchangeRates: map[string]float64{ExchangeTypeNFO: 0.0000173},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00002,
+			},
+			SegmentEquityOptions: {
+				BrokerageFlat: 20, STTSellRate: 0.001,
+				ExchangeRates: map[string]float64{ExchangeTypeNFO: 0.0003503},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+			SegmentCurrencyFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20,
+				ExchangeRates: map[string]float64{ExchangeTypeCDS: 0.0000035},
+				SEBIRate:      sebiRate, StampBuyRate: 0.000001,
+			},
+			SegmentCurrencyOptions: {
+				BrokerageFlat: 20,
+				ExchangeRates: map[string]float64{ExchangeTypeCDS: 0.000311},
+				SEBIRate:      sebiRate, StampBuyRate: 0.000001,
+			},
+			SegmentCommodityFutures: {
+				BrokerageRate: 0.0003, BrokerageMax: 20, STTSellRate: 0.0001,
+				ExchangeRates: map[string]float64{ExchangeTypeMCX: 0.000021},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00002,
+			},
+			SegmentCommodityOptions: {
+				BrokerageFlat: 20, STTSellRate: 0.0005,
+				ExchangeRates: map[string]float64{ExchangeTypeMCX: 0.000418},
+				SEBIRate:      sebiRate, StampBuyRate: 0.00003,
+			},
+		},
+	},
+}
+
+// SegmentOf returns the charge segment of a trade. Derivative symbols
+// ending in CE or PE are options, other derivatives are futures.
+func SegmentOf(exchange, productType, tradingSymbol string) string {
+	option := strings.HasSuffix(tradingSymbol, "CE") || strings.HasSuffix(tradingSymbol, "PE")
+	switch exchange {
+	case ExchangeTypeNSE, ExchangeTypeBSE:
+		if productType == ProductTypeIntraday {
+			return SegmentEquityIntraday
+		}
+		return SegmentEquityDelivery
+	case ExchangeTypeCDS:
+		if option {
+			return SegmentCurrencyOptions
+		}
+		return SegmentCurrencyFutures
+	case ExchangeTypeMCX:
+		if option {
+			return SegmentCommodityOptions
+		}
+		return SegmentCommodityFutures
+	default:
+		if option {
+			return SegmentEquityOptions
+		}
+		return SegmentEquityFutures
+	}
+}
+
+// ChargeCalculator computes charges with the rate table in force on the
+// day of each trade. It implements ChargeModel, so it can be used by the
+// Backtester and the PaperBroker.
+type ChargeCalculator struct {
+	tables []ChargeTable
+}
+
+// NewChargeCalculator initializes a calculator with tables, or with
+// DefaultChargeTables when none are given.
+func NewChargeCalculator(tables ...ChargeTable) *ChargeCalculator {
+	if len(tables) == 0 {
+		tables = DefaultChargeTables
+	}
+	sorted := append([]ChargeTable(nil), tables...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Effective.Before(sorted[j].Effective) })
+	return &ChargeCalculator{tables: sorted}
+}
+
+// Table returns the rate table in force at t.
+func (c *ChargeCalculator) Table(t time.Time) (ChargeTable, bool) {
+	for i := len(c.tables) - 1; i >= 0; i-- {
+		if !t.Before(c.tables[i].Effective) {
+			return c.tables[i], true
+		}
+	}
+	return ChargeTable{}, false
+}
+
+// Calculate returns the charges on tr. A trade without a time is charged
+// at today's rates. Each charge is rounded to the paisa.
+func (c *ChargeCalculator) Calculate(tr ChargeTrade) (ChargeBreakdown, error) {
+	at := tr.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	table, ok := c.Table(at)
+	if !ok {
+		return ChargeBreakdown{}, fmt.Errorf("no charge table in force on %s", at.In(IST).Format("2006-01-02"))
+	}
+	segment := tr.Segment
+	if segment == "" {
+		segment = SegmentOf(tr.Exchange, tr.ProductType, tr.TradingSymbol)
+	}
+	rates, ok := table.Segments[segment]
+	if !ok {
+		return ChargeBreakdown{}, fmt.Errorf("charge table %s has no rates for %s", table.Version, segment)
+	}
+	exchangeRate, ok := rates.ExchangeRates[tr.Exchange]
+	if !ok {
+		return ChargeBreakdown{}, fmt.Errorf("charge table %s has no %s exchange rate for %s", table.Version, segment, tr.Exchange)
+	}
+
+	turnover := tr.Price * float64(tr.Quantity)
+	brokerage := rates.BrokerageFlat
+	if rates.BrokerageRate > 0 {
+		brokerage = turnover * rates.BrokerageRate
+		if rates.BrokerageMax > 0 && brokerage > rates.BrokerageMax {
+			brokerage = rates.BrokerageMax
+		}
+	}
+
+	b := ChargeBreakdown{
+		Turnover:        turnover,
+		Brokerage:       paise(brokerage),
+		ExchangeCharges: paise(turnover * exchangeRate),
+		SEBIFees:        paise(turnover * rates.SEBIRate),
+	}
+	if tr.OrderType == OrderTypeBuy {
+		b.STT = paise(turnover * rates.STTBuyRate)
+		b.StampDuty = paise(turnover * rates.StampBuyRate)
+	} else {
+		b.STT = paise(turnover * rates.STTSellRate)
+	}
+	b.GST = paise((b.Brokerage + b.ExchangeCharges + b.SEBIFees) * table.GSTRate)
+	return b, nil
+}
+
+func paise(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// ForFill returns the charges on a fill from Trades() or a PaperBroker.
+func (c *ChargeCalculator) ForFill(f Fill) (ChargeBreakdown, error) {
+	return c.Calculate(ChargeTrade{
+		Exchange:      f.Exchange,
+		TradingSymbol: f.TradingSymbol,
+		ProductType:   f.ProductType,
+		OrderType:     f.OrderType,
+		Quantity:      f.Quantity,
+		Price:         f.Price,
+		Time:          f.Time,
+	})
+}
+
+// ForFills returns the total charges on fills and the charges on each.
+// Fills of the same order are charged together, so brokerage is charged
+// and capped once per order: each fill costs the charges on its order's
+// fills so far less what the earlier ones cost. Fills that cannot be
+// charged are left at zero and reported in the error.
+func (c *ChargeCalculator) ForFills(fills []Fill) (ChargeBreakdown, []ChargeBreakdown, error) {
+	var total ChargeBreakdown
+	each := make([]ChargeBreakdown, len(fills))
+	orders := make(map[string]Fill)
+	charged := make(map[string]ChargeBreakdown)
+	var firstErr error
+	for i, f := range fills {
+		if f.OrderID != "" {
+			f = mergeFill(orders[f.OrderID], f)
+		}
+		b, err := c.ForFill(f)
+		if err == nil && f.OrderID != "" {
+			orders[f.OrderID] = f
+			b, charged[f.OrderID] = b.sub(charged[f.OrderID]), b
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("fill %s: %w", f.FillID, err)
+			}
+			continue
+		}
+		each[i] = b
+		total = total.Add(b)
+	}
+	return total, each, firstErr
+}
+
+// Charges implements ChargeModel. It charges f on its own; the
+// PaperBroker and Backtester pass it the fills of an order together so
+// brokerage is charged once per order. Fills that cannot be charged cost
+// nothing.
+func (c *ChargeCalculator) Charges(f Fill) float64 {
+	b, err := c.ForFill(f)
+	if err != nil {
+		return 0
+	}
+	return b.Total()
+}
+
+// TradeCharges fetches Trades() and returns the charges on the day's
+// fills.
+func (io *IntegrateOrders) TradeCharges(c *ChargeCalculator) (ChargeBreakdown, error) {
+	fills, err := io.ListTrades()
+	if err != nil {
+		return ChargeBreakdown{}, err
+	}
+	total, _, err := c.ForFills(fills)
+	return total, err
+}
@@ -0,0 +1,126 @@
+package integrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChargeCalculatorCalculate(t *testing.T) {
+	c := NewChargeCalculator()
+	tests := []struct {
+		name    string
+		trade   ChargeTrade
+		want    ChargeBreakdown
+		wantErr bool
+	}{
+		{
+			name: "intraday sell capped brokerage",
+			trade: ChargeTrade{Exchange: ExchangeTypeNSE, ProductType: ProductTypeIntraday, OrderType: OrderTypeSell,
+				Quantity: 100, Price: 1000, Time: time.Date(2025, 1, 2, 10, 0, 0, 0, IST)},
+			want: ChargeBreakdown{Turnover: 100000, Brokerage: 20, STT: 25, ExchangeCharges: 2.97, SEBIFees: 0.1, GST: 4.15},
+		},
+		{
+			name: "intraday buy pays stamp duty",
+			trade: ChargeTrade{Exchange: ExchangeTypeNSE, ProductType: ProductTypeIntraday, OrderType: OrderTypeBuy,
+				Quantity: 10, Price: 1000, Time: time.Date(2025, 1, 2, 10, 0, 0, 0, IST)},
+			want: ChargeBreakdown{Turnover: 10000, Brokerage: 3, ExchangeCharges: 0.3, SEBIFees: 0.01, StampDuty: 0.3, GST: 0.6},
+		},
+		{
+			name: "option sell on the earlier table",
+			trade: ChargeTrade{Exchange: ExchangeTypeNFO, TradingSymbol: "NIFTY24SEP25000CE", OrderType: OrderTypeSell,
+				Quantity: 75, Price: 100, Time: time.Date(2024, 9, 2, 10, 0, 0, 0, IST)},
+			want: ChargeBreakdown{Turnover: 7500, Brokerage: 20, STT: 4.69, ExchangeCharges: 3.75, SEBIFees: 0.01, GST: 4.28},
+		},
+		{
+			name:    "before the first table",
+			trade:   ChargeTrade{Exchange: ExchangeTypeNSE, OrderType: OrderTypeBuy, Quantity: 1, Price: 1, Time: time.Date(2020, 1, 1, 10, 0, 0, 0, IST)},
+			wantErr: true,
+		},
+		{
+			name: "no exchange rate for the segment",
+			trade: ChargeTrade{Exchange: "XX", Segment: SegmentEquityIntraday, OrderType: OrderTypeBuy,
+				Quantity: 1, Price: 1, Time: time.Date(2025, 1, 2, 10, 0, 0, 0, IST)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Calculate(tt.trade)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChargeCalculatorForFills(t *testing.T) {
+	c := NewChargeCalculator()
+	at := time.Date(2025, 1, 10, 10, 0, 0, 0, IST)
+	fill := func(id, orderID string, qty int) Fill {
+		return Fill{FillID: id, OrderID: orderID, Exchange: ExchangeTypeNSE, TradingSymbol: "INFY-EQ",
+			OrderType: OrderTypeBuy, ProductType: ProductTypeIntraday, Quantity: qty, Price: 1000, Time: at}
+	}
+	bad := fill("9", "C", 10)
+	bad.Exchange = "XX"
+
+	tests := []struct {
+		name      string
+		fills     []Fill
+		brokerage []float64
+		total     float64
+		wantErr   bool
+	}{
+		{
+			name:      "partial fills share the order cap",
+			fills:     []Fill{fill("1", "A", 100), fill("2", "A", 100)},
+			brokerage: []float64{20, 0},
+			total:     20,
+		},
+		{
+			name:      "partial fills below the cap",
+			fills:     []Fill{fill("1", "A", 10), fill("2", "A", 20)},
+			brokerage: []float64{3, 6},
+			total:     9,
+		},
+		{
+			name:      "separate orders are capped separately",
+			fills:     []Fill{fill("1", "A", 100), fill("2", "B", 100)},
+			brokerage: []float64{20, 20},
+			total:     40,
+		},
+		{
+			name:      "fills without an order id are charged alone",
+			fills:     []Fill{fill("1", "", 100), fill("2", "", 100)},
+			brokerage: []float64{20, 20},
+			total:     40,
+		},
+		{
+			name:      "uncharged fill is zero and reported",
+			fills:     []Fill{fill("1", "A", 10), bad},
+			brokerage: []float64{3, 0},
+			total:     3,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, each, err := c.ForFills(tt.fills)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if total.Brokerage != tt.total {
+				t.Fatalf("total brokerage = %v, want %v", total.Brokerage, tt.total)
+			}
+			for i, b := range each {
+				if b.Brokerage != tt.brokerage[i] {
+					t.Fatalf("fill %d brokerage = %v, want %v", i, b.Brokerage, tt.brokerage[i])
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package integrate
 import (
     "archive/zip"
     "bytes"
+    "context"
     "crypto/sha256"
     "encoding/csv"
     "encoding/hex"
@@ -28,6 +29,8 @@ type ConnectToIntegrate struct {
     APISessionKey        string
     WSSessionKey         string
     HTTPClient           *http.Client
+    Limiter              *RateLimiter
+    ctx                  context.Context
     ExchangeTypes        []string
     OrderTypes           []string
     PriceTypes           []string
@@ -68,6 +71,12 @@ const (
 	ProductTypeNormal   = "NORMAL"
 )
 
+// Constants for position types
+const (
+	PositionTypeDay       = "DAY"
+	PositionTypeOvernight = "OVERNIGHT"
+)
+
 // Constants for subscription types
 const (
 	SubscriptionTypeTick  = "TICK"
@@ -133,6 +142,7 @@ func NewConnectToIntegrate(loginURL, baseURL string, timeout int, logging bool,
 		LoginURL:               loginURL,
 		BaseURL:                baseURL,
 		SessionExpiredCallback: nil, // Set a callback function if needed
+		Limiter:                NewRateLimiter(defaultRequestsPerSecond, defaultRequestBurst),
 
 		// Initialize exchange, order, price, product, and subscription types
 		ExchangeTypes:       []string{"NSE", "BSE", "NFO", "CDS", "MCX"},
@@ -334,6 +344,14 @@ func downloadSymbols() error {
 }
 
 
+// withContext returns a copy of c whose requests wait for the rate limit
+// and run under ctx.
+func (c *ConnectToIntegrate) withContext(ctx context.Context) *ConnectToIntegrate {
+	cc := *c
+	cc.ctx = ctx
+	return &cc
+}
+
 //function to send request
 func (s *YourStruct) sendRequest(
 	routePrefix string,
@@ -355,8 +373,14 @@ func (s *YourStruct) sendRequest(
 		urlStr += "?" + query.Encode()
 	}
 
+	// Requests run under the context of a WithContext view, if any
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	// Create a new HTTP request
-	req, err := http.NewRequest(method, urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -401,6 +425,11 @@ func (s *YourStruct) sendRequest(
 		fmt.Printf("Request: %s %s %v\n", method, urlStr, headers)
 	}
 
+	// Every request spends a token of the session's rate limit
+	if err := s.Limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSent, err)
+	}
+
 	// Make the HTTP request
 	client := &http.Client{
 		Timeout: s.Timeout,
@@ -0,0 +1,260 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ConversionResult is the outcome of converting one position.
+type ConversionResult struct {
+	Position Position
+	From     string
+	To       string
+	Quantity int
+	Margin   float64
+	Skipped  string
+	Err      error
+}
+
+// OK reports whether the position was converted.
+func (r ConversionResult) OK() bool {
+	return r.Skipped == "" && r.Err == nil
+}
+
+// ConversionReport lists the result for every position considered.
+type ConversionReport struct {
+	Time      time.Time
+	Available float64
+	Results   []ConversionResult
+}
+
+// Converted returns the results of the positions that were converted.
+func (r ConversionReport) Converted() []ConversionResult {
+	var ok []ConversionResult
+	for _, res := range r.Results {
+		if res.OK() {
+			ok = append(ok, res)
+		}
+	}
+	return ok
+}
+
+// Failed returns the results of the conversions that were attempted and
+// failed.
+func (r ConversionReport) Failed() []ConversionResult {
+	var failed []ConversionResult
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// CarryProduct returns the product an intraday position on exchange is
+// carried overnight in: CNC for cash equity, NORMAL for derivatives.
+func CarryProduct(exchange string) string {
+	if exchange == ExchangeTypeNSE || exchange == ExchangeTypeBSE {
+		return ProductTypeCNC
+	}
+	return ProductTypeNormal
+}
+
+// ConvertPosition converts the open quantity of p to product to: the
+// quantity traded today as a DAY position and the quantity carried from
+// earlier sessions as an OVERNIGHT one.
+func (io *IntegrateOrders) ConvertPosition(ctx context.Context, p Position, to string) error {
+	if !p.Open() {
+		return errors.New("position is not open")
+	}
+	if p.ProductType == to {
+		return fmt.Errorf("position is already %s", to)
+	}
+	if to == ProductTypeCNC && CarryProduct(p.Exchange) != ProductTypeCNC {
+		return fmt.Errorf("CNC is not available on %s", p.Exchange)
+	}
+	if to == ProductTypeCNC && p.NetQuantity < 0 {
+		return errors.New("a short position cannot be converted to CNC")
+	}
+
+	if err := io.convert(ctx, p, to, p.DayQuantity(), PositionTypeDay); err != nil {
+		return err
+	}
+	if err := io.convert(ctx, p, to, p.CarriedQuantity(), PositionTypeOvernight); err != nil {
+		return fmt.Errorf("overnight quantity: %w", err)
+	}
+	return nil
+}
+
+// convert converts qty of p, signed like a net quantity, held as
+// positionType to product to. A zero qty is a no-op.
+func (io *IntegrateOrders) convert(ctx context.Context, p Position, to string, qty int, positionType string) error {
+	if qty == 0 {
+		return nil
+	}
+	orderType := OrderTypeBuy
+	if qty < 0 {
+		orderType = OrderTypeSell
+	}
+	_, err := io.WithContext(ctx).ConvertPositionProductType(p.Exchange, orderType, p.ProductType, to, abs(qty), p.TradingSymbol, positionType)
+	return err
+}
+
+// conversionMargin estimates the extra margin converting p from its
+// product to another needs, as the margin of the position in the new
+// product less that in the current one.
+func (io *IntegrateOrders) conversionMargin(ctx context.Context, p Position, to string) (float64, error) {
+	orderType := OrderTypeBuy
+	if p.NetQuantity < 0 {
+		orderType = OrderTypeSell
+	}
+	price := p.LastPrice
+	if price <= 0 {
+		price = p.NetAveragePrice
+	}
+	req := OrderRequest{
+		Exchange:      p.Exchange,
+		OrderType:     orderType,
+		Price:         price,
+		PriceType:     PriceTypeLimit,
+		ProductType:   to,
+		Quantity:      abs(p.NetQuantity),
+		TradingSymbol: p.TradingSymbol,
+		Validity:      ValidityTypeDay,
+	}
+
+	after, err := io.WithContext(ctx).RequiredMargin([]OrderRequest{req})
+	if err != nil {
+		return 0, err
+	}
+	req.ProductType = p.ProductType
+	before, err := io.WithContext(ctx).RequiredMargin([]OrderRequest{req})
+	if err != nil {
+		return 0, err
+	}
+	return after - before, nil
+}
+
+// CarryIntradayPositions converts open INTRADAY positions accepted by
+// keep to to, or to CarryProduct of their exchange when to is empty, so
+// they are held overnight. keep is required; pass one that checks
+// UnrealizedPnL to carry only winning trades.
+//
+// Positions are skipped once their exchange's square-off cutoff has passed,
+// and when the extra margin the conversion needs is more than the funds
+// still available after the positions converted before them.
+func (io *IntegrateOrders) CarryIntradayPositions(ctx context.Context, to string, keep func(Position) bool) (ConversionReport, error) {
+	report := ConversionReport{Time: time.Now()}
+	if keep == nil {
+		return report, errors.New("keep is required")
+	}
+
+	limits, err := io.WithContext(ctx).AccountLimits()
+	if err != nil {
+		return report, fmt.Errorf("limits: %w", err)
+	}
+	report.Available = limits.Available()
+	available := report.Available
+
+	positions, err := io.WithContext(ctx).ListPositions()
+	if err != nil {
+		return report, fmt.Errorf("positions: %w", err)
+	}
+
+	for _, p := range positions {
+		if !p.Open() || p.ProductType != ProductTypeIntraday || !keep(p) {
+			continue
+		}
+		target := to
+		if target == "" {
+			target = CarryProduct(p.Exchange)
+		}
+		res := ConversionResult{Position: p, From: p.ProductType, To: target, Quantity: abs(p.NetQuantity)}
+
+		switch {
+		case !report.Time.Before(SquareOffCutoff(p.Exchange, report.Time)):
+			res.Skipped = "square-off cutoff has passed"
+		case target == ProductTypeCNC && p.NetQuantity < 0:
+			res.Skipped = "short positions cannot be held as CNC"
+		case target == ProductTypeCNC && CarryProduct(p.Exchange) != ProductTypeCNC:
+			res.Skipped = "CNC is not available on " + p.Exchange
+		}
+		if res.Skipped == "" {
+			res.Margin, res.Err = io.conversionMargin(ctx, p, target)
+			if res.Err == nil && res.Margin > available {
+				res.Skipped = fmt.Sprintf("needs %.2f margin, %.2f available", res.Margin, available)
+			}
+		}
+		if res.Skipped == "" && res.Err == nil {
+			if res.Err = io.ConvertPosition(ctx, p, target); res.Err == nil {
+				available -= res.Margin
+			}
+		}
+
+		if io.logging {
+			switch {
+			case res.Err != nil:
+				logger.Printf("carry %s %s: %v", p.Exchange, p.TradingSymbol, res.Err)
+			case res.Skipped != "":
+				logger.Printf("carry %s %s: skipped, %s", p.Exchange, p.TradingSymbol, res.Skipped)
+			default:
+				logger.Printf("carry %s %s: %d converted to %s", p.Exchange, p.TradingSymbol, res.Quantity, target)
+			}
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+// RevertCarriedPositions converts the quantity of open NORMAL and CNC
+// positions accepted by keep that was opened today back to INTRADAY,
+// undoing CarryIntradayPositions. keep is required. Quantity carried from
+// earlier sessions stays in its product, and positions with nothing opened
+// today are skipped. Positions are also skipped once the square-off cutoff
+// has passed, since they would be squared off straight away.
+func (io *IntegrateOrders) RevertCarriedPositions(ctx context.Context, keep func(Position) bool) (ConversionReport, error) {
+	report := ConversionReport{Time: time.Now()}
+	if keep == nil {
+		return report, errors.New("keep is required")
+	}
+
+	positions, err := io.WithContext(ctx).ListPositions()
+	if err != nil {
+		return report, fmt.Errorf("positions: %w", err)
+	}
+
+	for _, p := range positions {
+		if !p.Open() || (p.ProductType != ProductTypeNormal && p.ProductType != ProductTypeCNC) || !keep(p) {
+			continue
+		}
+		// Only the part of today's quantity that is still open is reverted.
+		qty := p.DayQuantity()
+		if abs(qty) > abs(p.NetQuantity) {
+			qty = p.NetQuantity
+		}
+		res := ConversionResult{Position: p, From: p.ProductType, To: ProductTypeIntraday, Quantity: abs(qty)}
+		switch {
+		case qty == 0 || (qty < 0) != (p.NetQuantity < 0):
+			res.Skipped = "no open quantity from today"
+		case !report.Time.Before(SquareOffCutoff(p.Exchange, report.Time)):
+			res.Skipped = "square-off cutoff has passed"
+		default:
+			res.Err = io.convert(ctx, p, ProductTypeIntraday, qty, PositionTypeDay)
+		}
+
+		if io.logging {
+			switch {
+			case res.Err != nil:
+				logger.Printf("revert %s %s: %v", p.Exchange, p.TradingSymbol, res.Err)
+			case res.Skipped != "":
+				logger.Printf("revert %s %s: skipped, %s", p.Exchange, p.TradingSymbol, res.Skipped)
+			default:
+				logger.Printf("revert %s %s: %d converted to INTRADAY", p.Exchange, p.TradingSymbol, res.Quantity)
+			}
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
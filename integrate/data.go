@@ -1,6 +1,7 @@
 package integrate
 
 import (
+    "context"
     "errors"
     "fmt"
     "strconv"
@@ -21,6 +22,15 @@ func NewIntegrateData(c2i *ConnectToIntegrate, logging bool) *IntegrateData {
     }
 }
 
+// WithContext returns a view of ic whose requests wait for the rate limit
+// and run under ctx.
+func (ic *IntegrateData) WithContext(ctx context.Context) *IntegrateData {
+    return &IntegrateData{
+        c2i:     ic.c2i.withContext(ctx),
+        logging: ic.logging,
+    }
+}
+
 // HistoricalData retrieves historical data for a security.
 // Returns data as a channel of maps, similar to Python's generator.
 func (ic *IntegrateData) HistoricalData(exchange, tradingSymbol, timeframe string, start, end time.Time) (<-chan map[string]interface{}, <-chan error, error) {
@@ -99,6 +109,11 @@ func (ic *IntegrateData) Quotes(exchange, tradingSymbol string) (map[string]inte
         return nil, err
     }
 
+    return ic.quotesByToken(exchange, token)
+}
+
+// quotesByToken retrieves the quote for an already resolved token.
+func (ic *IntegrateData) quotesByToken(exchange, token string) (map[string]interface{}, error) {
     route := fmt.Sprintf("%s/quotes/%s/%s", ic.c2i.baseURL, exchange, token)
     return ic.c2i.sendRequest(route, "GET")
 }
@@ -147,6 +162,16 @@ func (ic *IntegrateData) getToken(exchange, tradingSymbol string) (string, error
     return "", fmt.Errorf("token not found for %s in symbols file", tradingSymbol)
 }
 
+// findSymbol returns the symbol master record for a trading symbol.
+func findSymbol(c2i *ConnectToIntegrate, exchange, tradingSymbol string) (map[string]interface{}, bool) {
+    for _, symbol := range c2i.Symbols {
+        if symbol["segment"] == exchange && symbol["trading_symbol"] == tradingSymbol {
+            return symbol, true
+        }
+    }
+    return nil, false
+}
+
 func parseDate(dateStr string) time.Time {
     dt, err := time.Parse("020120061504", dateStr)
     if err != nil {
@@ -174,3 +199,50 @@ func toInt(s string) int {
     }
     return i
 }
+
+// fieldString reads a response field as a string regardless of its JSON type.
+func fieldString(m map[string]interface{}, key string) string {
+    switch v := m[key].(type) {
+    case string:
+        return v
+    case nil:
+        return ""
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64)
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+// fieldFloat reads a numeric response field. The API sends most numbers as
+// strings, so both forms are accepted.
+func fieldFloat(m map[string]interface{}, key string) float64 {
+    switch v := m[key].(type) {
+    case float64:
+        return v
+    case int:
+        return float64(v)
+    case string:
+        return toFloat(strings.TrimSpace(v))
+    default:
+        return 0.0
+    }
+}
+
+// fieldInt reads an integral response field.
+func fieldInt(m map[string]interface{}, key string) int {
+    switch v := m[key].(type) {
+    case float64:
+        return int(v)
+    case int:
+        return v
+    case string:
+        v = strings.TrimSpace(v)
+        if i, err := strconv.Atoi(v); err == nil {
+            return i
+        }
+        return int(toFloat(v))
+    default:
+        return 0
+    }
+}
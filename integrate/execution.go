@@ -0,0 +1,461 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Constants for execution algorithms
+const (
+	ExecAlgoTWAP    = "TWAP"
+	ExecAlgoVWAP    = "VWAP"
+	ExecAlgoIceberg = "ICEBERG"
+)
+
+// Constants for execution status
+const (
+	ExecStatusWaiting   = "WAITING"
+	ExecStatusRunning   = "RUNNING"
+	ExecStatusPaused    = "PAUSED"
+	ExecStatusDone      = "DONE"
+	ExecStatusPartial   = "PARTIAL"
+	ExecStatusCancelled = "CANCELLED"
+	ExecStatusFailed    = "FAILED"
+)
+
+// Defaults for retiring a child order
+const (
+	defaultExecChildPoll    = 500 * time.Millisecond
+	defaultExecChildTimeout = 30 * time.Second
+)
+
+// ExecChild is one child limit order sent by an execution algorithm.
+type ExecChild struct {
+	OrderID  string
+	Time     time.Time
+	Quantity int
+	Price    float64
+	Filled   int
+	AvgPrice float64
+	Status   string
+}
+
+// ExecutionReport is the progress of an execution algorithm.
+type ExecutionReport struct {
+	Algo          string
+	TradingSymbol string
+	OrderType     string
+	Quantity      int
+	Target        int
+	Filled        int
+	AvgPrice      float64
+	Status        string
+	Started       time.Time
+	Finished      time.Time
+	Children      []ExecChild
+	Err           error
+}
+
+// Remaining returns the quantity not yet filled.
+func (r ExecutionReport) Remaining() int {
+	return r.Quantity - r.Filled
+}
+
+// ExecutionAlgo works a parent order between Start and End in lot-aligned
+// child LIMIT orders, one at a time. Every Interval the open child is
+// cancelled and a new one is sent for the shortfall against the schedule,
+// priced at the best bid for a BUY and the best ask for a SELL, or across
+// the spread when Aggressive is set. With MaxParticipation, no child is
+// larger than that fraction of the volume traded since the previous one.
+type ExecutionAlgo struct {
+	orders           *IntegrateOrders
+	data             *IntegrateData
+	algo             string
+	req              OrderRequest
+	Start            time.Time
+	End              time.Time
+	Interval         time.Duration
+	MaxParticipation float64
+	Aggressive       bool
+	logging          bool
+
+	// weight returns the fraction of the parent due by t.
+	weight func(t time.Time) float64
+	lot    int
+
+	mu         sync.Mutex
+	report     ExecutionReport
+	paused     bool
+	child      int
+	lastVolume int
+}
+
+// NewTWAP initializes a TWAP of req from start to end, with a child order
+// every interval. The price fields of req are ignored.
+func NewTWAP(orders *IntegrateOrders, data *IntegrateData, req OrderRequest, start, end time.Time, interval time.Duration, logging bool) (*ExecutionAlgo, error) {
+	a, err := newExecutionAlgo(orders, data, ExecAlgoTWAP, req, start, end, interval, logging)
+	if err != nil {
+		return nil, err
+	}
+	span := end.Sub(start).Seconds()
+	a.weight = func(t time.Time) float64 {
+		return math.Min(1, math.Max(0, t.Sub(start).Seconds()/span))
+	}
+	return a, nil
+}
+
+// NewVWAP initializes a VWAP of req from start to end that follows the
+// average minute volume profile of the previous lookbackDays sessions.
+func NewVWAP(orders *IntegrateOrders, data *IntegrateData, req OrderRequest, start, end time.Time, interval time.Duration, lookbackDays int, logging bool) (*ExecutionAlgo, error) {
+	a, err := newExecutionAlgo(orders, data, ExecAlgoVWAP, req, start, end, interval, logging)
+	if err != nil {
+		return nil, err
+	}
+	if lookbackDays <= 0 {
+		return nil, errors.New("lookback must be at least one day")
+	}
+
+	session := SessionFor(req.Exchange)
+	to := istMidnight(start)
+	from := to.AddDate(0, 0, -(lookbackDays*7/5 + 3))
+	candles, err := data.HistoricalCandles(req.Exchange, req.TradingSymbol, TimeframeTypeMin, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("vwap volume profile: %w", err)
+	}
+
+	profile := volumeProfile(candles, session, lookbackDays)
+	offset := func(t time.Time) float64 {
+		return t.Sub(session.OpenOn(t)).Minutes()
+	}
+	cumulative := func(t time.Time) float64 {
+		total := 0.0
+		for minute, v := range profile {
+			if float64(minute) < offset(t) {
+				total += v
+			}
+		}
+		return total
+	}
+
+	first, last := cumulative(start), cumulative(end)
+	if last <= first {
+		return nil, errors.New("no volume history for the vwap window")
+	}
+	a.weight = func(t time.Time) float64 {
+		if !t.Before(end) {
+			return 1
+		}
+		return math.Min(1, math.Max(0, (cumulative(t)-first)/(last-first)))
+	}
+	return a, nil
+}
+
+// volumeProfile returns the total volume by minute of the session over the
+// most recent days of candles.
+func volumeProfile(candles []Candle, session TradingSession, days int) []float64 {
+	minutes := int((session.Close - session.Open).Minutes())
+	profile := make([]float64, minutes)
+
+	seen := make(map[time.Time]bool)
+	for i := len(candles) - 1; i >= 0; i-- {
+		c := candles[i]
+		day := istMidnight(c.Time)
+		if !seen[day] {
+			if len(seen) == days {
+				continue
+			}
+			seen[day] = true
+		}
+		m := int(c.Time.Sub(session.OpenOn(c.Time)).Minutes())
+		if m >= 0 && m < minutes {
+			profile[m] += float64(c.Volume)
+		}
+	}
+	return profile
+}
+
+func newExecutionAlgo(orders *IntegrateOrders, data *IntegrateData, algo string, req OrderRequest, start, end time.Time, interval time.Duration, logging bool) (*ExecutionAlgo, error) {
+	if !end.After(start) {
+		return nil, errors.New("end must be after start")
+	}
+	if interval <= 0 || interval > end.Sub(start) {
+		return nil, errors.New("interval must be positive and within the window")
+	}
+	if req.Quantity <= 0 {
+		return nil, errors.New("quantity must be positive")
+	}
+
+	lot := lotSize(orders.c2i, req.Exchange, req.TradingSymbol)
+	if req.Quantity%lot != 0 {
+		return nil, fmt.Errorf("quantity %d is not a multiple of lot size %d", req.Quantity, lot)
+	}
+
+	req.PriceType = PriceTypeLimit
+	req.TriggerPrice = nil
+	if req.Validity == "" {
+		req.Validity = ValidityTypeDay
+	}
+	return &ExecutionAlgo{
+		orders:   orders,
+		data:     data,
+		algo:     algo,
+		req:      req,
+		Start:    start,
+		End:      end,
+		Interval: interval,
+		logging:  logging,
+		lot:      lot,
+		child:    -1,
+		report: ExecutionReport{
+			Algo:          algo,
+			TradingSymbol: req.TradingSymbol,
+			OrderType:     req.OrderType,
+			Quantity:      req.Quantity,
+			Status:        ExecStatusWaiting,
+		},
+	}, nil
+}
+
+// Pause stops the algorithm sending children: at the next interval the open
+// child is cancelled and no new one is sent until Resume. The schedule
+// keeps running, so the shortfall is worked after resuming.
+func (a *ExecutionAlgo) Pause() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = true
+}
+
+// Resume continues a paused algorithm at the next interval.
+func (a *ExecutionAlgo) Resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = false
+}
+
+// Report returns the progress so far.
+func (a *ExecutionAlgo) Report() ExecutionReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r := a.report
+	r.Children = append([]ExecChild(nil), r.Children...)
+	return r
+}
+
+// Run works the order until End, the parent is filled or ctx is done, and
+// returns the final report. The last open child is cancelled on return.
+// The status is DONE when the parent was filled and PARTIAL when the
+// window ended short of it.
+func (a *ExecutionAlgo) Run(ctx context.Context) (ExecutionReport, error) {
+	if wait := time.Until(a.Start); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return a.finish(ctx, ExecStatusCancelled, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+
+	a.mu.Lock()
+	a.report.Status = ExecStatusRunning
+	a.report.Started = time.Now()
+	a.mu.Unlock()
+	if a.logging {
+		logger.Printf("%s %s %d %s: started", a.algo, a.req.OrderType, a.req.Quantity, a.req.TradingSymbol)
+	}
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.step(ctx, time.Now()); err != nil {
+			return a.finish(ctx, ExecStatusFailed, err)
+		}
+
+		a.mu.Lock()
+		done := a.report.Filled >= a.req.Quantity
+		a.mu.Unlock()
+		if done {
+			return a.finish(ctx, ExecStatusDone, nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return a.finish(ctx, ExecStatusCancelled, ctx.Err())
+		case now := <-ticker.C:
+			if !now.Before(a.End) {
+				return a.finish(ctx, ExecStatusDone, nil)
+			}
+		}
+	}
+}
+
+// step retires the open child and sends the next one.
+func (a *ExecutionAlgo) step(ctx context.Context, now time.Time) error {
+	if err := a.retireChild(ctx); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	paused := a.paused
+	if paused {
+		a.report.Status = ExecStatusPaused
+	} else {
+		a.report.Status = ExecStatusRunning
+	}
+	target := int(math.Ceil(a.weight(now.Add(a.Interval))*float64(a.req.Quantity)/float64(a.lot))) * a.lot
+	if target > a.req.Quantity {
+		target = a.req.Quantity
+	}
+	a.report.Target = target
+	need := target - a.report.Filled
+	a.mu.Unlock()
+
+	res := a.data.QuotesMany(ctx, []Instrument{{Exchange: a.req.Exchange, TradingSymbol: a.req.TradingSymbol}})[0]
+	if res.Err != nil {
+		if a.logging {
+			logger.Printf("%s %s: quote failed, skipping interval: %v", a.algo, a.req.TradingSymbol, res.Err)
+		}
+		return nil
+	}
+	q := res.Quote
+
+	a.mu.Lock()
+	traded := q.Volume - a.lastVolume
+	first := a.lastVolume == 0
+	a.lastVolume = q.Volume
+	a.mu.Unlock()
+
+	if paused || need <= 0 {
+		return nil
+	}
+	if a.MaxParticipation > 0 && !first {
+		if limit := int(float64(traded) * a.MaxParticipation); need > limit {
+			need = limit
+		}
+	}
+	need = need / a.lot * a.lot
+	if need <= 0 {
+		return nil
+	}
+
+	price := a.peg(q)
+	if price <= 0 {
+		return nil
+	}
+
+	child := a.req
+	child.Quantity = need
+	child.Price = price
+	r, err := a.orders.WithContext(ctx).PlaceOrderRequest(child)
+	if err != nil {
+		return err
+	}
+	id, err := orderIDFrom(r)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.report.Children = append(a.report.Children, ExecChild{
+		OrderID:  id,
+		Time:     now,
+		Quantity: need,
+		Price:    price,
+		Status:   OrderStatusOpen,
+	})
+	a.child = len(a.report.Children) - 1
+	a.mu.Unlock()
+
+	if a.logging {
+		logger.Printf("%s %s: child %s %d @ %.2f (target %d)", a.algo, a.req.TradingSymbol, id, need, price, target)
+	}
+	return nil
+}
+
+// peg returns the child price from the touch.
+func (a *ExecutionAlgo) peg(q *Quote) float64 {
+	bid, ask := q.Bids[0].Price, q.Asks[0].Price
+	buy := a.req.OrderType == OrderTypeBuy
+	switch {
+	case buy && a.Aggressive, !buy && !a.Aggressive:
+		if ask > 0 {
+			return ask
+		}
+	default:
+		if bid > 0 {
+			return bid
+		}
+	}
+	return q.LTP
+}
+
+// retireChild cancels the open child if it is still working, waits for it
+// to reach a terminal state and records what it filled. The child stays
+// open in the algorithm until then, so a failed cancel is retried at the
+// next call.
+func (a *ExecutionAlgo) retireChild(ctx context.Context) error {
+	a.mu.Lock()
+	idx := a.child
+	var id string
+	if idx >= 0 {
+		id = a.report.Children[idx].OrderID
+	}
+	a.mu.Unlock()
+	if idx < 0 {
+		return nil
+	}
+
+	u, err := orderState(ctx, a.orders, id)
+	if err != nil {
+		return err
+	}
+	if !isTerminalStatus(u.Status) {
+		if _, err := a.orders.WithContext(ctx).CancelOrder(id); err != nil {
+			return fmt.Errorf("cancel child %s: %w", id, err)
+		}
+		if u, err = awaitTerminal(ctx, a.orders, id, defaultExecChildPoll, defaultExecChildTimeout); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.child = -1
+	value := a.report.AvgPrice * float64(a.report.Filled)
+	child := &a.report.Children[idx]
+	child.Filled = u.FilledQuantity
+	child.AvgPrice = u.AveragePrice
+	child.Status = u.Status
+	a.report.Filled += u.FilledQuantity
+	if a.report.Filled > 0 {
+		a.report.AvgPrice = (value + u.AveragePrice*float64(u.FilledQuantity)) / float64(a.report.Filled)
+	}
+	return nil
+}
+
+func (a *ExecutionAlgo) finish(ctx context.Context, status string, err error) (ExecutionReport, error) {
+	// The child is retired even if ctx is done, so nothing is left working.
+	if rerr := a.retireChild(context.WithoutCancel(ctx)); rerr != nil && err == nil {
+		err = rerr
+		status = ExecStatusFailed
+	}
+
+	a.mu.Lock()
+	if status == ExecStatusDone && a.report.Filled < a.req.Quantity {
+		status = ExecStatusPartial
+	}
+	a.report.Status = status
+	a.report.Finished = time.Now()
+	a.report.Err = err
+	a.mu.Unlock()
+
+	r := a.Report()
+	if a.logging {
+		logger.Printf("%s %s: %s, filled %d of %d at %.2f", a.algo, a.req.TradingSymbol, status, r.Filled, r.Quantity, r.AvgPrice)
+	}
+	return r, err
+}
@@ -0,0 +1,578 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Constants for GTT alert kinds
+const (
+	GTTKindSingle = "GTT"
+	GTTKindOCO    = "OCO"
+)
+
+// Constants for GTT alert status
+const (
+	GTTStatusPending   = "PENDING"
+	GTTStatusTriggered = "TRIGGERED"
+	GTTStatusCancelled = "CANCELLED"
+	GTTStatusExpired   = "EXPIRED"
+)
+
+// defaultGTTSyncInterval is used by Run when no positive interval is given.
+const defaultGTTSyncInterval = 30 * time.Second
+
+// GTTAlert is the typed form of a GTT or OCO alert. A single alert uses
+// Condition, AlertPrice, Price and Quantity; an OCO alert uses the
+// Stoploss and Target fields.
+type GTTAlert struct {
+	AlertID          string
+	Kind             string
+	Exchange         string
+	TradingSymbol    string
+	OrderType        string
+	Condition        string
+	AlertPrice       float64
+	Price            float64
+	Quantity         int
+	StoplossPrice    float64
+	StoplossQuantity int
+	TargetPrice      float64
+	TargetQuantity   int
+	Remarks          string
+	Status           string
+	OrderID          string
+	FirstSeen        time.Time
+	Updated          time.Time
+}
+
+// key identifies the alert a desired alert replaces when it has no id:
+// one alert per kind, instrument, side and condition.
+func (a GTTAlert) key() string {
+	return a.Kind + "|" + paperKey(a.Exchange, a.TradingSymbol) + "|" + a.OrderType + "|" + a.Condition
+}
+
+// sameTerms reports whether a and b would place the same alert.
+func (a GTTAlert) sameTerms(b GTTAlert) bool {
+	return a.Kind == b.Kind &&
+		a.Condition == b.Condition &&
+		a.AlertPrice == b.AlertPrice &&
+		a.Price == b.Price &&
+		a.Quantity == b.Quantity &&
+		a.StoplossPrice == b.StoplossPrice &&
+		a.StoplossQuantity == b.StoplossQuantity &&
+		a.TargetPrice == b.TargetPrice &&
+		a.TargetQuantity == b.TargetQuantity
+}
+
+// parseGTTRow converts a row of the pending GTT order book into a GTTAlert.
+func parseGTTRow(row map[string]interface{}) GTTAlert {
+	a := GTTAlert{
+		AlertID:          fieldString(row, "alert_id"),
+		Kind:             GTTKindSingle,
+		Exchange:         fieldString(row, "exchange"),
+		TradingSymbol:    fieldString(row, "tradingsymbol"),
+		OrderType:        fieldString(row, "order_type"),
+		Condition:        fieldString(row, "condition"),
+		AlertPrice:       fieldFloat(row, "alert_price"),
+		Price:            fieldFloat(row, "price"),
+		Quantity:         fieldInt(row, "quantity"),
+		StoplossPrice:    fieldFloat(row, "stoploss_price"),
+		StoplossQuantity: fieldInt(row, "stoploss_quantity"),
+		TargetPrice:      fieldFloat(row, "target_price"),
+		TargetQuantity:   fieldInt(row, "target_quantity"),
+		Remarks:          fieldString(row, "remarks"),
+		Status:           GTTStatusPending,
+	}
+	if row["target_price"] != nil || row["stoploss_price"] != nil {
+		a.Kind = GTTKindOCO
+	}
+	return a
+}
+
+// ValidateGTT checks an alert against the last traded price. A single
+// alert must not trigger immediately: LTP_ABOVE needs an alert price above
+// ltp and LTP_BELOW one below it. An OCO SELL protects a long position and
+// needs stoploss < ltp < target; an OCO BUY needs the reverse. The price
+// checks are skipped when ltp is zero.
+func ValidateGTT(a GTTAlert, ltp float64) error {
+	if a.OrderType != OrderTypeBuy && a.OrderType != OrderTypeSell {
+		return errors.New("invalid order type")
+	}
+	if a.Exchange == "" || a.TradingSymbol == "" {
+		return errors.New("alert needs an exchange and a trading symbol")
+	}
+
+	switch a.Kind {
+	case GTTKindSingle:
+		if a.Condition != GttConditionLtpAbove && a.Condition != GttConditionLtpBelow {
+			return errors.New("invalid GTT condition")
+		}
+		if a.Quantity <= 0 {
+			return errors.New("quantity must be positive")
+		}
+		if a.AlertPrice <= 0 || a.Price < 0 {
+			return errors.New("alert price must be positive")
+		}
+		if ltp <= 0 {
+			return nil
+		}
+		if a.Condition == GttConditionLtpAbove && a.AlertPrice <= ltp {
+			return fmt.Errorf("LTP_ABOVE alert at %.2f would trigger now, ltp is %.2f", a.AlertPrice, ltp)
+		}
+		if a.Condition == GttConditionLtpBelow && a.AlertPrice >= ltp {
+			return fmt.Errorf("LTP_BELOW alert at %.2f would trigger now, ltp is %.2f", a.AlertPrice, ltp)
+		}
+	case GTTKindOCO:
+		if a.StoplossQuantity <= 0 || a.TargetQuantity <= 0 {
+			return errors.New("stoploss and target quantities must be positive")
+		}
+		if a.StoplossPrice <= 0 || a.TargetPrice <= 0 {
+			return errors.New("stoploss and target prices must be positive")
+		}
+		sell := a.OrderType == OrderTypeSell
+		if (sell && a.StoplossPrice >= a.TargetPrice) || (!sell && a.StoplossPrice <= a.TargetPrice) {
+			return fmt.Errorf("stoploss %.2f and target %.2f are the wrong way round for an OCO %s", a.StoplossPrice, a.TargetPrice, a.OrderType)
+		}
+		if ltp <= 0 {
+			return nil
+		}
+		lo, hi := a.StoplossPrice, a.TargetPrice
+		if !sell {
+			lo, hi = hi, lo
+		}
+		if ltp <= lo || ltp >= hi {
+			return fmt.Errorf("ltp %.2f is outside the OCO range %.2f-%.2f", ltp, lo, hi)
+		}
+	default:
+		return fmt.Errorf("unknown alert kind %q", a.Kind)
+	}
+	return nil
+}
+
+// GTTPlan is the set of calls that turns the alerts on the server into a
+// desired set.
+type GTTPlan struct {
+	Place  []GTTAlert
+	Modify []GTTAlert
+	Cancel []GTTAlert
+}
+
+// Empty reports whether the plan has nothing to do.
+func (p GTTPlan) Empty() bool {
+	return len(p.Place) == 0 && len(p.Modify) == 0 && len(p.Cancel) == 0
+}
+
+// GTTManager keeps typed copies of the GTT and OCO alerts on the account.
+// Sync refreshes them from GTTOrders(). An alert that leaves the pending
+// book is marked TRIGGERED when an order for the same instrument, side and
+// quantity was entered after it was first seen, CANCELLED when it was
+// cancelled through the manager, and EXPIRED otherwise.
+type GTTManager struct {
+	orders   *IntegrateOrders
+	data     *IntegrateData
+	OnChange func(GTTAlert)
+	logging  bool
+
+	mu     sync.Mutex
+	alerts map[string]*GTTAlert
+}
+
+// NewGTTManager initializes a manager. data is used to fetch the LTP that
+// alerts are validated against and may be nil to skip the price checks.
+func NewGTTManager(orders *IntegrateOrders, data *IntegrateData, logging bool) *GTTManager {
+	return &GTTManager{
+		orders:  orders,
+		data:    data,
+		logging: logging,
+		alerts:  make(map[string]*GTTAlert),
+	}
+}
+
+// ltp returns the last traded price of the alert's instrument, or zero
+// without a data client.
+func (m *GTTManager) ltp(ctx context.Context, a GTTAlert) (float64, error) {
+	if m.data == nil {
+		return 0, nil
+	}
+	res := m.data.QuotesMany(ctx, []Instrument{{Exchange: a.Exchange, TradingSymbol: a.TradingSymbol}})[0]
+	if res.Err != nil {
+		return 0, res.Err
+	}
+	return res.Quote.LTP, nil
+}
+
+func (m *GTTManager) validate(ctx context.Context, a GTTAlert) error {
+	ltp, err := m.ltp(ctx, a)
+	if err != nil {
+		return err
+	}
+	return ValidateGTT(a, ltp)
+}
+
+// Place validates and places a, and returns it with its alert id.
+func (m *GTTManager) Place(ctx context.Context, a GTTAlert) (GTTAlert, error) {
+	if err := m.validate(ctx, a); err != nil {
+		return a, err
+	}
+	orders := m.orders.WithContext(ctx)
+	var r map[string]interface{}
+	var err error
+	if a.Kind == GTTKindOCO {
+		var remarks *string
+		if a.Remarks != "" {
+			remarks = &a.Remarks
+		}
+		r, err = orders.PlaceOCOOrder(a.Exchange, a.OrderType, a.TradingSymbol, a.StoplossQuantity, a.StoplossPrice, a.TargetQuantity, a.TargetPrice, remarks)
+	} else {
+		r, err = orders.PlaceGTTOrder(a.Exchange, a.OrderType, a.Price, a.Quantity, a.TradingSymbol, a.AlertPrice, a.Condition)
+	}
+	if err != nil {
+		return a, err
+	}
+	if a.AlertID, err = alertIDFrom(r); err != nil {
+		return a, err
+	}
+
+	a.Status = GTTStatusPending
+	a.FirstSeen = time.Now()
+	a.Updated = a.FirstSeen
+	m.mu.Lock()
+	m.alerts[a.AlertID] = &a
+	m.mu.Unlock()
+
+	if m.logging {
+		logger.Printf("gtt %s: placed %s %s %s", a.AlertID, a.Kind, a.OrderType, a.TradingSymbol)
+	}
+	m.changed(a)
+	return a, nil
+}
+
+// Modify validates a and changes the alert with a.AlertID to match it.
+func (m *GTTManager) Modify(ctx context.Context, a GTTAlert) (GTTAlert, error) {
+	if a.AlertID == "" {
+		return a, errors.New("alert id is required")
+	}
+	if err := m.validate(ctx, a); err != nil {
+		return a, err
+	}
+	orders := m.orders.WithContext(ctx)
+	var err error
+	if a.Kind == GTTKindOCO {
+		var remarks *string
+		if a.Remarks != "" {
+			remarks = &a.Remarks
+		}
+		_, err = orders.ModifyOCOOrder(a.Exchange, a.AlertID, a.OrderType, a.TradingSymbol, a.StoplossQuantity, a.StoplossPrice, a.TargetQuantity, a.TargetPrice, remarks)
+	} else {
+		_, err = orders.ModifyGTTOrder(a.Exchange, a.AlertID, a.OrderType, a.TradingSymbol, a.Condition, a.Price, a.AlertPrice, a.Quantity)
+	}
+	if err != nil {
+		return a, err
+	}
+
+	m.mu.Lock()
+	if cur, ok := m.alerts[a.AlertID]; ok {
+		a.FirstSeen = cur.FirstSeen
+	} else {
+		a.FirstSeen = time.Now()
+	}
+	a.Status = GTTStatusPending
+	a.Updated = time.Now()
+	m.alerts[a.AlertID] = &a
+	m.mu.Unlock()
+
+	if m.logging {
+		logger.Printf("gtt %s: modified %s %s %s", a.AlertID, a.Kind, a.OrderType, a.TradingSymbol)
+	}
+	m.changed(a)
+	return a, nil
+}
+
+// Cancel cancels the alert with alertID. Alerts the manager has not seen
+// are cancelled as GTT alerts; call Sync first to cancel an OCO alert
+// placed elsewhere.
+func (m *GTTManager) Cancel(ctx context.Context, alertID string) error {
+	m.mu.Lock()
+	kind := GTTKindSingle
+	if a, ok := m.alerts[alertID]; ok {
+		kind = a.Kind
+	}
+	m.mu.Unlock()
+
+	orders := m.orders.WithContext(ctx)
+	var err error
+	if kind == GTTKindOCO {
+		_, err = orders.CancelOCOOrder(alertID)
+	} else {
+		_, err = orders.CancelGTTOrder(alertID)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	a, ok := m.alerts[alertID]
+	if !ok {
+		a = &GTTAlert{AlertID: alertID, Kind: kind}
+		m.alerts[alertID] = a
+	}
+	a.Status = GTTStatusCancelled
+	a.Updated = time.Now()
+	snapshot := *a
+	m.mu.Unlock()
+
+	if m.logging {
+		logger.Printf("gtt %s: cancelled", alertID)
+	}
+	m.changed(snapshot)
+	return nil
+}
+
+// Alerts returns every alert the manager knows of, pending ones first.
+func (m *GTTManager) Alerts() []GTTAlert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]GTTAlert, 0, len(m.alerts))
+	for _, a := range m.alerts {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		pi, pj := list[i].Status == GTTStatusPending, list[j].Status == GTTStatusPending
+		if pi != pj {
+			return pi
+		}
+		return list[i].AlertID < list[j].AlertID
+	})
+	return list
+}
+
+// Pending returns the alerts that are still waiting to trigger.
+func (m *GTTManager) Pending() []GTTAlert {
+	var pending []GTTAlert
+	for _, a := range m.Alerts() {
+		if a.Status == GTTStatusPending {
+			pending = append(pending, a)
+		}
+	}
+	return pending
+}
+
+// Sync refreshes the alerts from GTTOrders() and returns the ones whose
+// status changed since the previous sync. Alerts placed or changed through
+// m after the book was fetched are left as they are.
+func (m *GTTManager) Sync(ctx context.Context) ([]GTTAlert, error) {
+	fetched := time.Now()
+	r, err := m.orders.WithContext(ctx).GTTOrders()
+	if err != nil {
+		return nil, err
+	}
+	rows := responseRows(r, "pendingGTTOrderBook")
+
+	now := time.Now()
+	seen := make(map[string]bool, len(rows))
+	var gone []*GTTAlert
+
+	m.mu.Lock()
+	for _, row := range rows {
+		a := parseGTTRow(row)
+		if a.AlertID == "" {
+			continue
+		}
+		seen[a.AlertID] = true
+		if cur, ok := m.alerts[a.AlertID]; ok {
+			if cur.Updated.After(fetched) {
+				continue
+			}
+			a.FirstSeen = cur.FirstSeen
+			a.Updated = cur.Updated
+			if !a.sameTerms(*cur) {
+				a.Updated = now
+			}
+		} else {
+			a.FirstSeen = now
+			a.Updated = now
+		}
+		m.alerts[a.AlertID] = &a
+	}
+	for id, a := range m.alerts {
+		if a.Status == GTTStatusPending && !seen[id] && !a.Updated.After(fetched) {
+			gone = append(gone, a)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(gone) == 0 {
+		return nil, nil
+	}
+
+	var book []OrderUpdate
+	r, err = m.orders.WithContext(ctx).Orders()
+	if err == nil {
+		for _, row := range responseRows(r, "orders") {
+			book = append(book, parseOrderRow(row))
+		}
+	} else if ctx.Err() != nil {
+		// Without the book a triggered alert would be reported as expired.
+		return nil, err
+	} else if m.logging {
+		logger.Printf("gtt sync: order book failed, alerts that left the book are marked expired: %v", err)
+	}
+
+	var changed []GTTAlert
+	m.mu.Lock()
+	for _, a := range gone {
+		// Skip alerts cancelled, modified or replaced while the order book
+		// was fetched.
+		if m.alerts[a.AlertID] != a || a.Status != GTTStatusPending || a.Updated.After(fetched) {
+			continue
+		}
+		a.Status = GTTStatusExpired
+		if o, ok := triggeredOrder(*a, book); ok {
+			a.Status = GTTStatusTriggered
+			a.OrderID = o.OrderID
+		}
+		a.Updated = now
+		changed = append(changed, *a)
+	}
+	m.mu.Unlock()
+
+	for _, a := range changed {
+		if m.logging {
+			logger.Printf("gtt %s: %s %s", a.AlertID, a.TradingSymbol, a.Status)
+		}
+		m.changed(a)
+	}
+	return changed, nil
+}
+
+// triggeredOrder finds the order an alert placed when it triggered.
+func triggeredOrder(a GTTAlert, book []OrderUpdate) (OrderUpdate, bool) {
+	for _, o := range book {
+		if o.Exchange != a.Exchange || o.TradingSymbol != a.TradingSymbol || o.OrderType != a.OrderType {
+			continue
+		}
+		if o.Time.Before(a.FirstSeen.Add(-time.Minute)) {
+			continue
+		}
+		if (a.Kind == GTTKindSingle && o.Quantity == a.Quantity) ||
+			(a.Kind == GTTKindOCO && (o.Quantity == a.StoplossQuantity || o.Quantity == a.TargetQuantity)) {
+			return o, true
+		}
+	}
+	return OrderUpdate{}, false
+}
+
+// Run syncs every interval until ctx is done. An interval <= 0 syncs every
+// 30 seconds.
+func (m *GTTManager) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = defaultGTTSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.Sync(ctx); err != nil && m.logging {
+			logger.Printf("gtt sync failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Diff compares desired with the pending alerts. A desired alert with an
+// AlertID is matched by id; one without is matched to a pending alert of
+// the same kind, instrument, side and condition. Matched alerts with
+// different terms are modified, unmatched desired alerts are placed and
+// pending alerts that are not desired are cancelled.
+func (m *GTTManager) Diff(desired []GTTAlert) GTTPlan {
+	pending := m.Pending()
+	byID := make(map[string]GTTAlert, len(pending))
+	byKey := make(map[string][]GTTAlert)
+	for _, a := range pending {
+		byID[a.AlertID] = a
+		byKey[a.key()] = append(byKey[a.key()], a)
+	}
+
+	var plan GTTPlan
+	matched := make(map[string]bool)
+	for _, d := range desired {
+		cur, ok := byID[d.AlertID]
+		if d.AlertID == "" || !ok {
+			for _, c := range byKey[d.key()] {
+				if !matched[c.AlertID] {
+					cur, ok = c, true
+					break
+				}
+			}
+		}
+		if !ok || matched[cur.AlertID] {
+			d.AlertID = ""
+			plan.Place = append(plan.Place, d)
+			continue
+		}
+		matched[cur.AlertID] = true
+		if !d.sameTerms(cur) {
+			d.AlertID = cur.AlertID
+			plan.Modify = append(plan.Modify, d)
+		}
+	}
+	for _, a := range pending {
+		if !matched[a.AlertID] {
+			plan.Cancel = append(plan.Cancel, a)
+		}
+	}
+	return plan
+}
+
+// Apply carries out plan: cancels first, then modifies, then places. It
+// goes through every step and returns the errors joined.
+func (m *GTTManager) Apply(ctx context.Context, plan GTTPlan) error {
+	var errs []error
+	for _, a := range plan.Cancel {
+		if err := m.Cancel(ctx, a.AlertID); err != nil {
+			errs = append(errs, fmt.Errorf("cancel %s: %w", a.AlertID, err))
+		}
+	}
+	for _, a := range plan.Modify {
+		if _, err := m.Modify(ctx, a); err != nil {
+			errs = append(errs, fmt.Errorf("modify %s: %w", a.AlertID, err))
+		}
+	}
+	for _, a := range plan.Place {
+		if _, err := m.Place(ctx, a); err != nil {
+			errs = append(errs, fmt.Errorf("place %s %s: %w", a.Kind, a.TradingSymbol, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reconcile syncs, then makes the pending alerts match desired.
+func (m *GTTManager) Reconcile(ctx context.Context, desired []GTTAlert) (GTTPlan, error) {
+	if _, err := m.Sync(ctx); err != nil {
+		return GTTPlan{}, err
+	}
+	plan := m.Diff(desired)
+	if plan.Empty() {
+		return plan, nil
+	}
+	if m.logging {
+		logger.Printf("gtt reconcile: %d to place, %d to modify, %d to cancel", len(plan.Place), len(plan.Modify), len(plan.Cancel))
+	}
+	return plan, m.Apply(ctx, plan)
+}
+
+func (m *GTTManager) changed(a GTTAlert) {
+	if m.OnChange != nil {
+		m.OnChange(a)
+	}
+}
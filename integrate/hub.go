@@ -0,0 +1,356 @@
+package integrate
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Slow consumer policies for hub subscribers
+const (
+	OverflowDrop  = "DROP"
+	OverflowBlock = "BLOCK"
+)
+
+const defaultHubBuffer = 256
+
+// MarketDataHub fans one websocket feed out to many in-process subscribers.
+// Each token is subscribed on the websocket once, however many subscribers
+// want it, and unsubscribed when the last of them lets go.
+type MarketDataHub struct {
+	ws *IntegrateWebSocket
+
+	// wsMu orders reference changes with the websocket calls they cause,
+	// so a subscribe and an unsubscribe of one token cannot cross.
+	wsMu sync.Mutex
+
+	mu          sync.Mutex
+	refs        map[string]map[InstrumentToken]int
+	subscribers map[*HubSubscription]struct{}
+	dropped     map[string]uint64
+}
+
+// HubSubscription is one consumer of a MarketDataHub with its own bounded
+// buffers. When a buffer is full the subscription either drops the event
+// (OverflowDrop) or makes the feed wait for it (OverflowBlock).
+type HubSubscription struct {
+	Name   string
+	hub    *MarketDataHub
+	policy string
+
+	ticks  chan Tick
+	depths chan Depth
+	done   chan struct{}
+
+	sendMu  sync.RWMutex
+	closed  bool
+	tokens  map[string]map[InstrumentToken]struct{}
+	dropped atomic.Uint64
+}
+
+// HubStats is a snapshot of hub activity.
+type HubStats struct {
+	Subscribers int
+	Tokens      int
+	Dropped     uint64
+	DroppedBy   map[string]uint64
+}
+
+// NewMarketDataHub takes over delivery of ws ticks and depth. The
+// websocket's OnTick and OnDepth callbacks are replaced by the hub.
+func NewMarketDataHub(ws *IntegrateWebSocket) *MarketDataHub {
+	h := &MarketDataHub{
+		ws:          ws,
+		refs:        make(map[string]map[InstrumentToken]int),
+		subscribers: make(map[*HubSubscription]struct{}),
+		dropped:     make(map[string]uint64),
+	}
+	ws.OnTick = h.publishTick
+	ws.OnDepth = h.publishDepth
+	return h
+}
+
+// NewSubscription registers a subscriber. buffer is the capacity of each of
+// its channels and policy is OverflowDrop or OverflowBlock.
+func (h *MarketDataHub) NewSubscription(name string, buffer int, policy string) (*HubSubscription, error) {
+	if policy != OverflowDrop && policy != OverflowBlock {
+		return nil, errors.New("invalid overflow policy")
+	}
+	if buffer <= 0 {
+		buffer = defaultHubBuffer
+	}
+
+	s := &HubSubscription{
+		Name:   name,
+		hub:    h,
+		policy: policy,
+		ticks:  make(chan Tick, buffer),
+		depths: make(chan Depth, buffer),
+		done:   make(chan struct{}),
+		tokens: make(map[string]map[InstrumentToken]struct{}),
+	}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s, nil
+}
+
+// Stats returns subscriber, token and drop counts. Drops are counted since
+// the hub was created, including those of closed subscribers.
+func (h *MarketDataHub) Stats() HubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := HubStats{
+		Subscribers: len(h.subscribers),
+		DroppedBy:   make(map[string]uint64, len(h.subscribers)+len(h.dropped)),
+	}
+	for _, refs := range h.refs {
+		stats.Tokens += len(refs)
+	}
+	for name, n := range h.dropped {
+		stats.Dropped += n
+		stats.DroppedBy[name] += n
+	}
+	for s := range h.subscribers {
+		n := s.dropped.Load()
+		stats.Dropped += n
+		stats.DroppedBy[s.Name] += n
+	}
+	return stats
+}
+
+// acquire adds references to tokens and returns those that are new to the hub.
+func (h *MarketDataHub) acquire(subscriptionType string, tokens []InstrumentToken) []InstrumentToken {
+	refs := h.refs[subscriptionType]
+	if refs == nil {
+		refs = make(map[InstrumentToken]int)
+		h.refs[subscriptionType] = refs
+	}
+
+	var added []InstrumentToken
+	for _, t := range tokens {
+		refs[t]++
+		if refs[t] == 1 {
+			added = append(added, t)
+		}
+	}
+	return added
+}
+
+// release drops references to tokens and returns those nobody wants any more.
+func (h *MarketDataHub) release(subscriptionType string, tokens []InstrumentToken) []InstrumentToken {
+	refs := h.refs[subscriptionType]
+
+	var removed []InstrumentToken
+	for _, t := range tokens {
+		if refs[t] == 0 {
+			continue
+		}
+		refs[t]--
+		if refs[t] == 0 {
+			delete(refs, t)
+			removed = append(removed, t)
+		}
+	}
+	return removed
+}
+
+func (h *MarketDataHub) targets(subscriptionType string, key InstrumentToken) []*HubSubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []*HubSubscription
+	for s := range h.subscribers {
+		if _, ok := s.tokens[subscriptionType][key]; ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (h *MarketDataHub) publishTick(t Tick) {
+	for _, s := range h.targets(SubscriptionTypeTick, InstrumentToken{Exchange: t.Exchange, Token: t.Token}) {
+		s.deliverTick(t)
+	}
+}
+
+func (h *MarketDataHub) publishDepth(d Depth) {
+	for _, s := range h.targets(SubscriptionTypeDepth, InstrumentToken{Exchange: d.Exchange, Token: d.Token}) {
+		s.deliverDepth(d)
+	}
+}
+
+// Ticks returns the subscriber's tick channel. It is closed by Close.
+func (s *HubSubscription) Ticks() <-chan Tick {
+	return s.ticks
+}
+
+// Depths returns the subscriber's depth channel. It is closed by Close.
+func (s *HubSubscription) Depths() <-chan Depth {
+	return s.depths
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *HubSubscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Subscribe adds tokens to this subscriber, subscribing on the websocket
+// only the tokens no other subscriber already holds. If the websocket
+// subscribe fails, none of tokens are added.
+func (s *HubSubscription) Subscribe(subscriptionType string, tokens ...InstrumentToken) error {
+	if subscriptionType != SubscriptionTypeTick && subscriptionType != SubscriptionTypeDepth {
+		return errors.New("invalid subscription type")
+	}
+
+	h := s.hub
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	h.mu.Lock()
+	set := s.tokens[subscriptionType]
+	if set == nil {
+		set = make(map[InstrumentToken]struct{})
+		s.tokens[subscriptionType] = set
+	}
+	var fresh []InstrumentToken
+	for _, t := range tokens {
+		if _, ok := set[t]; !ok {
+			set[t] = struct{}{}
+			fresh = append(fresh, t)
+		}
+	}
+	added := h.acquire(subscriptionType, fresh)
+	h.mu.Unlock()
+
+	if len(added) == 0 {
+		return nil
+	}
+	err := h.ws.Subscribe(subscriptionType, added...)
+	if err == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	for _, t := range fresh {
+		delete(set, t)
+	}
+	h.release(subscriptionType, fresh)
+	h.mu.Unlock()
+	// Drop the tokens from the websocket too, so a reconnect does not
+	// subscribe them; the send itself is expected to fail as well.
+	h.ws.Unsubscribe(subscriptionType, added...)
+	return err
+}
+
+// Unsubscribe removes tokens from this subscriber, unsubscribing on the
+// websocket those no other subscriber holds.
+func (s *HubSubscription) Unsubscribe(subscriptionType string, tokens ...InstrumentToken) error {
+	h := s.hub
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	h.mu.Lock()
+	var held []InstrumentToken
+	for _, t := range tokens {
+		if _, ok := s.tokens[subscriptionType][t]; ok {
+			delete(s.tokens[subscriptionType], t)
+			held = append(held, t)
+		}
+	}
+	removed := h.release(subscriptionType, held)
+	h.mu.Unlock()
+
+	if len(removed) == 0 {
+		return nil
+	}
+	return h.ws.Unsubscribe(subscriptionType, removed...)
+}
+
+// Close releases every token held by the subscriber and closes its channels.
+func (s *HubSubscription) Close() error {
+	h := s.hub
+	h.wsMu.Lock()
+	defer h.wsMu.Unlock()
+	h.mu.Lock()
+	if _, ok := h.subscribers[s]; !ok {
+		h.mu.Unlock()
+		return nil
+	}
+	delete(h.subscribers, s)
+	removed := make(map[string][]InstrumentToken)
+	for subscriptionType, set := range s.tokens {
+		held := make([]InstrumentToken, 0, len(set))
+		for t := range set {
+			held = append(held, t)
+		}
+		removed[subscriptionType] = h.release(subscriptionType, held)
+	}
+	s.tokens = make(map[string]map[InstrumentToken]struct{})
+	h.mu.Unlock()
+
+	// Unblock any delivery in progress, then close the channels once it returns.
+	close(s.done)
+	s.sendMu.Lock()
+	s.closed = true
+	close(s.ticks)
+	close(s.depths)
+	s.sendMu.Unlock()
+
+	h.mu.Lock()
+	h.dropped[s.Name] += s.dropped.Load()
+	h.mu.Unlock()
+
+	var firstErr error
+	for subscriptionType, tokens := range removed {
+		if len(tokens) == 0 {
+			continue
+		}
+		if err := h.ws.Unsubscribe(subscriptionType, tokens...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *HubSubscription) deliverTick(t Tick) {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	if s.policy == OverflowBlock {
+		select {
+		case s.ticks <- t:
+		case <-s.done:
+		}
+		return
+	}
+	select {
+	case s.ticks <- t:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *HubSubscription) deliverDepth(d Depth) {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	if s.policy == OverflowBlock {
+		select {
+		case s.depths <- d:
+		case <-s.done:
+		}
+		return
+	}
+	select {
+	case s.depths <- d:
+	default:
+		s.dropped.Add(1)
+	}
+}
@@ -0,0 +1,292 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DisclosedQuantityExchanges lists the segments that accept
+// disclosed_quantity. Derivatives segments do not.
+var DisclosedQuantityExchanges = map[string]bool{
+	ExchangeTypeNSE: true,
+	ExchangeTypeBSE: true,
+}
+
+// minDisclosedFraction is the smallest disclosed quantity the exchanges
+// accept, as a fraction of the order quantity.
+const minDisclosedFraction = 0.1
+
+// Defaults for the iceberg executor
+const (
+	defaultIcebergPoll          = time.Second
+	defaultIcebergCancelTimeout = 30 * time.Second
+)
+
+// Iceberg works a large order showing only Visible quantity at a time.
+// Where the segment allows it and Visible is at least a tenth of the order,
+// a single order with disclosed_quantity is placed and the exchange does
+// the slicing. Otherwise slices are placed one after another, each when the
+// previous one has filled, with the size varied by up to Variance of
+// Visible so the clips are harder to spot.
+//
+// Slices of a LIMIT order are priced at req.Price. With PegToTouch, they
+// are priced at the best bid for a BUY or best ask for a SELL, never beyond
+// req.Price, and a slice left unfilled for RefreshAfter is moved to the
+// current touch.
+type Iceberg struct {
+	orders       *IntegrateOrders
+	data         *IntegrateData
+	req          OrderRequest
+	Visible      int
+	Variance     float64
+	PegToTouch   bool
+	RefreshAfter time.Duration
+	PollInterval time.Duration
+	PreferNative bool
+	logging      bool
+
+	lot    int
+	report ExecutionReport
+}
+
+// NewIceberg initializes an iceberg of req showing visible quantity.
+func NewIceberg(orders *IntegrateOrders, data *IntegrateData, req OrderRequest, visible int, logging bool) (*Iceberg, error) {
+	if req.PriceType != PriceTypeLimit && req.PriceType != PriceTypeMarket {
+		return nil, errors.New("iceberg orders must be LIMIT or MARKET")
+	}
+	if req.Quantity <= 0 || visible <= 0 || visible >= req.Quantity {
+		return nil, errors.New("visible quantity must be positive and below the order quantity")
+	}
+	lot := lotSize(orders.c2i, req.Exchange, req.TradingSymbol)
+	if req.Quantity%lot != 0 || visible%lot != 0 {
+		return nil, fmt.Errorf("quantities must be multiples of lot size %d", lot)
+	}
+	if req.Validity == "" {
+		req.Validity = ValidityTypeDay
+	}
+	req.DisclosedQuantity = nil
+
+	return &Iceberg{
+		orders:       orders,
+		data:         data,
+		req:          req,
+		Visible:      visible,
+		RefreshAfter: 30 * time.Second,
+		PollInterval: defaultIcebergPoll,
+		PreferNative: true,
+		logging:      logging,
+		lot:          lot,
+		report: ExecutionReport{
+			Algo:          ExecAlgoIceberg,
+			TradingSymbol: req.TradingSymbol,
+			OrderType:     req.OrderType,
+			Quantity:      req.Quantity,
+			Target:        req.Quantity,
+			Status:        ExecStatusWaiting,
+		},
+	}, nil
+}
+
+// Native reports whether the iceberg will use disclosed_quantity.
+func (ic *Iceberg) Native() bool {
+	return ic.PreferNative &&
+		DisclosedQuantityExchanges[ic.req.Exchange] &&
+		float64(ic.Visible) >= float64(ic.req.Quantity)*minDisclosedFraction
+}
+
+// Run works the order until it is filled, a slice fails or ctx is done.
+// An open slice is cancelled when ctx is done.
+func (ic *Iceberg) Run(ctx context.Context) (ExecutionReport, error) {
+	ic.report.Status = ExecStatusRunning
+	ic.report.Started = time.Now()
+
+	if ic.Native() {
+		visible := ic.Visible
+		req := ic.req
+		req.DisclosedQuantity = &visible
+		if ic.logging {
+			logger.Printf("iceberg %s: placing %d with disclosed quantity %d", req.TradingSymbol, req.Quantity, visible)
+		}
+		err := ic.work(ctx, req)
+		return ic.finish(err)
+	}
+
+	for ic.report.Filled < ic.req.Quantity {
+		req := ic.req
+		req.Quantity = ic.clip(ic.req.Quantity - ic.report.Filled)
+		if err := ic.work(ctx, req); err != nil {
+			return ic.finish(err)
+		}
+	}
+	return ic.finish(nil)
+}
+
+// clip returns the next slice size for remaining quantity.
+func (ic *Iceberg) clip(remaining int) int {
+	size := float64(ic.Visible)
+	if ic.Variance > 0 {
+		size *= 1 + ic.Variance*(2*rand.Float64()-1)
+	}
+	n := int(math.Round(size/float64(ic.lot))) * ic.lot
+	if n < ic.lot {
+		n = ic.lot
+	}
+	if n > remaining {
+		n = remaining
+	}
+	return n
+}
+
+// price returns the limit price for a slice.
+func (ic *Iceberg) price(ctx context.Context) (float64, error) {
+	if ic.req.PriceType == PriceTypeMarket || !ic.PegToTouch {
+		return ic.req.Price, nil
+	}
+
+	res := ic.data.QuotesMany(ctx, []Instrument{{Exchange: ic.req.Exchange, TradingSymbol: ic.req.TradingSymbol}})[0]
+	if res.Err != nil {
+		return 0, res.Err
+	}
+	buy := ic.req.OrderType == OrderTypeBuy
+	touch := res.Quote.Asks[0].Price
+	if buy {
+		touch = res.Quote.Bids[0].Price
+	}
+	if touch <= 0 || (buy && touch > ic.req.Price) || (!buy && touch < ic.req.Price) {
+		return ic.req.Price, nil
+	}
+	return touch, nil
+}
+
+// work places one slice and waits for it to fill, refreshing its price.
+func (ic *Iceberg) work(ctx context.Context, req OrderRequest) error {
+	price, err := ic.price(ctx)
+	if err != nil {
+		return err
+	}
+	req.Price = price
+
+	r, err := ic.orders.WithContext(ctx).PlaceOrderRequest(req)
+	if err != nil {
+		return err
+	}
+	id, err := orderIDFrom(r)
+	if err != nil {
+		return err
+	}
+	ic.report.Children = append(ic.report.Children, ExecChild{
+		OrderID:  id,
+		Time:     time.Now(),
+		Quantity: req.Quantity,
+		Price:    price,
+		Status:   OrderStatusOpen,
+	})
+	child := &ic.report.Children[len(ic.report.Children)-1]
+
+	poll := ic.PollInterval
+	if poll <= 0 {
+		poll = defaultIcebergPoll
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	placed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Fills can land until the cancel is confirmed, so the slice is
+			// recorded only once it has reached a final state.
+			cctx := context.WithoutCancel(ctx)
+			ic.orders.WithContext(cctx).CancelOrder(id)
+			u, err := awaitTerminal(cctx, ic.orders, id, poll, defaultIcebergCancelTimeout)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ctx.Err(), err)
+			}
+			ic.record(child, u)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		u, err := orderState(ctx, ic.orders, id)
+		if err != nil {
+			if ic.logging {
+				logger.Printf("iceberg %s: slice %s status failed: %v", req.TradingSymbol, id, err)
+			}
+			continue
+		}
+		switch u.Status {
+		case OrderStatusComplete:
+			ic.record(child, u)
+			return nil
+		case OrderStatusCancelled, OrderStatusRejected:
+			ic.record(child, u)
+			return fmt.Errorf("slice %s %s: %s", id, u.Status, u.Message)
+		}
+
+		if !ic.PegToTouch || req.PriceType != PriceTypeLimit || time.Since(placed) < ic.RefreshAfter {
+			continue
+		}
+		fresh, err := ic.price(ctx)
+		if err != nil || fresh == child.Price {
+			continue
+		}
+		_, err = ic.orders.WithContext(ctx).ModifyOrder(OrderParams{
+			Exchange:          req.Exchange,
+			OrderID:           id,
+			OrderType:         req.OrderType,
+			Price:             fresh,
+			PriceType:         req.PriceType,
+			ProductType:       req.ProductType,
+			Quantity:          req.Quantity,
+			TradingSymbol:     req.TradingSymbol,
+			DisclosedQuantity: req.DisclosedQuantity,
+			Validity:          req.Validity,
+		})
+		if err != nil {
+			if ic.logging {
+				logger.Printf("iceberg %s: refresh of slice %s failed: %v", req.TradingSymbol, id, err)
+			}
+			continue
+		}
+		if ic.logging {
+			logger.Printf("iceberg %s: slice %s moved %.2f -> %.2f", req.TradingSymbol, id, child.Price, fresh)
+		}
+		child.Price = fresh
+		placed = time.Now()
+	}
+}
+
+// record adds the fills of a finished slice to the report.
+func (ic *Iceberg) record(child *ExecChild, u OrderUpdate) {
+	child.Filled = u.FilledQuantity
+	child.AvgPrice = u.AveragePrice
+	child.Status = u.Status
+
+	r := &ic.report
+	value := r.AvgPrice*float64(r.Filled) + u.AveragePrice*float64(u.FilledQuantity)
+	r.Filled += u.FilledQuantity
+	if r.Filled > 0 {
+		r.AvgPrice = value / float64(r.Filled)
+	}
+}
+
+func (ic *Iceberg) finish(err error) (ExecutionReport, error) {
+	ic.report.Finished = time.Now()
+	ic.report.Err = err
+	switch {
+	case err == nil:
+		ic.report.Status = ExecStatusDone
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		ic.report.Status = ExecStatusCancelled
+	default:
+		ic.report.Status = ExecStatusFailed
+	}
+	if ic.logging {
+		logger.Printf("iceberg %s: %s, filled %d of %d at %.2f", ic.req.TradingSymbol, ic.report.Status, ic.report.Filled, ic.report.Quantity, ic.report.AvgPrice)
+	}
+	return ic.report, err
+}
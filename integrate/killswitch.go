@@ -0,0 +1,332 @@
+package integrate
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Constants for kill switch actions
+const (
+	KillActionCancelOrder = "CANCEL_ORDER"
+	KillActionCancelGTT   = "CANCEL_GTT"
+	KillActionCancelOCO   = "CANCEL_OCO"
+	KillActionSquareOff   = "SQUARE_OFF"
+)
+
+// killSwitchMarketProtection is the market protection, in percent, of the
+// market orders that square off positions.
+const killSwitchMarketProtection = 2.0
+
+// Defaults for waiting on the kill switch's orders
+const (
+	defaultKillPoll     = 500 * time.Millisecond
+	defaultKillTimeout  = 30 * time.Second
+	defaultKillFilePoll = time.Second
+)
+
+// KillSwitchAction is one step taken by the kill switch.
+type KillSwitchAction struct {
+	Action        string
+	ID            string
+	TradingSymbol string
+	Quantity      int
+	OrderID       string
+	Err           error
+}
+
+// KillSwitchReport lists what the kill switch did and what failed.
+type KillSwitchReport struct {
+	Started  time.Time
+	Finished time.Time
+	Actions  []KillSwitchAction
+	Errors   []error
+}
+
+// Failed returns the actions that did not succeed.
+func (r *KillSwitchReport) Failed() []KillSwitchAction {
+	var failed []KillSwitchAction
+	for _, a := range r.Actions {
+		if a.Err != nil {
+			failed = append(failed, a)
+		}
+	}
+	return failed
+}
+
+// OK reports whether every step succeeded.
+func (r *KillSwitchReport) OK() bool {
+	return len(r.Errors) == 0 && len(r.Failed()) == 0
+}
+
+func (r *KillSwitchReport) add(a KillSwitchAction) {
+	r.Actions = append(r.Actions, a)
+}
+
+// Halt blocks PlaceOrder, SliceOrder, ModifyOrder, PlaceGTTOrder and
+// PlaceOCOOrder until Resume is called. Cancels are still allowed.
+func (io *IntegrateOrders) Halt() {
+	io.halted.Store(true)
+}
+
+// Resume allows order entry again after Halt or KillSwitch.
+func (io *IntegrateOrders) Resume() {
+	io.halted.Store(false)
+}
+
+// Halted reports whether order entry is blocked.
+func (io *IntegrateOrders) Halted() bool {
+	return io.halted.Load()
+}
+
+// KillSwitch halts order entry and flattens the account: every open order
+// from Orders() is cancelled, every GTT and OCO alert from GTTOrders() is
+// cancelled, and every open position is squared off with market protected
+// orders. Positions are read once the cancelled orders are final, and read
+// again after the square-off; any still open are reported as errors. Order
+// entry stays halted until Resume is called.
+func (io *IntegrateOrders) KillSwitch(ctx context.Context) *KillSwitchReport {
+	io.Halt()
+	report := &KillSwitchReport{Started: time.Now()}
+	if io.logging {
+		logger.Println("kill switch engaged")
+	}
+
+	io.killOrders(ctx, report)
+	io.killAlerts(ctx, report)
+	io.killPositions(ctx, report)
+
+	report.Finished = time.Now()
+	if io.logging {
+		logger.Printf("kill switch finished: %d actions, %d failed, %d errors", len(report.Actions), len(report.Failed()), len(report.Errors))
+	}
+	return report
+}
+
+func (io *IntegrateOrders) killOrders(ctx context.Context, report *KillSwitchReport) {
+	view := io.WithContext(ctx)
+	orders, err := view.ListOrders()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("orders: %w", err))
+		return
+	}
+
+	for _, o := range orders {
+		if isTerminalStatus(o.Status) {
+			continue
+		}
+		a := KillSwitchAction{
+			Action:        KillActionCancelOrder,
+			ID:            o.OrderID,
+			TradingSymbol: o.TradingSymbol,
+			Quantity:      o.PendingQuantity,
+		}
+		_, a.Err = view.CancelOrder(o.OrderID)
+		report.add(a)
+	}
+}
+
+func (io *IntegrateOrders) killAlerts(ctx context.Context, report *KillSwitchReport) {
+	view := io.WithContext(ctx)
+	r, err := view.GTTOrders()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("gtt orders: %w", err))
+		return
+	}
+
+	for _, row := range responseRows(r, "pendingGTTOrderBook") {
+		a := KillSwitchAction{
+			Action:        KillActionCancelGTT,
+			ID:            fieldString(row, "alert_id"),
+			TradingSymbol: fieldString(row, "tradingsymbol"),
+			Quantity:      fieldInt(row, "quantity"),
+		}
+		oco := row["target_price"] != nil || row["stoploss_price"] != nil
+		if oco {
+			a.Action = KillActionCancelOCO
+		}
+
+		if oco {
+			_, a.Err = view.CancelOCOOrder(a.ID)
+		} else {
+			_, a.Err = view.CancelGTTOrder(a.ID)
+		}
+		report.add(a)
+	}
+}
+
+func (io *IntegrateOrders) killPositions(ctx context.Context, report *KillSwitchReport) {
+	// A cancelled order can still fill until the cancel is confirmed, so
+	// positions are sized only once every cancelled order is final.
+	io.settle(ctx, report, KillActionCancelOrder)
+
+	positions, err := io.WithContext(ctx).ListPositions()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("positions: %w", err))
+		return
+	}
+
+	slicer := NewOrderSlicer(io, io.logging)
+	protection := killSwitchMarketProtection
+	for _, p := range positions {
+		if !p.Open() {
+			continue
+		}
+		req := OrderRequest{
+			Exchange:         p.Exchange,
+			OrderType:        OrderTypeSell,
+			PriceType:        PriceTypeMarket,
+			ProductType:      p.ProductType,
+			Quantity:         abs(p.NetQuantity),
+			TradingSymbol:    p.TradingSymbol,
+			MarketProtection: &protection,
+			Validity:         ValidityTypeDay,
+		}
+		if p.NetQuantity < 0 {
+			req.OrderType = OrderTypeBuy
+		}
+
+		children, err := slicer.Plan(req)
+		if err != nil {
+			children = []OrderRequest{req}
+		}
+		for _, child := range children {
+			report.add(io.squareOff(ctx, child))
+		}
+	}
+
+	io.settle(ctx, report, KillActionSquareOff)
+	positions, err = io.WithContext(ctx).ListPositions()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("positions after square-off: %w", err))
+		return
+	}
+	for _, p := range positions {
+		if p.Open() {
+			report.Errors = append(report.Errors, fmt.Errorf("position %s %s %s still open: %d", p.Exchange, p.TradingSymbol, p.ProductType, p.NetQuantity))
+		}
+	}
+}
+
+// settle waits for the orders of the successful actions of kind to reach a
+// final state. Orders that do not are reported as errors.
+func (io *IntegrateOrders) settle(ctx context.Context, report *KillSwitchReport, kind string) {
+	for _, a := range report.Actions {
+		if a.Action != kind || a.Err != nil || a.ID == "" {
+			continue
+		}
+		if _, err := awaitTerminal(ctx, io, a.ID, defaultKillPoll, defaultKillTimeout); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+}
+
+// squareOff places a closing order, bypassing the halt.
+func (io *IntegrateOrders) squareOff(ctx context.Context, req OrderRequest) KillSwitchAction {
+	a := KillSwitchAction{
+		Action:        KillActionSquareOff,
+		TradingSymbol: req.TradingSymbol,
+		Quantity:      req.Quantity,
+	}
+	r, err := io.WithContext(ctx).placeOrder(req.Exchange, req.OrderType, req.Price, req.PriceType, req.ProductType,
+		req.Quantity, req.TradingSymbol, req.Amo, req.BookLossPrice, req.BookProfitPrice,
+		req.DisclosedQuantity, req.MarketProtection, req.Remarks, req.TrailingPrice,
+		req.TriggerPrice, req.Validity, req.Tag)
+	if err == nil {
+		a.OrderID, err = orderIDFrom(r)
+	}
+	a.ID = a.OrderID
+	a.Err = err
+	return a
+}
+
+// WatchKillFile checks for a sentinel file at path every interval and fires
+// the kill switch once when it appears. The report is passed to onReport.
+// An interval <= 0 checks every second.
+func (io *IntegrateOrders) WatchKillFile(ctx context.Context, path string, interval time.Duration, onReport func(*KillSwitchReport)) {
+	if interval <= 0 {
+		interval = defaultKillFilePoll
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if io.logging {
+			logger.Printf("kill file %s found", path)
+		}
+		report := io.KillSwitch(ctx)
+		if onReport != nil {
+			onReport(report)
+		}
+		return
+	}
+}
+
+// KillSwitchHandler returns an HTTP handler that fires the kill switch on
+// POST and responds with the report as JSON. Requests must carry token in
+// an "Authorization: Bearer" header; with an empty token every request is
+// refused. The kill switch runs to completion even if the client goes
+// away.
+func (io *IntegrateOrders) KillSwitchHandler(token string) http.Handler {
+	type action struct {
+		Action        string `json:"action"`
+		ID            string `json:"id"`
+		TradingSymbol string `json:"tradingsymbol"`
+		Quantity      int    `json:"quantity"`
+		OrderID       string `json:"order_id,omitempty"`
+		Error         string `json:"error,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		got := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if token == "" || subtle.ConstantTimeCompare(got, []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		report := io.KillSwitch(context.WithoutCancel(r.Context()))
+
+		body := struct {
+			Started  time.Time `json:"started"`
+			Finished time.Time `json:"finished"`
+			OK       bool      `json:"ok"`
+			Actions  []action  `json:"actions"`
+			Errors   []string  `json:"errors,omitempty"`
+		}{Started: report.Started, Finished: report.Finished, OK: report.OK()}
+		for _, a := range report.Actions {
+			out := action{Action: a.Action, ID: a.ID, TradingSymbol: a.TradingSymbol, Quantity: a.Quantity, OrderID: a.OrderID}
+			if a.Err != nil {
+				out.Error = a.Err.Error()
+			}
+			body.Actions = append(body.Actions, out)
+		}
+		for _, err := range report.Errors {
+			body.Errors = append(body.Errors, err.Error())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !body.OK {
+			w.WriteHeader(http.StatusMultiStatus)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
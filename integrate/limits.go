@@ -0,0 +1,48 @@
+package integrate
+
+// AccountLimits is the typed form of the Limits() response.
+type AccountLimits struct {
+	Cash       float64
+	Payin      float64
+	Collateral float64
+	MarginUsed float64
+	Raw        map[string]interface{}
+}
+
+// Available returns the funds free for new orders.
+func (l AccountLimits) Available() float64 {
+	return l.Cash + l.Payin + l.Collateral - l.MarginUsed
+}
+
+// AccountLimits fetches Limits() and decodes it.
+func (io *IntegrateOrders) AccountLimits() (AccountLimits, error) {
+	r, err := io.Limits()
+	if err != nil {
+		return AccountLimits{}, err
+	}
+	return AccountLimits{
+		Cash:       fieldFloat(r, "cash"),
+		Payin:      fieldFloat(r, "payin"),
+		Collateral: fieldFloat(r, "collateral"),
+		MarginUsed: fieldFloat(r, "marginused"),
+		Raw:        r,
+	}, nil
+}
+
+// RequiredMargin returns the margin the broker needs for a set of orders,
+// with hedge benefit where the response provides it.
+func (io *IntegrateOrders) RequiredMargin(orders []OrderRequest) (float64, error) {
+	lists := make([]map[string]interface{}, len(orders))
+	for i, o := range orders {
+		lists[i] = o.payload()
+	}
+
+	r, err := io.Margins(lists)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := r["marginusedtrade"]; ok {
+		return fieldFloat(r, "marginusedtrade"), nil
+	}
+	return fieldFloat(r, "marginused"), nil
+}
@@ -0,0 +1,239 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDuplicateOrder is returned when an identical order was already
+// submitted within the guard window.
+var ErrDuplicateOrder = errors.New("duplicate order within guard window")
+
+// errNotSent marks failures that happened before the request left.
+var errNotSent = errors.New("order not sent")
+
+// errNoOrderID marks a placeorder call that succeeded but whose response
+// carried no order id. The order most likely exists.
+var errNoOrderID = errors.New("order accepted without an order id")
+
+// Defaults for the order guard
+const (
+	defaultTagPrefix    = "og"
+	defaultGuardWindow  = 5 * time.Second
+	guardLookupAttempts = 3
+	guardLookupDelay    = time.Second
+)
+
+// clientTagSeq numbers client tags across the process.
+var clientTagSeq atomic.Uint64
+
+// newClientTag returns a client tag that is unique within this process.
+func newClientTag(prefix string) string {
+	return prefix + strconv.FormatInt(time.Now().UnixMilli(), 36) + strconv.FormatUint(clientTagSeq.Add(1), 36)
+}
+
+// tagRemarks returns remarks with tag appended, as sent to placeorder.
+func tagRemarks(remarks *string, tag string) *string {
+	tagged := tag
+	if remarks != nil && *remarks != "" {
+		tagged = *remarks + ":" + tag
+	}
+	return &tagged
+}
+
+// userRemarks returns the remarks an order was placed with, without the
+// client tag placeOrder appended.
+func userRemarks(remarks string) string {
+	if i := strings.LastIndexByte(remarks, ':'); i >= 0 {
+		return remarks[:i]
+	}
+	return ""
+}
+
+// OrderGuard protects against placing the same order twice. Every order
+// carries a unique client tag in remarks, which the guard chooses for the
+// orders it sends. When placeorder fails in a way that leaves the outcome
+// unknown, such as a timeout or a response without an order id, the guard
+// looks for the tag in Orders() before it sends the order again or
+// releases the order for resubmission. Identical orders
+// submitted within Window of each other are rejected outright.
+type OrderGuard struct {
+	orders    *IntegrateOrders
+	Window    time.Duration
+	TagPrefix string
+	logging   bool
+
+	mu     sync.Mutex
+	recent map[string]time.Time
+}
+
+// NewOrderGuard initializes a guard with a five second duplicate window.
+func NewOrderGuard(orders *IntegrateOrders, logging bool) *OrderGuard {
+	return &OrderGuard{
+		orders:    orders,
+		Window:    defaultGuardWindow,
+		TagPrefix: defaultTagPrefix,
+		logging:   logging,
+		recent:    make(map[string]time.Time),
+	}
+}
+
+// NewTag returns a client tag that is unique within this process.
+func (g *OrderGuard) NewTag() string {
+	return newClientTag(g.TagPrefix)
+}
+
+// fingerprint identifies orders that would have the same effect.
+func fingerprint(req OrderRequest) string {
+	trigger := 0.0
+	if req.TriggerPrice != nil {
+		trigger = *req.TriggerPrice
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d|%g|%g",
+		req.Exchange, req.TradingSymbol, req.OrderType, req.PriceType, req.ProductType,
+		req.Quantity, req.Price, trigger)
+}
+
+// claim records req as submitted, or fails if an identical order was
+// submitted within the window.
+func (g *OrderGuard) claim(key string, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for k, at := range g.recent {
+		if now.Sub(at) >= g.Window {
+			delete(g.recent, k)
+		}
+	}
+	if at, ok := g.recent[key]; ok && now.Sub(at) < g.Window {
+		return ErrDuplicateOrder
+	}
+	g.recent[key] = now
+	return nil
+}
+
+func (g *OrderGuard) release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.recent, key)
+}
+
+// Place tags and places req. It returns the order id and the remarks the
+// order was sent with: existing remarks followed by the client tag.
+func (g *OrderGuard) Place(ctx context.Context, req OrderRequest) (string, string, error) {
+	key := fingerprint(req)
+	if err := g.claim(key, time.Now()); err != nil {
+		return "", "", err
+	}
+
+	req.Tag = g.NewTag()
+	remarks := *tagRemarks(req.Remarks, req.Tag)
+
+	id, err := g.send(ctx, req)
+	if err == nil {
+		return id, remarks, nil
+	}
+	if !isAmbiguous(err) {
+		g.release(key)
+		return "", remarks, err
+	}
+
+	if g.logging {
+		logger.Printf("order %s: outcome unknown (%v), searching order book", remarks, err)
+	}
+	// The lookup runs even if ctx is done, as the order may be live.
+	id, found, lookupErr := g.FindByTag(context.WithoutCancel(ctx), remarks)
+	if found {
+		return id, remarks, nil
+	}
+	if lookupErr != nil {
+		return "", remarks, fmt.Errorf("order outcome unknown: %v; lookup failed: %w", err, lookupErr)
+	}
+
+	if g.logging {
+		logger.Printf("order %s: not in order book, resending", remarks)
+	}
+	id, err = g.send(ctx, req)
+	if err != nil && !isAmbiguous(err) {
+		g.release(key)
+	}
+	return id, remarks, err
+}
+
+func (g *OrderGuard) send(ctx context.Context, req OrderRequest) (string, error) {
+	r, err := g.orders.WithContext(ctx).PlaceOrderRequest(req)
+	if err != nil {
+		return "", err
+	}
+	id, err := orderIDFrom(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errNoOrderID, err)
+	}
+	return id, nil
+}
+
+// FindByTag searches Orders() for an order carrying tag in remarks. The
+// order book can lag behind placeorder, so the search is tried a few times.
+func (g *OrderGuard) FindByTag(ctx context.Context, tag string) (string, bool, error) {
+	var lastErr error
+	for attempt := 0; attempt < guardLookupAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", false, ctx.Err()
+			case <-time.After(guardLookupDelay):
+			}
+		}
+		orders, err := g.orders.WithContext(ctx).ListOrders()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		for _, o := range orders {
+			if o.Remarks == tag {
+				return o.OrderID, true, nil
+			}
+		}
+	}
+	return "", false, lastErr
+}
+
+// isAmbiguous reports whether err leaves it unknown if the broker received
+// the request: timeouts, cancellations and connections lost after the
+// request was written, and responses without an order id, as opposed to
+// an error response from the API or a connection that never opened, such
+// as a failed DNS lookup or a refused dial.
+func isAmbiguous(err error) bool {
+	if errors.Is(err, errNotSent) {
+		return false
+	}
+	if errors.Is(err, errNoOrderID) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return opErr != nil ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
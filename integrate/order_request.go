@@ -0,0 +1,118 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+)
+
+// OrderRequest holds the parameters of PlaceOrder, so an order can be
+// built, inspected and passed around before it is placed.
+type OrderRequest struct {
+	Exchange          string
+	OrderType         string
+	Price             float64
+	PriceType         string
+	ProductType       string
+	Quantity          int
+	TradingSymbol     string
+	Amo               *string  // Optional
+	BookLossPrice     *float64 // Optional
+	BookProfitPrice   *float64 // Optional
+	DisclosedQuantity *int     // Optional
+	MarketProtection  *float64 // Optional
+	Remarks           *string  // Optional
+	TrailingPrice     *float64 // Optional
+	TriggerPrice      *float64 // Optional
+	Validity          string
+
+	// Tag is the client tag appended to Remarks when the order is sent.
+	// One is generated when it is empty; set it to find the order later.
+	Tag string
+}
+
+// PlaceOrderRequest places req like PlaceOrder, tagged with req.Tag. When a
+// RiskEngine has been created for io, req must pass its checks first.
+func (io *IntegrateOrders) PlaceOrderRequest(req OrderRequest) (map[string]interface{}, error) {
+	if err := io.riskCheck(req); err != nil {
+		return nil, err
+	}
+	return io.placeRequest(req)
+}
+
+// riskCheck runs the RiskEngine created for io, if any, against req. The
+// lookups run under the context of a WithContext view, or are bounded by
+// defaultRiskCheckTimeout.
+func (io *IntegrateOrders) riskCheck(req OrderRequest) error {
+	r := io.risk.Load()
+	if r == nil {
+		return nil
+	}
+	ctx := io.c2i.ctx
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), defaultRiskCheckTimeout)
+		defer cancel()
+	}
+	return r.Check(ctx, req)
+}
+
+// placeRequest places req without the risk check.
+func (io *IntegrateOrders) placeRequest(req OrderRequest) (map[string]interface{}, error) {
+	if io.halted.Load() {
+		return nil, ErrTradingHalted
+	}
+	return io.placeOrder(
+		req.Exchange,
+		req.OrderType,
+		req.Price,
+		req.PriceType,
+		req.ProductType,
+		req.Quantity,
+		req.TradingSymbol,
+		req.Amo,
+		req.BookLossPrice,
+		req.BookProfitPrice,
+		req.DisclosedQuantity,
+		req.MarketProtection,
+		req.Remarks,
+		req.TrailingPrice,
+		req.TriggerPrice,
+		req.Validity,
+		req.Tag,
+	)
+}
+
+// Opposite returns the order type that closes a position opened by orderType.
+func Opposite(orderType string) string {
+	if orderType == OrderTypeBuy {
+		return OrderTypeSell
+	}
+	return OrderTypeBuy
+}
+
+// orderIDFrom extracts the order id from a placeorder response.
+func orderIDFrom(r map[string]interface{}) (string, error) {
+	id := fieldString(r, "order_id")
+	if id == "" {
+		return "", errors.New("order_id missing from response")
+	}
+	return id, nil
+}
+
+// payload returns req in the shape of a placeorder body, as used in margin
+// basket lists.
+func (req OrderRequest) payload() map[string]interface{} {
+	p := map[string]interface{}{
+		"exchange":      req.Exchange,
+		"order_type":    req.OrderType,
+		"price":         req.Price,
+		"price_type":    req.PriceType,
+		"product_type":  req.ProductType,
+		"quantity":      req.Quantity,
+		"tradingsymbol": req.TradingSymbol,
+	}
+	if req.TriggerPrice != nil {
+		p["trigger_price"] = *req.TriggerPrice
+	}
+	return p
+}
@@ -0,0 +1,198 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultFreezeQuantities is the largest quantity the exchange accepts in a
+// single order for each F&O underlying. Exchanges revise these from time to
+// time, so OrderSlicer.FreezeQuantities can be updated at runtime.
+var DefaultFreezeQuantities = map[string]int{
+	"NIFTY":      1800,
+	"BANKNIFTY":  900,
+	"FINNIFTY":   1800,
+	"MIDCPNIFTY": 2800,
+	"NIFTYNXT50": 600,
+	"SENSEX":     1000,
+	"BANKEX":     900,
+}
+
+// SliceResult is the outcome of placing one child order. Request carries
+// the client tag the child was sent with.
+type SliceResult struct {
+	Request  OrderRequest
+	OrderID  string
+	Response map[string]interface{}
+	Err      error
+
+	// accepted is set when placeorder succeeded but the response could
+	// not be read, so the child is most likely working.
+	accepted bool
+}
+
+// SlicedOrder is the aggregate result of placing a sliced order.
+type SlicedOrder struct {
+	Parent   OrderRequest
+	Children []SliceResult
+}
+
+// OrderIDs returns the ids of the children that were placed.
+func (s *SlicedOrder) OrderIDs() []string {
+	var ids []string
+	for _, c := range s.Children {
+		if c.Err == nil {
+			ids = append(ids, c.OrderID)
+		}
+	}
+	return ids
+}
+
+// Failed returns the children that were not placed.
+func (s *SlicedOrder) Failed() []SliceResult {
+	var failed []SliceResult
+	for _, c := range s.Children {
+		if c.Err != nil {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// Err summarizes the child errors, or returns nil if every child was placed.
+func (s *SlicedOrder) Err() error {
+	failed := s.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(failed))
+	for i, f := range failed {
+		msgs[i] = f.Err.Error()
+	}
+	return fmt.Errorf("%d of %d slices failed: %s", len(failed), len(s.Children), strings.Join(msgs, "; "))
+}
+
+// OrderSlicer splits orders larger than the exchange freeze quantity into
+// lot-aligned child orders and places them one by one through the session
+// rate limiter, instead of relying on the broker's sliceorder route.
+type OrderSlicer struct {
+	orders           *IntegrateOrders
+	guard            *OrderGuard
+	FreezeQuantities map[string]int
+	logging          bool
+}
+
+// NewOrderSlicer initializes a slicer with DefaultFreezeQuantities.
+func NewOrderSlicer(orders *IntegrateOrders, logging bool) *OrderSlicer {
+	freeze := make(map[string]int, len(DefaultFreezeQuantities))
+	for k, v := range DefaultFreezeQuantities {
+		freeze[k] = v
+	}
+	return &OrderSlicer{orders: orders, guard: NewOrderGuard(orders, logging), FreezeQuantities: freeze, logging: logging}
+}
+
+// lotSize returns the lot size from the symbols file, or 1.
+func lotSize(c2i *ConnectToIntegrate, exchange, tradingSymbol string) int {
+	if symbol, ok := findSymbol(c2i, exchange, tradingSymbol); ok {
+		if n := fieldInt(symbol, "lot_size"); n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// Plan splits req into child orders of at most the freeze quantity, each a
+// multiple of the lot size. Instruments without a freeze quantity are
+// returned as a single order.
+func (s *OrderSlicer) Plan(req OrderRequest) ([]OrderRequest, error) {
+	if req.Quantity <= 0 {
+		return nil, errors.New("quantity must be positive")
+	}
+
+	lot := lotSize(s.orders.c2i, req.Exchange, req.TradingSymbol)
+	underlying := ""
+	if symbol, ok := findSymbol(s.orders.c2i, req.Exchange, req.TradingSymbol); ok {
+		underlying = fieldString(symbol, "symbol")
+	}
+	if req.Quantity%lot != 0 {
+		return nil, fmt.Errorf("quantity %d is not a multiple of lot size %d", req.Quantity, lot)
+	}
+
+	freeze, ok := s.FreezeQuantities[underlying]
+	if !ok || req.Quantity <= freeze {
+		return []OrderRequest{req}, nil
+	}
+
+	maxChild := freeze / lot * lot
+	if maxChild == 0 {
+		return nil, fmt.Errorf("freeze quantity %d is below lot size %d", freeze, lot)
+	}
+
+	var children []OrderRequest
+	for left := req.Quantity; left > 0; left -= maxChild {
+		child := req
+		child.Quantity = maxChild
+		if left < maxChild {
+			child.Quantity = left
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// Place slices req and places every child. Children are attempted even if
+// an earlier one fails; the returned SlicedOrder reports each outcome and
+// can be passed to Retry. The error is only set when req cannot be sliced.
+func (s *OrderSlicer) Place(ctx context.Context, req OrderRequest) (*SlicedOrder, error) {
+	children, err := s.Plan(req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SlicedOrder{Parent: req, Children: make([]SliceResult, len(children))}
+	for i, child := range children {
+		child.Tag = s.guard.NewTag()
+		result.Children[i] = s.placeChild(ctx, child)
+	}
+	return result, nil
+}
+
+// Retry places again the children of result that failed. Only children
+// the broker rejected outright are sent again. Those whose outcome is
+// unknown, after a timeout or an unreadable response, are first looked up
+// in Orders() by their client tag and only sent again when not found.
+func (s *OrderSlicer) Retry(ctx context.Context, result *SlicedOrder) error {
+	for i, c := range result.Children {
+		if c.Err == nil {
+			continue
+		}
+		if c.accepted || isAmbiguous(c.Err) {
+			id, found, err := s.guard.FindByTag(ctx, *tagRemarks(c.Request.Remarks, c.Request.Tag))
+			if found {
+				result.Children[i].OrderID, result.Children[i].Err = id, nil
+				continue
+			}
+			if err != nil {
+				result.Children[i].Err = fmt.Errorf("%w; lookup failed: %w", c.Err, err)
+				continue
+			}
+		}
+		result.Children[i] = s.placeChild(ctx, c.Request)
+	}
+	return result.Err()
+}
+
+func (s *OrderSlicer) placeChild(ctx context.Context, req OrderRequest) SliceResult {
+	res := SliceResult{Request: req}
+	res.Response, res.Err = s.orders.WithContext(ctx).PlaceOrderRequest(req)
+	if res.Err == nil {
+		res.OrderID, res.Err = orderIDFrom(res.Response)
+		res.accepted = res.Err != nil
+	}
+	if s.logging {
+		logger.Printf("slice %s %s qty %d: order %s err %v", req.OrderType, req.TradingSymbol, req.Quantity, res.OrderID, res.Err)
+	}
+	return res
+}
@@ -0,0 +1,336 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// legalTransitions lists, for each order status, the statuses it may move to.
+var legalTransitions = map[string][]string{
+	"":                   {OrderStatusNew, OrderStatusOpen, OrderStatusReplaced, OrderStatusComplete, OrderStatusCancelled, OrderStatusRejected},
+	OrderStatusNew:       {OrderStatusOpen, OrderStatusReplaced, OrderStatusComplete, OrderStatusCancelled, OrderStatusRejected},
+	OrderStatusOpen:      {OrderStatusOpen, OrderStatusReplaced, OrderStatusComplete, OrderStatusCancelled},
+	OrderStatusReplaced:  {OrderStatusOpen, OrderStatusReplaced, OrderStatusComplete, OrderStatusCancelled},
+	OrderStatusComplete:  {},
+	OrderStatusCancelled: {},
+	OrderStatusRejected:  {},
+}
+
+// isTerminalStatus reports whether an order in status can no longer change.
+func isTerminalStatus(status string) bool {
+	return status == OrderStatusComplete || status == OrderStatusCancelled || status == OrderStatusRejected
+}
+
+func isLegalTransition(from, to string) bool {
+	for _, s := range legalTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderTransition is a change of state of a tracked order. Illegal is set
+// when the move is not allowed by the order lifecycle; an illegal move out
+// of a terminal status is recorded but not applied.
+type OrderTransition struct {
+	OrderID string
+	From    string
+	To      string
+	Update  OrderUpdate
+	Illegal bool
+}
+
+// TrackedOrder is the local view of an order.
+type TrackedOrder struct {
+	OrderID string
+	Status  string
+	Last    OrderUpdate
+	Fills   []Fill
+	History []OrderTransition
+}
+
+// FilledQuantity returns the quantity executed so far.
+func (o TrackedOrder) FilledQuantity() int {
+	n := 0
+	for _, f := range o.Fills {
+		n += f.Quantity
+	}
+	if n < o.Last.FilledQuantity {
+		n = o.Last.FilledQuantity
+	}
+	return n
+}
+
+type trackedState struct {
+	order   TrackedOrder
+	fillIDs map[string]struct{}
+	done    chan struct{}
+}
+
+// OrderTracker follows registered orders through NEW, OPEN and their final
+// status. It is fed by the websocket order stream or PollOrderUpdates via
+// Apply or Run, or polls Order(orderID) itself with Poll.
+type OrderTracker struct {
+	orders       *IntegrateOrders
+	logging      bool
+	OnTransition func(OrderTransition)
+
+	mu      sync.Mutex
+	tracked map[string]*trackedState
+	subs    map[chan OrderTransition]struct{}
+}
+
+// NewOrderTracker initializes an empty tracker.
+func NewOrderTracker(orders *IntegrateOrders, logging bool) *OrderTracker {
+	return &OrderTracker{
+		orders:  orders,
+		logging: logging,
+		tracked: make(map[string]*trackedState),
+		subs:    make(map[chan OrderTransition]struct{}),
+	}
+}
+
+// Register starts tracking an order id. Registering twice is a no-op.
+func (t *OrderTracker) Register(orderID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tracked[orderID]; ok {
+		return
+	}
+	t.tracked[orderID] = &trackedState{
+		order:   TrackedOrder{OrderID: orderID},
+		fillIDs: make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Get returns the current view of a tracked order.
+func (t *OrderTracker) Get(orderID string) (TrackedOrder, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.tracked[orderID]
+	if !ok {
+		return TrackedOrder{}, false
+	}
+	return st.snapshot(), true
+}
+
+func (st *trackedState) snapshot() TrackedOrder {
+	o := st.order
+	o.Fills = append([]Fill(nil), o.Fills...)
+	o.History = append([]OrderTransition(nil), o.History...)
+	return o
+}
+
+// Subscribe returns a channel of transitions of every tracked order and a
+// function that ends the subscription. Transitions are dropped for a
+// subscriber whose buffer is full.
+func (t *OrderTracker) Subscribe(buffer int) (<-chan OrderTransition, func()) {
+	ch := make(chan OrderTransition, buffer)
+
+	t.mu.Lock()
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subs, ch)
+			t.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Apply feeds an order update into the tracker. Updates for orders that are
+// not registered are ignored.
+func (t *OrderTracker) Apply(u OrderUpdate) {
+	t.mu.Lock()
+	st, ok := t.tracked[u.OrderID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+
+	from := st.order.Status
+	if from == u.Status && st.order.Last.sameState(u) {
+		t.mu.Unlock()
+		return
+	}
+
+	tr := OrderTransition{
+		OrderID: u.OrderID,
+		From:    from,
+		To:      u.Status,
+		Update:  u,
+		Illegal: !isLegalTransition(from, u.Status),
+	}
+	st.order.History = append(st.order.History, tr)
+	if !(tr.Illegal && isTerminalStatus(from)) {
+		st.order.Status = u.Status
+		st.order.Last = u
+		if isTerminalStatus(u.Status) {
+			close(st.done)
+		}
+	}
+	t.publish(tr)
+	t.mu.Unlock()
+
+	if tr.Illegal && t.logging {
+		logger.Printf("order %s: illegal transition %s -> %s", tr.OrderID, tr.From, tr.To)
+	}
+	if t.OnTransition != nil {
+		t.OnTransition(tr)
+	}
+}
+
+// publish sends tr to every subscriber. Callers hold t.mu.
+func (t *OrderTracker) publish(tr OrderTransition) {
+	for ch := range t.subs {
+		select {
+		case ch <- tr:
+		default:
+		}
+	}
+}
+
+// Run applies updates until ctx is done or updates is closed.
+func (t *OrderTracker) Run(ctx context.Context, updates <-chan OrderUpdate) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			t.Apply(u)
+		}
+	}
+}
+
+// Poll fetches Order(orderID) for every tracked order that is not final,
+// and the trade book for fills, every interval until ctx is done. It
+// returns at once when the tracker has no orders client. An interval <= 0
+// polls every second.
+func (t *OrderTracker) Poll(ctx context.Context, interval time.Duration) {
+	if t.orders == nil {
+		if t.logging {
+			logger.Printf("order tracker has no orders client, not polling")
+		}
+		return
+	}
+	if interval <= 0 {
+		interval = defaultOrderPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		t.pollOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *OrderTracker) pollOnce(ctx context.Context) {
+	t.mu.Lock()
+	var pending []string
+	for id, st := range t.tracked {
+		if !isTerminalStatus(st.order.Status) {
+			pending = append(pending, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, id := range pending {
+		r, err := t.orders.WithContext(ctx).Order(id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if t.logging {
+				logger.Printf("order %s: poll failed: %v", id, err)
+			}
+			continue
+		}
+		u := parseOrderRow(r)
+		if u.OrderID == "" {
+			u.OrderID = id
+		}
+		t.Apply(u)
+	}
+
+	if len(pending) > 0 {
+		if err := t.SyncTrades(); err != nil && t.logging {
+			logger.Printf("trade sync failed: %v", err)
+		}
+	}
+}
+
+// SyncTrades records fills of tracked orders from the trade book.
+func (t *OrderTracker) SyncTrades() error {
+	if t.orders == nil {
+		return errors.New("order tracker has no orders client")
+	}
+	fills, err := t.orders.ListTrades()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, f := range fills {
+		st, ok := t.tracked[f.OrderID]
+		if !ok {
+			continue
+		}
+		id := f.FillID
+		if id == "" {
+			id = fmt.Sprintf("%s/%d@%g/%s", f.OrderID, f.Quantity, f.Price, f.Time)
+		}
+		if _, seen := st.fillIDs[id]; seen {
+			continue
+		}
+		st.fillIDs[id] = struct{}{}
+		st.order.Fills = append(st.order.Fills, f)
+	}
+	return nil
+}
+
+// WaitForFill blocks until the order reaches a final status or ctx is done.
+// It returns the order and nil when it completed, or an error describing
+// why it was cancelled or rejected.
+func (t *OrderTracker) WaitForFill(ctx context.Context, orderID string) (TrackedOrder, error) {
+	t.mu.Lock()
+	st, ok := t.tracked[orderID]
+	t.mu.Unlock()
+	if !ok {
+		return TrackedOrder{}, fmt.Errorf("order %s is not tracked", orderID)
+	}
+
+	select {
+	case <-ctx.Done():
+		o, _ := t.Get(orderID)
+		return o, ctx.Err()
+	case <-st.done:
+	}
+
+	o, _ := t.Get(orderID)
+	if o.Status != OrderStatusComplete {
+		return o, fmt.Errorf("order %s %s: %s", orderID, o.Status, o.Last.Message)
+	}
+	return o, nil
+}
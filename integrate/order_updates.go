@@ -0,0 +1,314 @@
+package integrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OrderUpdate is a change in the state of one order. Status is one of the
+// OrderStatus* constants.
+type OrderUpdate struct {
+	OrderID         string
+	Exchange        string
+	TradingSymbol   string
+	OrderType       string
+	PriceType       string
+	ProductType     string
+	Status          string
+	Quantity        int
+	FilledQuantity  int
+	PendingQuantity int
+	Price           float64
+	TriggerPrice    float64
+	AveragePrice    float64
+	Remarks         string
+	Message         string
+	Time            time.Time
+}
+
+// sameState reports whether two updates describe the same order state.
+func (u OrderUpdate) sameState(o OrderUpdate) bool {
+	return u.Status == o.Status &&
+		u.Quantity == o.Quantity &&
+		u.FilledQuantity == o.FilledQuantity &&
+		u.Price == o.Price &&
+		u.TriggerPrice == o.TriggerPrice
+}
+
+// normalizeOrderStatus maps the status strings used by the order book and
+// the websocket feed onto the OrderStatus* constants.
+func normalizeOrderStatus(status, reportType string) string {
+	switch strings.ToUpper(reportType) {
+	case "NEWACK":
+		return OrderStatusNew
+	case "REPLACED", "MODACK":
+		return OrderStatusReplaced
+	}
+
+	switch s := strings.ToUpper(strings.TrimSpace(status)); s {
+	case "NEW", "PENDING", "VALIDATION_PENDING", "PUT_ORDER_REQ_RECEIVED":
+		return OrderStatusNew
+	case "OPEN", "TRIGGER_PENDING", "PARTIALLY_FILLED":
+		return OrderStatusOpen
+	case "COMPLETE", "COMPLETED", "FILLED":
+		return OrderStatusComplete
+	case "CANCELED", "CANCELLED":
+		return OrderStatusCancelled
+	case "REJECTED":
+		return OrderStatusRejected
+	case "REPLACED", "MODIFIED":
+		return OrderStatusReplaced
+	default:
+		return s
+	}
+}
+
+// wsCodes translates the short codes used on the websocket feed.
+var wsCodes = map[string]map[string]string{
+	"trantype": {"B": OrderTypeBuy, "S": OrderTypeSell},
+	"prctyp": {
+		"LMT":    PriceTypeLimit,
+		"MKT":    PriceTypeMarket,
+		"SL-LMT": PriceTypeSlLmt,
+		"SL-MKT": PriceTypeSlMkt,
+	},
+	"prd": {"C": ProductTypeCNC, "I": ProductTypeIntraday, "M": ProductTypeNormal},
+}
+
+func wsCode(m map[string]interface{}, key string) string {
+	v := fieldString(m, key)
+	if full, ok := wsCodes[key][v]; ok {
+		return full
+	}
+	return v
+}
+
+// parseWSOrderUpdate decodes an "om" message from the websocket.
+func parseWSOrderUpdate(m map[string]interface{}) OrderUpdate {
+	u := OrderUpdate{
+		OrderID:        fieldString(m, "norenordno"),
+		Exchange:       fieldString(m, "exch"),
+		TradingSymbol:  fieldString(m, "tsym"),
+		OrderType:      wsCode(m, "trantype"),
+		PriceType:      wsCode(m, "prctyp"),
+		ProductType:    wsCode(m, "prd"),
+		Status:         normalizeOrderStatus(fieldString(m, "status"), fieldString(m, "reporttype")),
+		Quantity:       fieldInt(m, "qty"),
+		FilledQuantity: fieldInt(m, "fillshares"),
+		Price:          fieldFloat(m, "prc"),
+		TriggerPrice:   fieldFloat(m, "trgprc"),
+		AveragePrice:   fieldFloat(m, "avgprc"),
+		Remarks:        fieldString(m, "remarks"),
+		Message:        fieldString(m, "rejreason"),
+		Time:           time.Now(),
+	}
+	u.PendingQuantity = u.Quantity - u.FilledQuantity
+	return u
+}
+
+// parseOrderRow decodes one entry of the Orders() order book.
+func parseOrderRow(m map[string]interface{}) OrderUpdate {
+	u := OrderUpdate{
+		OrderID:         fieldString(m, "order_id"),
+		Exchange:        fieldString(m, "exchange"),
+		TradingSymbol:   fieldString(m, "tradingsymbol"),
+		OrderType:       fieldString(m, "order_type"),
+		PriceType:       fieldString(m, "price_type"),
+		ProductType:     fieldString(m, "product_type"),
+		Status:          normalizeOrderStatus(fieldString(m, "order_status"), ""),
+		Quantity:        fieldInt(m, "quantity"),
+		FilledQuantity:  fieldInt(m, "filled_qty"),
+		PendingQuantity: fieldInt(m, "pending_qty"),
+		Price:           fieldFloat(m, "price"),
+		TriggerPrice:    fieldFloat(m, "trigger_price"),
+		AveragePrice:    fieldFloat(m, "average_traded_price"),
+		Remarks:         fieldString(m, "remarks"),
+		Message:         fieldString(m, "message"),
+		Time:            time.Now(),
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", fieldString(m, "order_entry_time"), IST); err == nil {
+		u.Time = t
+	}
+	return u
+}
+
+// orderState fetches one order under ctx and decodes it.
+func orderState(ctx context.Context, orders *IntegrateOrders, orderID string) (OrderUpdate, error) {
+	r, err := orders.WithContext(ctx).Order(orderID)
+	if err != nil {
+		return OrderUpdate{}, fmt.Errorf("order %s: %w", orderID, err)
+	}
+	return parseOrderRow(r), nil
+}
+
+// awaitTerminal polls an order every poll until it is COMPLETE, CANCELED
+// or REJECTED, giving up after timeout. It is used after a cancel, so that
+// fills landing while the cancel is in flight are counted.
+func awaitTerminal(ctx context.Context, orders *IntegrateOrders, orderID string, poll, timeout time.Duration) (OrderUpdate, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		u, err := orderState(ctx, orders, orderID)
+		if err == nil && isTerminalStatus(u.Status) {
+			return u, nil
+		}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return OrderUpdate{}, fmt.Errorf("order %s not final after cancel: %w", orderID, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// responseRows returns the list stored under key in a book response such as
+// Orders(), Trades() or Positions().
+func responseRows(r map[string]interface{}, key string) []map[string]interface{} {
+	list, _ := r[key].([]interface{})
+	rows := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		if row, ok := item.(map[string]interface{}); ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// ListOrders fetches Orders() and decodes every entry.
+func (io *IntegrateOrders) ListOrders() ([]OrderUpdate, error) {
+	r, err := io.Orders()
+	if err != nil {
+		return nil, err
+	}
+	rows := responseRows(r, "orders")
+	orders := make([]OrderUpdate, len(rows))
+	for i, row := range rows {
+		orders[i] = parseOrderRow(row)
+	}
+	return orders, nil
+}
+
+// defaultOrderPollInterval is used by PollOrderUpdates when no positive
+// interval is given.
+const defaultOrderPollInterval = time.Second
+
+// PollOrderUpdates is the polling fallback for the websocket order stream.
+// It fetches the order book every interval and emits an OrderUpdate for
+// each order that is new or whose state changed since the previous poll.
+// Request errors are sent on the error channel without stopping the poll.
+// Both channels are closed when ctx is done. An interval <= 0 polls every
+// second.
+func (io *IntegrateOrders) PollOrderUpdates(ctx context.Context, interval time.Duration) (<-chan OrderUpdate, <-chan error) {
+	if interval <= 0 {
+		interval = defaultOrderPollInterval
+	}
+	updates := make(chan OrderUpdate)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(updates)
+		defer close(errs)
+
+		last := make(map[string]OrderUpdate)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			orders, err := io.ListOrders()
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+			for _, o := range orders {
+				prev, seen := last[o.OrderID]
+				if seen && prev.sameState(o) {
+					continue
+				}
+				last[o.OrderID] = o
+
+				// An open order whose terms changed was modified, which the
+				// websocket reports as a replacement.
+				if seen && o.Status == OrderStatusOpen && prev.Status == OrderStatusOpen && o.FilledQuantity == prev.FilledQuantity {
+					o.Status = OrderStatusReplaced
+				}
+				select {
+				case updates <- o:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return updates, errs
+}
+
+// Fill is one execution from the Trades() book.
+type Fill struct {
+	FillID        string
+	OrderID       string
+	Exchange      string
+	TradingSymbol string
+	OrderType     string
+	ProductType   string
+	Quantity      int
+	Price         float64
+	Remarks       string
+	Time          time.Time
+}
+
+// parseTradeRow decodes one entry of the Trades() book.
+func parseTradeRow(m map[string]interface{}) Fill {
+	f := Fill{
+		FillID:        fieldString(m, "fill_id"),
+		OrderID:       fieldString(m, "order_id"),
+		Exchange:      fieldString(m, "exchange"),
+		TradingSymbol: fieldString(m, "tradingsymbol"),
+		OrderType:     fieldString(m, "order_type"),
+		ProductType:   fieldString(m, "product_type"),
+		Quantity:      fieldInt(m, "filled_qty"),
+		Price:         fieldFloat(m, "fill_price"),
+		Remarks:       fieldString(m, "remarks"),
+	}
+	if f.Quantity == 0 {
+		f.Quantity = fieldInt(m, "fill_qty")
+	}
+	if f.Price == 0 {
+		f.Price = fieldFloat(m, "average_traded_price")
+	}
+	if f.FillID == "" {
+		f.FillID = fieldString(m, "exchange_tradeid")
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", fieldString(m, "fill_time"), IST); err == nil {
+		f.Time = t
+	}
+	return f
+}
+
+// ListTrades fetches Trades() and decodes every fill.
+func (io *IntegrateOrders) ListTrades() ([]Fill, error) {
+	r, err := io.Trades()
+	if err != nil {
+		return nil, err
+	}
+	rows := responseRows(r, "trades")
+	fills := make([]Fill, len(rows))
+	for i, row := range rows {
+		fills[i] = parseTradeRow(row)
+	}
+	return fills, nil
+}
@@ -0,0 +1,209 @@
+package integrate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// OrderBookSnapshot is a consistent copy of an OrderBook at one moment.
+type OrderBookSnapshot struct {
+	Exchange string
+	Token    string
+	Bids     [5]DepthLevel
+	Asks     [5]DepthLevel
+	LTP      float64
+	Time     time.Time
+	Updates  uint64
+}
+
+// Valid reports whether both sides of the book have a price.
+func (s OrderBookSnapshot) Valid() bool {
+	return s.Bids[0].Price > 0 && s.Asks[0].Price > 0
+}
+
+// BestBid returns the top bid level.
+func (s OrderBookSnapshot) BestBid() DepthLevel {
+	return s.Bids[0]
+}
+
+// BestAsk returns the top ask level.
+func (s OrderBookSnapshot) BestAsk() DepthLevel {
+	return s.Asks[0]
+}
+
+// Spread returns best ask minus best bid, or 0 for a one-sided book.
+func (s OrderBookSnapshot) Spread() float64 {
+	if !s.Valid() {
+		return 0
+	}
+	return s.Asks[0].Price - s.Bids[0].Price
+}
+
+// Mid returns the midpoint of the best bid and ask, or 0 for a one-sided book.
+func (s OrderBookSnapshot) Mid() float64 {
+	if !s.Valid() {
+		return 0
+	}
+	return (s.Asks[0].Price + s.Bids[0].Price) / 2
+}
+
+// Microprice weights the best bid and ask by the quantity on the opposite
+// side, leaning towards the side more likely to trade next.
+func (s OrderBookSnapshot) Microprice() float64 {
+	if !s.Valid() {
+		return 0
+	}
+	bid, ask := s.Bids[0], s.Asks[0]
+	total := bid.Quantity + ask.Quantity
+	if total == 0 {
+		return s.Mid()
+	}
+	return (bid.Price*float64(ask.Quantity) + ask.Price*float64(bid.Quantity)) / float64(total)
+}
+
+// Imbalance returns (bid qty - ask qty) / (bid qty + ask qty) over the top
+// levels, in the range -1 (all asks) to 1 (all bids).
+func (s OrderBookSnapshot) Imbalance(levels int) float64 {
+	if levels <= 0 || levels > len(s.Bids) {
+		levels = len(s.Bids)
+	}
+	var bids, asks int
+	for i := 0; i < levels; i++ {
+		bids += s.Bids[i].Quantity
+		asks += s.Asks[i].Quantity
+	}
+	if bids+asks == 0 {
+		return 0
+	}
+	return float64(bids-asks) / float64(bids+asks)
+}
+
+// OrderBook maintains the five level book of one instrument. It is safe to
+// update from the feed goroutine while other goroutines take snapshots.
+type OrderBook struct {
+	mu   sync.RWMutex
+	snap OrderBookSnapshot
+}
+
+// NewOrderBook initializes an empty book.
+func NewOrderBook(exchange, token string) *OrderBook {
+	return &OrderBook{snap: OrderBookSnapshot{Exchange: exchange, Token: token}}
+}
+
+// ApplyDepth replaces the book with a depth update. Updates older than the
+// current book are ignored.
+func (b *OrderBook) ApplyDepth(d Depth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if d.Time.Before(b.snap.Time) {
+		return
+	}
+	b.snap.Bids = d.Bids
+	b.snap.Asks = d.Asks
+	if d.LTP > 0 {
+		b.snap.LTP = d.LTP
+	}
+	b.snap.Time = d.Time
+	b.snap.Updates++
+}
+
+// SeedFromQuote fills the book from the depth fields of a quote. It is
+// meant for startup, before the websocket delivers its first depth, and
+// does nothing once the book has been filled.
+func (b *OrderBook) SeedFromQuote(q *Quote) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.snap.Updates > 0 || !b.snap.Time.IsZero() {
+		return
+	}
+
+	b.snap.Bids = q.Bids
+	b.snap.Asks = q.Asks
+	b.snap.LTP = q.LTP
+	b.snap.Updates++
+}
+
+// Snapshot returns a copy of the current book.
+func (b *OrderBook) Snapshot() OrderBookSnapshot {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.snap
+}
+
+// OrderBooks keeps an OrderBook per instrument fed from depth updates.
+type OrderBooks struct {
+	mu    sync.RWMutex
+	books map[InstrumentToken]*OrderBook
+}
+
+// NewOrderBooks initializes an empty set of books.
+func NewOrderBooks() *OrderBooks {
+	return &OrderBooks{books: make(map[InstrumentToken]*OrderBook)}
+}
+
+// Book returns the book for an instrument, creating it if needed.
+func (s *OrderBooks) Book(exchange, token string) *OrderBook {
+	key := InstrumentToken{Exchange: exchange, Token: token}
+
+	s.mu.RLock()
+	b := s.books[key]
+	s.mu.RUnlock()
+	if b != nil {
+		return b
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b = s.books[key]; b == nil {
+		b = NewOrderBook(exchange, token)
+		s.books[key] = b
+	}
+	return b
+}
+
+// Snapshot returns the current book of an instrument.
+func (s *OrderBooks) Snapshot(exchange, token string) (OrderBookSnapshot, bool) {
+	s.mu.RLock()
+	b := s.books[InstrumentToken{Exchange: exchange, Token: token}]
+	s.mu.RUnlock()
+	if b == nil {
+		return OrderBookSnapshot{}, false
+	}
+	return b.Snapshot(), true
+}
+
+// ApplyDepth routes a depth update to its book.
+func (s *OrderBooks) ApplyDepth(d Depth) {
+	s.Book(d.Exchange, d.Token).ApplyDepth(d)
+}
+
+// Seed fetches quotes for instruments and seeds their books. Per-item
+// errors are returned in the results.
+func (s *OrderBooks) Seed(ctx context.Context, data *IntegrateData, instruments []Instrument) []QuoteResult {
+	results := data.QuotesMany(ctx, instruments)
+	for _, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		s.Book(res.Quote.Exchange, res.Quote.Token).SeedFromQuote(res.Quote)
+	}
+	return results
+}
+
+// Run applies depth updates until ctx is done or depths is closed.
+func (s *OrderBooks) Run(ctx context.Context, depths <-chan Depth) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-depths:
+			if !ok {
+				return
+			}
+			s.ApplyDepth(d)
+		}
+	}
+}
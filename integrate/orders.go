@@ -1,14 +1,21 @@
 package integrate
 
 import (
+    "context"
     "errors"
     "fmt"
     "log"
+    "sync/atomic"
 )
 
+// ErrTradingHalted is returned for new orders while the kill switch is engaged.
+var ErrTradingHalted = errors.New("order entry is halted by the kill switch")
+
 type IntegrateOrders struct {
     c2i     *ConnectToIntegrate
     logging bool
+    halted  *atomic.Bool
+    risk    *atomic.Pointer[RiskEngine]
 }
 
 // NewIntegrateOrders initializes a new instance of IntegrateOrders
@@ -16,10 +23,27 @@ func NewIntegrateOrders(connectToIntegrate *ConnectToIntegrate, logging bool) *I
     return &IntegrateOrders{
         c2i:     connectToIntegrate,
         logging: logging,
+        halted:  new(atomic.Bool),
+        risk:    new(atomic.Pointer[RiskEngine]),
+    }
+}
+
+// WithContext returns a view of io whose requests wait for the rate limit
+// and run under ctx. The view shares the kill switch and risk gate with io.
+func (io *IntegrateOrders) WithContext(ctx context.Context) *IntegrateOrders {
+    return &IntegrateOrders{
+        c2i:     io.c2i.withContext(ctx),
+        logging: io.logging,
+        halted:  io.halted,
+        risk:    io.risk,
     }
 }
 
-// PlaceOrder places an order and returns order details.
+// PlaceOrder places an order and returns order details. A client tag is
+// appended to remarks so the order can be found in Orders() if the
+// response is lost.
+// It fails with ErrTradingHalted while the kill switch is engaged, and
+// with a *RiskRejection when the order breaks a RiskEngine rule.
 func (io *IntegrateOrders) PlaceOrder(
     exchange string,
     orderType string,
@@ -38,6 +62,55 @@ func (io *IntegrateOrders) PlaceOrder(
     triggerPrice *float64,
     validity string,
 ) (map[string]interface{}, error) {
+    if io.halted.Load() {
+        return nil, ErrTradingHalted
+    }
+    err := io.riskCheck(OrderRequest{
+        Exchange:          exchange,
+        OrderType:         orderType,
+        Price:             price,
+        PriceType:         priceType,
+        ProductType:       productType,
+        Quantity:          quantity,
+        TradingSymbol:     tradingSymbol,
+        DisclosedQuantity: disclosedQuantity,
+        MarketProtection:  marketProtection,
+        TriggerPrice:      triggerPrice,
+        Validity:          validity,
+    })
+    if err != nil {
+        return nil, err
+    }
+    return io.placeOrder(exchange, orderType, price, priceType, productType, quantity, tradingSymbol,
+        amo, bookLossPrice, bookProfitPrice, disclosedQuantity, marketProtection, remarks,
+        trailingPrice, triggerPrice, validity, "")
+}
+
+// placeOrder validates and sends an order without the kill switch check.
+// tag is appended to remarks; a new one is generated when it is empty.
+func (io *IntegrateOrders) placeOrder(
+    exchange string,
+    orderType string,
+    price float64,
+    priceType string,
+    productType string,
+    quantity int,
+    tradingSymbol string,
+    amo *string,
+    bookLossPrice *float64,
+    bookProfitPrice *float64,
+    disclosedQuantity *int,
+    marketProtection *float64,
+    remarks *string,
+    trailingPrice *float64,
+    triggerPrice *float64,
+    validity string,
+    tag string,
+) (map[string]interface{}, error) {
+    if tag == "" {
+        tag = newClientTag(defaultTagPrefix)
+    }
+    remarks = tagRemarks(remarks, tag)
 
     // Validate exchange, order type, price type, and product type
     if !io.isValidExchange(exchange) {
@@ -180,7 +253,21 @@ type OrderParams struct {
 }
 
 // ModifyOrder modifies an open order based on the given parameters.
+// It fails with ErrTradingHalted while the kill switch is engaged, and
+// with a *RiskRejection when the modified order breaks a RiskEngine rule.
 func (c *Client) ModifyOrder(params OrderParams) (map[string]interface{}, error) {
+	if c.halted.Load() {
+		return nil, ErrTradingHalted
+	}
+	if err := c.riskCheck(modifyRequest(params)); err != nil {
+		return nil, err
+	}
+	return c.modifyOrder(params)
+}
+
+// modifyOrder validates and sends a modification without the kill switch
+// check.
+func (c *Client) modifyOrder(params OrderParams) (map[string]interface{}, error) {
 	// Check exchange type
 	if !contains(c.ExchangeTypes, params.Exchange) {
 		return nil, errors.New("invalid exchange type")
@@ -297,6 +384,7 @@ func (c *Client) CancelOrder(orderID string) (map[string]interface{}, error) {
 }
 
 // SliceOrder slices an order into multiple parts and places each as a separate order.
+// The whole order must pass the checks of a RiskEngine created for c.
 func (c *Client) SliceOrder(
 	exchange string,
 	orderType string,
@@ -317,6 +405,26 @@ func (c *Client) SliceOrder(
 	validity string,
 ) (map[string]interface{}, error) {
 
+	if c.halted.Load() {
+		return nil, ErrTradingHalted
+	}
+	err := c.riskCheck(OrderRequest{
+		Exchange:          exchange,
+		OrderType:         orderType,
+		Price:             price,
+		PriceType:         priceType,
+		ProductType:       productType,
+		Quantity:          quantity,
+		TradingSymbol:     tradingsymbol,
+		DisclosedQuantity: disclosedQuantity,
+		MarketProtection:  marketProtection,
+		TriggerPrice:      triggerPrice,
+		Validity:          validity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	// Validations
 	if !isValidExchange(exchange) {
 		return nil, errors.New("invalid exchange type")
@@ -440,6 +548,12 @@ func (c *Client) ConvertPositionProductType(
     if !contains(c.c2i.productTypes, productType) || !contains(c.c2i.productTypes, previousProduct) {
         return nil, errors.New("invalid product type")
     }
+    if productType == previousProduct {
+        return nil, errors.New("product type is unchanged")
+    }
+    if positionType != PositionTypeDay && positionType != PositionTypeOvernight {
+        return nil, errors.New("invalid position type")
+    }
     if quantity == 0 {
         return nil, errors.New("quantity cannot be 0")
     }
@@ -470,6 +584,7 @@ func (c *Client) ConvertPositionProductType(
 }
 
 // PlaceGTTOrder places a GTT order.
+// It fails with ErrTradingHalted while the kill switch is engaged.
 func (c *Client) PlaceGTTOrder(
     exchange string,
     orderType string,
@@ -479,6 +594,9 @@ func (c *Client) PlaceGTTOrder(
     alertPrice float64,
     condition string,
 ) (map[string]interface{}, error) {
+    if c.halted.Load() {
+        return nil, ErrTradingHalted
+    }
 
     // Validate parameters
     if !contains(c.c2i.exchangeTypes, exchange) {
@@ -555,6 +673,9 @@ func (o *Orders) ModifyGTTOrder(
 	if quantity == 0 {
 		return nil, errors.New("quantity cannot be 0")
 	}
+	if condition != GttConditionLtpBelow && condition != GttConditionLtpAbove {
+		return nil, errors.New("invalid GTT condition")
+	}
 
 	// Prepare JSON parameters for request
 	jsonParams := map[string]interface{}{
@@ -580,12 +701,17 @@ func (o *Orders) CancelGTTOrder(alertID string) (map[string]interface{}, error)
 	return o.c2i.SendRequestWithURLParams("gttcancel/{alert_id}", "GET", nil, urlParams)
 }
 
+// PlaceOCOOrder places an OCO order.
+// It fails with ErrTradingHalted while the kill switch is engaged.
 func (o *Orders) PlaceOCOOrder(
 	exchange, orderType, tradingsymbol string,
 	stoplossQuantity int, stoplossPrice float64,
 	targetQuantity int, targetPrice float64,
 	remarks *string,
 ) (map[string]interface{}, error) {
+	if o.halted.Load() {
+		return nil, ErrTradingHalted
+	}
 	// Validate input parameters
 	if !o.c2i.IsValidExchange(exchange) {
 		return nil, errors.New("invalid exchange type")
@@ -0,0 +1,794 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPaperMarginRates is the fraction of order value blocked as margin
+// for each product type.
+var DefaultPaperMarginRates = map[string]float64{
+	ProductTypeCNC:      1,
+	ProductTypeIntraday: 0.2,
+	ProductTypeNormal:   0.2,
+}
+
+// paperMarket is the latest price seen for one instrument.
+type paperMarket struct {
+	LTP    float64
+	Bid    float64
+	BidQty int
+	Ask    float64
+	AskQty int
+}
+
+type paperOrder struct {
+	OrderRequest
+	ID        string
+	Token     string
+	Status    string
+	Triggered bool
+	Filled    int
+	AvgPrice  float64
+	Message   string
+	Time      time.Time
+}
+
+func (o *paperOrder) pending() int {
+	return o.Quantity - o.Filled
+}
+
+func (o *paperOrder) row() map[string]interface{} {
+	status := o.Status
+	if status == OrderStatusOpen && isStopPrice(o.PriceType) && !o.Triggered {
+		status = "TRIGGER_PENDING"
+	}
+	row := map[string]interface{}{
+		"order_id":             o.ID,
+		"exchange":             o.Exchange,
+		"tradingsymbol":        o.TradingSymbol,
+		"token":                o.Token,
+		"order_type":           o.OrderType,
+		"price_type":           o.PriceType,
+		"product_type":         o.ProductType,
+		"order_status":         status,
+		"quantity":             o.Quantity,
+		"filled_qty":           o.Filled,
+		"price":                o.Price,
+		"average_traded_price": o.AvgPrice,
+		"validity":             o.Validity,
+		"message":              o.Message,
+		"order_entry_time":     o.Time.In(IST).Format("2006-01-02 15:04:05"),
+	}
+	if o.TriggerPrice != nil {
+		row["trigger_price"] = *o.TriggerPrice
+	}
+	if o.Remarks != nil {
+		row["remarks"] = *o.Remarks
+	}
+	if o.open() {
+		row["pending_qty"] = o.pending()
+	} else {
+		row["pending_qty"] = 0
+	}
+	return row
+}
+
+// open reports whether the order can still fill.
+func (o *paperOrder) open() bool {
+	return !isTerminalStatus(o.Status)
+}
+
+type paperPosition struct {
+	Exchange      string
+	TradingSymbol string
+	Token         string
+	ProductType   string
+	Net           int
+	AvgPrice      float64
+	BuyQty        int
+	BuyValue      float64
+	SellQty       int
+	SellValue     float64
+	Realized      float64
+	Charges       float64
+}
+
+// PaperBroker simulates the Integrate order routes against live prices.
+// Orders rest in memory and fill when quotes or ticks fed to the broker
+// cross them. MARKET orders fill at the touch plus Slippage, LIMIT orders
+// fill at the touch once it reaches the limit price, and SL orders wait for
+// the last traded price to reach the trigger: at or above it for a BUY, at
+// or below it for a SELL. A fill never takes more than the quantity shown
+// at the touch, so large orders fill partially over several updates, and
+// once the shown quantity is used up orders wait for fresh depth. Orders
+// are margined at their price, or at the last price seen for MARKET
+// orders; an order with neither is rejected.
+// With Charges set, the charges on each fill are taken from cash.
+type PaperBroker struct {
+	data          *IntegrateData
+	logging       bool
+	Slippage      float64
+	MarginRates   map[string]float64
+	Charges       ChargeModel
+	OnOrderUpdate func(OrderUpdate)
+	now           func() time.Time
+
+	mu        sync.Mutex
+	seq       int
+	cash      float64
+	orders    map[string]*paperOrder
+	orderIDs  []string
+	trades    []map[string]interface{}
+	positions map[string]*paperPosition
+	markets   map[string]paperMarket
+	last      map[string]float64
+	symbols   map[string]string
+	ledger    chargeLedger
+}
+
+// NewPaperBroker initializes a paper account holding cash. data is used by
+// Refresh to fetch quotes and may be nil when prices come from ApplyTick
+// or ApplyQuote.
+func NewPaperBroker(data *IntegrateData, cash float64, logging bool) *PaperBroker {
+	return &PaperBroker{
+		data:        data,
+		logging:     logging,
+		MarginRates: DefaultPaperMarginRates,
+		now:         time.Now,
+		cash:        cash,
+		orders:      make(map[string]*paperOrder),
+		positions:   make(map[string]*paperPosition),
+		markets:     make(map[string]paperMarket),
+		last:        make(map[string]float64),
+		symbols:     make(map[string]string),
+	}
+}
+
+func isStopPrice(priceType string) bool {
+	return priceType == PriceTypeSlLmt || priceType == PriceTypeSlMkt
+}
+
+func paperKey(exchange, tradingSymbol string) string {
+	return exchange + "|" + tradingSymbol
+}
+
+// validate applies the checks PlaceOrder and ModifyOrder make before
+// sending an order.
+func (b *PaperBroker) validate(req OrderRequest) error {
+	if req.OrderType != OrderTypeBuy && req.OrderType != OrderTypeSell {
+		return errors.New("invalid order type")
+	}
+	switch req.PriceType {
+	case PriceTypeMarket, PriceTypeLimit, PriceTypeSlLmt, PriceTypeSlMkt:
+	default:
+		return errors.New("invalid price type")
+	}
+	if _, ok := b.MarginRates[req.ProductType]; !ok {
+		return errors.New("invalid product type")
+	}
+	if req.PriceType == PriceTypeMarket && req.Price != 0 {
+		return errors.New("price should be 0 for market order")
+	}
+	if req.PriceType == PriceTypeSlLmt {
+		if req.OrderType == OrderTypeBuy && req.TriggerPrice != nil && *req.TriggerPrice > req.Price {
+			return errors.New("trigger price cannot be greater than price for SL-LIMIT BUY order")
+		} else if req.OrderType == OrderTypeSell && req.TriggerPrice != nil && *req.TriggerPrice < req.Price {
+			return errors.New("trigger price cannot be lesser than price for SL-LIMIT SELL order")
+		}
+	}
+	if isStopPrice(req.PriceType) && req.TriggerPrice == nil {
+		return errors.New("trigger price is required for SL orders")
+	}
+	if req.Quantity <= 0 {
+		return errors.New("quantity cannot be 0")
+	}
+	return nil
+}
+
+// PlaceOrderRequest accepts req as a new order, tagged like a live one, and
+// tries to fill it against the latest price. An order that needs more
+// margin than is available is recorded as REJECTED, as the exchange would.
+func (b *PaperBroker) PlaceOrderRequest(req OrderRequest) (map[string]interface{}, error) {
+	if err := b.validate(req); err != nil {
+		return nil, err
+	}
+	if req.Validity == "" {
+		req.Validity = ValidityTypeDay
+	}
+	if req.Tag == "" {
+		req.Tag = newClientTag(defaultTagPrefix)
+	}
+	req.Remarks = tagRemarks(req.Remarks, req.Tag)
+
+	token := ""
+	if b.data != nil {
+		token, _ = b.data.getToken(req.Exchange, req.TradingSymbol)
+	}
+
+	b.mu.Lock()
+	b.seq++
+	o := &paperOrder{
+		OrderRequest: req,
+		ID:           "P" + strconv.Itoa(b.seq),
+		Token:        token,
+		Status:       OrderStatusOpen,
+		Time:         b.now(),
+	}
+	b.orders[o.ID] = o
+	b.orderIDs = append(b.orderIDs, o.ID)
+	if token != "" {
+		b.symbols[paperKey(req.Exchange, token)] = req.TradingSymbol
+	}
+
+	if b.marginPrice(o) == 0 {
+		o.Status = OrderStatusRejected
+		o.Message = "no price to check margin against"
+	} else if need, free := b.orderMargin(o), b.cash-b.marginUsed(o.ID); need > free {
+		o.Status = OrderStatusRejected
+		o.Message = fmt.Sprintf("insufficient funds: required %.2f, available %.2f", need, free)
+	}
+	updates := []OrderUpdate{parseOrderRow(o.row())}
+	if o.Status == OrderStatusOpen {
+		if m, ok := b.markets[paperKey(o.Exchange, o.TradingSymbol)]; ok {
+			updates = append(updates, b.match(o, &m)...)
+		}
+	}
+	status := o.Status
+	b.mu.Unlock()
+
+	if b.logging {
+		logger.Printf("paper order %s: %s %d %s %s", o.ID, req.OrderType, req.Quantity, req.TradingSymbol, status)
+	}
+	b.notify(updates)
+	return map[string]interface{}{"status": "SUCCESS", "order_id": o.ID, "message": "order placed"}, nil
+}
+
+// ModifyOrder changes the price, trigger, quantity or price type of an
+// open order. The quantity cannot drop below what has already filled.
+func (b *PaperBroker) ModifyOrder(params OrderParams) (map[string]interface{}, error) {
+	b.mu.Lock()
+	o, ok := b.orders[params.OrderID]
+	if !ok {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("order %s not found", params.OrderID)
+	}
+	if !o.open() {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("order %s is %s", o.ID, o.Status)
+	}
+
+	req := o.OrderRequest
+	req.Price = params.Price
+	req.PriceType = params.PriceType
+	req.Quantity = params.Quantity
+	req.TriggerPrice = params.TriggerPrice
+	if params.Validity != "" {
+		req.Validity = params.Validity
+	}
+	if err := b.validate(req); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	if req.Quantity < o.Filled {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("quantity %d is below filled quantity %d", req.Quantity, o.Filled)
+	}
+
+	o.OrderRequest = req
+	o.Triggered = false
+	var updates []OrderUpdate
+	if o.pending() == 0 {
+		o.Status = OrderStatusComplete
+		updates = append(updates, parseOrderRow(o.row()))
+	} else {
+		updates = append(updates, parseOrderRow(o.row()))
+		if m, ok := b.markets[paperKey(o.Exchange, o.TradingSymbol)]; ok {
+			updates = append(updates, b.match(o, &m)...)
+		}
+	}
+	b.mu.Unlock()
+
+	b.notify(updates)
+	return map[string]interface{}{"status": "SUCCESS", "order_id": o.ID, "message": "order modified"}, nil
+}
+
+// CancelOrder cancels the unfilled part of an open order.
+func (b *PaperBroker) CancelOrder(orderID string) (map[string]interface{}, error) {
+	b.mu.Lock()
+	o, ok := b.orders[orderID]
+	if !ok {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("order %s not found", orderID)
+	}
+	if !o.open() {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("order %s is %s", o.ID, o.Status)
+	}
+	o.Status = OrderStatusCancelled
+	u := parseOrderRow(o.row())
+	b.mu.Unlock()
+
+	b.notify([]OrderUpdate{u})
+	return map[string]interface{}{"status": "SUCCESS", "order_id": orderID, "message": "order cancelled"}, nil
+}
+
+// Order returns one order in the shape of an order book entry.
+func (b *PaperBroker) Order(orderID string) (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("order %s not found", orderID)
+	}
+	return o.row(), nil
+}
+
+// Orders returns the order book, oldest order first.
+func (b *PaperBroker) Orders() (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows := make([]interface{}, len(b.orderIDs))
+	for i, id := range b.orderIDs {
+		rows[i] = b.orders[id].row()
+	}
+	return map[string]interface{}{"status": "SUCCESS", "orders": rows}, nil
+}
+
+// Trades returns every fill.
+func (b *PaperBroker) Trades() (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows := make([]interface{}, len(b.trades))
+	for i, t := range b.trades {
+		rows[i] = t
+	}
+	return map[string]interface{}{"status": "SUCCESS", "trades": rows}, nil
+}
+
+// Positions returns the position book, marked to the latest price.
+func (b *PaperBroker) Positions() (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rows := make([]interface{}, 0, len(b.positions))
+	for _, p := range b.sortedPositions() {
+		ltp := b.markets[paperKey(p.Exchange, p.TradingSymbol)].LTP
+		rows = append(rows, map[string]interface{}{
+			"exchange":          p.Exchange,
+			"tradingsymbol":     p.TradingSymbol,
+			"token":             p.Token,
+			"product_type":      p.ProductType,
+			"net_quantity":      p.Net,
+			"net_averageprice":  p.AvgPrice,
+			"day_buy_quantity":  p.BuyQty,
+			"day_buy_average":   average(p.BuyValue, p.BuyQty),
+			"day_sell_quantity": p.SellQty,
+			"day_sell_average":  average(p.SellValue, p.SellQty),
+			"lastPrice":         ltp,
+			"realized_pnl":      p.Realized,
+			"unrealized_pnl":    unrealized(p, ltp),
+			"charges":           p.Charges,
+		})
+	}
+	return map[string]interface{}{"status": "SUCCESS", "positions": rows}, nil
+}
+
+// Holdings returns long CNC positions as holdings.
+func (b *PaperBroker) Holdings() (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var rows []interface{}
+	for _, p := range b.sortedPositions() {
+		if p.ProductType != ProductTypeCNC || p.Net <= 0 {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"exchange":      p.Exchange,
+			"tradingsymbol": p.TradingSymbol,
+			"token":         p.Token,
+			"quantity":      p.Net,
+			"avg_buy_price": p.AvgPrice,
+			"ltp":           b.markets[paperKey(p.Exchange, p.TradingSymbol)].LTP,
+		})
+	}
+	return map[string]interface{}{"status": "SUCCESS", "data": rows}, nil
+}
+
+// Limits returns the virtual cash and the margin blocked by positions and
+// open orders.
+func (b *PaperBroker) Limits() (map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return map[string]interface{}{
+		"status":     "SUCCESS",
+		"cash":       b.cash,
+		"payin":      0.0,
+		"collateral": 0.0,
+		"marginused": b.marginUsed(""),
+	}, nil
+}
+
+func (b *PaperBroker) sortedPositions() []*paperPosition {
+	keys := make([]string, 0, len(b.positions))
+	for k := range b.positions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	positions := make([]*paperPosition, len(keys))
+	for i, k := range keys {
+		positions[i] = b.positions[k]
+	}
+	return positions
+}
+
+func average(value float64, qty int) float64 {
+	if qty == 0 {
+		return 0
+	}
+	return value / float64(qty)
+}
+
+func unrealized(p *paperPosition, ltp float64) float64 {
+	if p.Net == 0 || ltp == 0 {
+		return 0
+	}
+	return (ltp - p.AvgPrice) * float64(p.Net)
+}
+
+// marginUsed returns the margin blocked by positions and by open orders
+// other than skip. Callers hold b.mu.
+func (b *PaperBroker) marginUsed(skip string) float64 {
+	used := 0.0
+	for _, p := range b.positions {
+		used += float64(abs(p.Net)) * p.AvgPrice * b.MarginRates[p.ProductType]
+	}
+	for id, o := range b.orders {
+		if id != skip && o.open() {
+			used += b.orderMargin(o)
+		}
+	}
+	return used
+}
+
+// orderMargin returns the margin an open order blocks. Only the part that
+// would increase the position of its product needs margin. Callers hold
+// b.mu.
+func (b *PaperBroker) orderMargin(o *paperOrder) float64 {
+	net := 0
+	if p, ok := b.positions[paperKey(o.Exchange, o.TradingSymbol)+"|"+o.ProductType]; ok {
+		net = p.Net
+	}
+	signed := o.pending()
+	if o.OrderType == OrderTypeSell {
+		signed = -signed
+	}
+	extra := abs(net+signed) - abs(net)
+	if extra <= 0 {
+		return 0
+	}
+
+	return float64(extra) * b.marginPrice(o) * b.MarginRates[o.ProductType]
+}
+
+// marginPrice returns the price o is margined at: its limit or trigger
+// price, else the latest price seen for the instrument, else zero.
+// Callers hold b.mu.
+func (b *PaperBroker) marginPrice(o *paperOrder) float64 {
+	if o.Price > 0 {
+		return o.Price
+	}
+	if o.TriggerPrice != nil && *o.TriggerPrice > 0 {
+		return *o.TriggerPrice
+	}
+	return b.last[paperKey(o.Exchange, o.TradingSymbol)]
+}
+
+// ApplyQuote updates the price of an instrument and fills the orders it
+// crosses.
+func (b *PaperBroker) ApplyQuote(q Quote) {
+	b.apply(q.Exchange, q.TradingSymbol, q.Token, paperMarket{
+		LTP:    q.LTP,
+		Bid:    q.Bids[0].Price,
+		BidQty: q.Bids[0].Quantity,
+		Ask:    q.Asks[0].Price,
+		AskQty: q.Asks[0].Quantity,
+	})
+}
+
+// ApplyTick updates the price of an instrument from a websocket tick and
+// fills the orders it crosses.
+func (b *PaperBroker) ApplyTick(t Tick) {
+	b.apply(t.Exchange, t.TradingSymbol, t.Token, paperMarket{
+		LTP:    t.LTP,
+		Bid:    t.BestBid.Price,
+		BidQty: t.BestBid.Quantity,
+		Ask:    t.BestAsk.Price,
+		AskQty: t.BestAsk.Quantity,
+	})
+}
+
+func (b *PaperBroker) apply(exchange, tradingSymbol, token string, m paperMarket) {
+	b.mu.Lock()
+	if tradingSymbol == "" {
+		tradingSymbol = b.symbols[paperKey(exchange, token)]
+	}
+	if tradingSymbol == "" {
+		b.mu.Unlock()
+		return
+	}
+	key := paperKey(exchange, tradingSymbol)
+	b.markets[key] = m
+	if m.LTP > 0 {
+		b.last[key] = m.LTP
+	}
+
+	var updates []OrderUpdate
+	for _, id := range b.orderIDs {
+		o := b.orders[id]
+		if o.open() && paperKey(o.Exchange, o.TradingSymbol) == key {
+			updates = append(updates, b.match(o, &m)...)
+		}
+	}
+	b.mu.Unlock()
+
+	b.notify(updates)
+}
+
+// Run applies ticks until ctx is done or ticks is closed.
+func (b *PaperBroker) Run(ctx context.Context, ticks <-chan Tick) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t, ok := <-ticks:
+			if !ok {
+				return
+			}
+			b.ApplyTick(t)
+		}
+	}
+}
+
+// Refresh fetches quotes for every instrument with an open order and
+// applies them.
+func (b *PaperBroker) Refresh(ctx context.Context) error {
+	if b.data == nil {
+		return errors.New("paper broker has no data client")
+	}
+
+	b.mu.Lock()
+	seen := make(map[string]bool)
+	var instruments []Instrument
+	for _, id := range b.orderIDs {
+		o := b.orders[id]
+		key := paperKey(o.Exchange, o.TradingSymbol)
+		if o.open() && !seen[key] {
+			seen[key] = true
+			instruments = append(instruments, Instrument{Exchange: o.Exchange, TradingSymbol: o.TradingSymbol})
+		}
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, r := range b.data.QuotesMany(ctx, instruments) {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", r.Instrument.Exchange, r.Instrument.TradingSymbol, r.Err))
+			continue
+		}
+		q := *r.Quote
+		q.Exchange = r.Instrument.Exchange
+		q.TradingSymbol = r.Instrument.TradingSymbol
+		b.ApplyQuote(q)
+	}
+	return errors.Join(errs...)
+}
+
+// Poll calls Refresh every interval until ctx is done. An interval <= 0
+// refreshes every second.
+func (b *PaperBroker) Poll(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultQuotePollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.Refresh(ctx); err != nil && b.logging {
+			logger.Printf("paper quote refresh failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// match fills as much of o as m allows and returns the resulting updates.
+// The quantity taken is removed from m, so later orders in the same update
+// cannot fill against it again. Callers hold b.mu.
+func (b *PaperBroker) match(o *paperOrder, m *paperMarket) []OrderUpdate {
+	buy := o.OrderType == OrderTypeBuy
+
+	if isStopPrice(o.PriceType) && !o.Triggered {
+		if m.LTP == 0 {
+			return nil
+		}
+		trigger := *o.TriggerPrice
+		if (buy && m.LTP < trigger) || (!buy && m.LTP > trigger) {
+			return nil
+		}
+		o.Triggered = true
+	}
+
+	touch, shown := m.Ask, &m.AskQty
+	if !buy {
+		touch, shown = m.Bid, &m.BidQty
+	}
+	depthKnown := touch > 0
+	if !depthKnown {
+		touch = m.LTP
+	}
+
+	var price float64
+	switch {
+	case touch == 0:
+	case o.PriceType == PriceTypeMarket || o.PriceType == PriceTypeSlMkt:
+		if buy {
+			price = touch * (1 + b.Slippage)
+		} else {
+			price = touch * (1 - b.Slippage)
+		}
+	case buy && touch <= o.Price, !buy && touch >= o.Price:
+		price = touch
+	}
+
+	if depthKnown && *shown <= 0 {
+		price = 0
+	}
+
+	var updates []OrderUpdate
+	if price > 0 {
+		qty := o.pending()
+		if depthKnown && *shown < qty {
+			qty = *shown
+		}
+		if depthKnown {
+			*shown -= qty
+		}
+		b.fill(o, qty, math.Round(price*100)/100)
+		updates = append(updates, parseOrderRow(o.row()))
+	}
+
+	if o.Validity == ValidityTypeIOC && o.open() && (!isStopPrice(o.PriceType) || o.Triggered) {
+		o.Status = OrderStatusCancelled
+		o.Message = "unfilled quantity cancelled (IOC)"
+		updates = append(updates, parseOrderRow(o.row()))
+	}
+	return updates
+}
+
+// fill executes qty of o at price and updates the position and cash.
+// Callers hold b.mu.
+func (b *PaperBroker) fill(o *paperOrder, qty int, price float64) {
+	o.AvgPrice = (o.AvgPrice*float64(o.Filled) + price*float64(qty)) / float64(o.Filled+qty)
+	o.Filled += qty
+	if o.pending() == 0 {
+		o.Status = OrderStatusComplete
+	}
+
+	now := b.now()
+	trade := map[string]interface{}{
+		"fill_id":       fmt.Sprintf("%s-%d", o.ID, len(b.trades)+1),
+		"order_id":      o.ID,
+		"exchange":      o.Exchange,
+		"tradingsymbol": o.TradingSymbol,
+		"order_type":    o.OrderType,
+		"product_type":  o.ProductType,
+		"filled_qty":    qty,
+		"fill_price":    price,
+		"fill_time":     now.In(IST).Format("2006-01-02 15:04:05"),
+	}
+	if o.Remarks != nil {
+		trade["remarks"] = *o.Remarks
+	}
+	var charges float64
+	if b.Charges != nil {
+		charges = b.ledger.charge(b.Charges, parseTradeRow(trade))
+		trade["charges"] = charges
+	}
+	b.trades = append(b.trades, trade)
+
+	key := paperKey(o.Exchange, o.TradingSymbol) + "|" + o.ProductType
+	p, ok := b.positions[key]
+	if !ok {
+		p = &paperPosition{Exchange: o.Exchange, TradingSymbol: o.TradingSymbol, Token: o.Token, ProductType: o.ProductType}
+		b.positions[key] = p
+	}
+	p.Charges += charges
+	b.cash -= charges
+
+	signed := qty
+	if o.OrderType == OrderTypeBuy {
+		p.BuyQty += qty
+		p.BuyValue += price * float64(qty)
+	} else {
+		signed = -qty
+		p.SellQty += qty
+		p.SellValue += price * float64(qty)
+	}
+
+	switch {
+	case p.Net == 0 || (p.Net > 0) == (signed > 0):
+		p.AvgPrice = (p.AvgPrice*float64(abs(p.Net)) + price*float64(qty)) / float64(abs(p.Net)+qty)
+		p.Net += signed
+	default:
+		closed := qty
+		if closed > abs(p.Net) {
+			closed = abs(p.Net)
+		}
+		pnl := (price - p.AvgPrice) * float64(closed)
+		if p.Net < 0 {
+			pnl = -pnl
+		}
+		p.Realized += pnl
+		b.cash += pnl
+		p.Net += signed
+		if p.Net == 0 {
+			p.AvgPrice = 0
+		} else if (p.Net > 0) == (signed > 0) {
+			p.AvgPrice = price
+		}
+	}
+
+	if b.logging {
+		logger.Printf("paper fill %s: %s %d %s @ %.2f", o.ID, o.OrderType, qty, o.TradingSymbol, price)
+	}
+}
+
+func (b *PaperBroker) notify(updates []OrderUpdate) {
+	if b.OnOrderUpdate == nil {
+		return
+	}
+	for _, u := range updates {
+		b.OnOrderUpdate(u)
+	}
+}
+
+// clearMarket forgets the price of an instrument, so orders placed next
+// wait for the following update. Backtests use it to stop orders placed on
+// a closed bar from filling at a price already in the past.
+func (b *PaperBroker) clearMarket(exchange, tradingSymbol string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.markets, paperKey(exchange, tradingSymbol))
+}
+
+// fillsSince returns the fills after the first n.
+func (b *PaperBroker) fillsSince(n int) []Fill {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n >= len(b.trades) {
+		return nil
+	}
+	fills := make([]Fill, 0, len(b.trades)-n)
+	for _, t := range b.trades[n:] {
+		fills = append(fills, parseTradeRow(t))
+	}
+	return fills
+}
@@ -0,0 +1,506 @@
+package integrate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Constants for P&L groupings
+const (
+	PnLBySymbol  = "SYMBOL"
+	PnLByTag     = "TAG"
+	PnLByProduct = "PRODUCT"
+	PnLByAccount = "ACCOUNT"
+)
+
+// defaultPnLTolerance is the difference in rupees below which engine and
+// broker figures are taken to agree.
+const defaultPnLTolerance = 1.0
+
+// PnLPosition is a position rebuilt from fills. AvgPrice is the average
+// cost of the open quantity, and Realized is booked against it as the
+// position is reduced.
+type PnLPosition struct {
+	Account       string
+	Tag           string
+	Exchange      string
+	TradingSymbol string
+	ProductType   string
+	NetQuantity   int
+	AvgPrice      float64
+	BuyQuantity   int
+	BuyValue      float64
+	SellQuantity  int
+	SellValue     float64
+	Realized      float64
+	LastPrice     float64
+	Unrealized    float64
+	Charges       float64
+}
+
+// Gross returns realized plus unrealized P&L.
+func (p PnLPosition) Gross() float64 {
+	return p.Realized + p.Unrealized
+}
+
+// Net returns the P&L after charges.
+func (p PnLPosition) Net() float64 {
+	return p.Gross() - p.Charges
+}
+
+// PnLSummary is the P&L of a group of positions.
+type PnLSummary struct {
+	Key        string
+	Positions  int
+	Open       int
+	Realized   float64
+	Unrealized float64
+	Charges    float64
+}
+
+// Net returns the P&L of the group after charges.
+func (s PnLSummary) Net() float64 {
+	return s.Realized + s.Unrealized - s.Charges
+}
+
+// PnLMismatch is a difference between a rebuilt position and the broker's.
+type PnLMismatch struct {
+	Exchange      string
+	TradingSymbol string
+	ProductType   string
+	Field         string
+	Engine        float64
+	Broker        float64
+}
+
+func (m PnLMismatch) String() string {
+	return fmt.Sprintf("%s %s %s: %s is %.2f, broker has %.2f", m.Exchange, m.TradingSymbol, m.ProductType, m.Field, m.Engine, m.Broker)
+}
+
+// PnL rebuilds positions from fills and marks them to market. Fills are
+// grouped by Tag, which defaults to the order remarks without the client
+// tag, so strategies that tag their orders get their own positions. Fills
+// are counted once, by FillID or by order, instrument, side, quantity,
+// price and time when the broker sends no FillID, so the trade book can be
+// loaded again as it grows. Positions carried from earlier sessions are
+// seeded with AddOpening or LoadOpening before the day's fills. With Charges
+// set, the charges on every fill are taken from its position's P&L; the
+// fills of one order are charged together, so per-order brokerage and its
+// cap apply once per order.
+type PnL struct {
+	Account   string
+	Tag       func(Fill) string
+	Charges   ChargeModel
+	Tolerance float64
+	logging   bool
+
+	mu        sync.Mutex
+	positions map[string]*PnLPosition
+	seen      map[string]bool
+	opened    map[string]bool
+	marks     map[string]float64
+	ledger    chargeLedger
+}
+
+// NewPnL initializes an engine for account.
+func NewPnL(account string, logging bool) *PnL {
+	return &PnL{
+		Account:   account,
+		Tag:       func(f Fill) string { return userRemarks(f.Remarks) },
+		Tolerance: defaultPnLTolerance,
+		logging:   logging,
+		positions: make(map[string]*PnLPosition),
+		seen:      make(map[string]bool),
+		opened:    make(map[string]bool),
+		marks:     make(map[string]float64),
+	}
+}
+
+// AddFill applies a fill to its position. A fill already applied is
+// ignored.
+func (e *PnL) AddFill(f Fill) {
+	if f.Quantity <= 0 {
+		return
+	}
+	tag := ""
+	if e.Tag != nil {
+		tag = e.Tag(f)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := fillKey(f)
+	if e.seen[id] {
+		return
+	}
+	e.seen[id] = true
+
+	p := e.positionLocked(tag, f.Exchange, f.TradingSymbol, f.ProductType)
+	if e.Charges != nil {
+		p.Charges += e.ledger.charge(e.Charges, f)
+	}
+
+	signed := f.Quantity
+	if f.OrderType == OrderTypeBuy {
+		p.BuyQuantity += f.Quantity
+		p.BuyValue += f.Price * float64(f.Quantity)
+	} else {
+		signed = -f.Quantity
+		p.SellQuantity += f.Quantity
+		p.SellValue += f.Price * float64(f.Quantity)
+	}
+	applyQuantity(p, signed, f.Price)
+	e.markLocked(p)
+}
+
+// fillKey identifies a fill for deduplication. Without a FillID two fills
+// of one order with the same quantity, price and time are counted once.
+func fillKey(f Fill) string {
+	if f.FillID != "" {
+		return f.FillID
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%g|%d", f.OrderID, paperKey(f.Exchange, f.TradingSymbol), f.OrderType, f.Quantity, f.Price, f.Time.UnixNano())
+}
+
+// positionLocked returns the position for a tag and instrument, creating it
+// if needed. e.mu must be held.
+func (e *PnL) positionLocked(tag, exchange, tradingSymbol, productType string) *PnLPosition {
+	key := tag + "|" + paperKey(exchange, tradingSymbol) + "|" + productType
+	p, ok := e.positions[key]
+	if !ok {
+		p = &PnLPosition{
+			Account:       e.Account,
+			Tag:           tag,
+			Exchange:      exchange,
+			TradingSymbol: tradingSymbol,
+			ProductType:   productType,
+		}
+		e.positions[key] = p
+	}
+	return p
+}
+
+// applyQuantity adds a signed quantity at price to p, booking realized P&L
+// on the part that reduces the position.
+func applyQuantity(p *PnLPosition, signed int, price float64) {
+	qty := abs(signed)
+	switch {
+	case p.NetQuantity == 0 || (p.NetQuantity > 0) == (signed > 0):
+		p.AvgPrice = (p.AvgPrice*float64(abs(p.NetQuantity)) + price*float64(qty)) / float64(abs(p.NetQuantity)+qty)
+		p.NetQuantity += signed
+	default:
+		closed := qty
+		if closed > abs(p.NetQuantity) {
+			closed = abs(p.NetQuantity)
+		}
+		pnl := (price - p.AvgPrice) * float64(closed)
+		if p.NetQuantity < 0 {
+			pnl = -pnl
+		}
+		p.Realized += pnl
+		p.NetQuantity += signed
+		if p.NetQuantity == 0 {
+			p.AvgPrice = 0
+		} else if (p.NetQuantity > 0) == (signed > 0) {
+			p.AvgPrice = price
+		}
+	}
+}
+
+// AddOpening seeds a position carried from an earlier session, with a
+// signed quantity at its cost price, under the empty tag. Call it before
+// the day's fills are applied. An instrument already seeded is ignored.
+func (e *PnL) AddOpening(exchange, tradingSymbol, productType string, quantity int, price float64) {
+	if quantity == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := paperKey(exchange, tradingSymbol) + "|" + productType
+	if e.opened[key] {
+		return
+	}
+	e.opened[key] = true
+
+	p := e.positionLocked("", exchange, tradingSymbol, productType)
+	applyQuantity(p, quantity, price)
+	e.markLocked(p)
+}
+
+// LoadOpening seeds the carried quantity of every broker position. The cost
+// of the carried part is worked out from the net and day averages. When the
+// position has been closed today that is not possible, and the carried part
+// is taken at the average of the day's closing trades.
+func (e *PnL) LoadOpening(positions []Position) {
+	for _, bp := range positions {
+		carried := bp.CarriedQuantity()
+		if carried == 0 {
+			continue
+		}
+		price := bp.SellAverage
+		if carried < 0 {
+			price = bp.BuyAverage
+		}
+		if bp.NetQuantity != 0 {
+			day := bp.BuyAverage*float64(bp.BuyQuantity) - bp.SellAverage*float64(bp.SellQuantity)
+			price = bp.NetAveragePrice
+			if c := (bp.NetAveragePrice*float64(bp.NetQuantity) - day) / float64(carried); c > 0 {
+				price = c
+			}
+		}
+		e.AddOpening(bp.Exchange, bp.TradingSymbol, bp.ProductType, carried, price)
+	}
+}
+
+// AddFills applies fills in order.
+func (e *PnL) AddFills(fills []Fill) {
+	for _, f := range fills {
+		e.AddFill(f)
+	}
+}
+
+// LoadTrades applies the fills in the broker's Trades() not yet seen.
+func (e *PnL) LoadTrades(b Broker) error {
+	r, err := b.Trades()
+	if err != nil {
+		return err
+	}
+	for _, row := range responseRows(r, "trades") {
+		e.AddFill(parseTradeRow(row))
+	}
+	return nil
+}
+
+// Mark sets the last price of an instrument and revalues its positions.
+func (e *PnL) Mark(exchange, tradingSymbol string, ltp float64) {
+	if ltp <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.marks[paperKey(exchange, tradingSymbol)] = ltp
+	for _, p := range e.positions {
+		if p.Exchange == exchange && p.TradingSymbol == tradingSymbol {
+			e.markLocked(p)
+		}
+	}
+}
+
+// OnTick marks the tick's instrument to its last price.
+func (e *PnL) OnTick(t Tick) {
+	e.Mark(t.Exchange, t.TradingSymbol, t.LTP)
+}
+
+// MarkQuotes marks every instrument with a position to its quoted price.
+func (e *PnL) MarkQuotes(ctx context.Context, data *IntegrateData) error {
+	seen := make(map[Instrument]bool)
+	var instruments []Instrument
+	e.mu.Lock()
+	for _, p := range e.positions {
+		in := Instrument{Exchange: p.Exchange, TradingSymbol: p.TradingSymbol}
+		if !seen[in] {
+			seen[in] = true
+			instruments = append(instruments, in)
+		}
+	}
+	e.mu.Unlock()
+
+	var firstErr error
+	for _, r := range data.QuotesMany(ctx, instruments) {
+		if r.Err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s: %w", r.Instrument.Exchange, r.Instrument.TradingSymbol, r.Err)
+			}
+			continue
+		}
+		e.Mark(r.Instrument.Exchange, r.Instrument.TradingSymbol, r.Quote.LTP)
+	}
+	return firstErr
+}
+
+// markLocked revalues p at the latest mark. e.mu must be held.
+func (e *PnL) markLocked(p *PnLPosition) {
+	ltp, ok := e.marks[paperKey(p.Exchange, p.TradingSymbol)]
+	if !ok {
+		return
+	}
+	p.LastPrice = ltp
+	p.Unrealized = (ltp - p.AvgPrice) * float64(p.NetQuantity)
+}
+
+// Positions returns the rebuilt positions ordered by tag, symbol and
+// product.
+func (e *PnL) Positions() []PnLPosition {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := make([]PnLPosition, 0, len(e.positions))
+	for _, p := range e.positions {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Tag != b.Tag {
+			return a.Tag < b.Tag
+		}
+		if a.TradingSymbol != b.TradingSymbol {
+			return a.TradingSymbol < b.TradingSymbol
+		}
+		if a.Exchange != b.Exchange {
+			return a.Exchange < b.Exchange
+		}
+		return a.ProductType < b.ProductType
+	})
+	return list
+}
+
+// Total returns the P&L of every position.
+func (e *PnL) Total() PnLSummary {
+	s := AggregatePnL(PnLByAccount, e)[e.Account]
+	s.Key = e.Account
+	return s
+}
+
+// By returns the P&L grouped by one of the PnLBy constants.
+func (e *PnL) By(group string) map[string]PnLSummary {
+	return AggregatePnL(group, e)
+}
+
+// AggregatePnL groups the positions of several engines, one per account,
+// by one of the PnLBy constants.
+func AggregatePnL(group string, engines ...*PnL) map[string]PnLSummary {
+	out := make(map[string]PnLSummary)
+	for _, e := range engines {
+		for _, p := range e.Positions() {
+			var key string
+			switch group {
+			case PnLByTag:
+				key = p.Tag
+			case PnLByProduct:
+				key = p.ProductType
+			case PnLByAccount:
+				key = p.Account
+			default:
+				key = paperKey(p.Exchange, p.TradingSymbol)
+			}
+
+			s := out[key]
+			s.Key = key
+			s.Positions++
+			if p.NetQuantity != 0 {
+				s.Open++
+			}
+			s.Realized += p.Realized
+			s.Unrealized += p.Unrealized
+			s.Charges += p.Charges
+			out[key] = s
+		}
+	}
+	return out
+}
+
+// Reconcile compares the rebuilt positions, summed over tags, with the
+// broker's positions and returns the differences: net quantity, average
+// price of an open position and realized P&L beyond Tolerance, and
+// positions only one side has. When several tags trade the same symbol
+// against each other, realized P&L split by tag can legitimately differ
+// from the broker's single average cost. Carried positions must be seeded
+// with LoadOpening first or they show up as net quantity differences.
+func (e *PnL) Reconcile(positions []Position) []PnLMismatch {
+	type totals struct {
+		position PnLPosition
+		net      int
+		cost     float64
+		realized float64
+	}
+	ours := make(map[string]*totals)
+	for _, p := range e.Positions() {
+		key := paperKey(p.Exchange, p.TradingSymbol) + "|" + p.ProductType
+		t, ok := ours[key]
+		if !ok {
+			t = &totals{position: p}
+			ours[key] = t
+		}
+		t.net += p.NetQuantity
+		t.cost += p.AvgPrice * float64(p.NetQuantity)
+		t.realized += p.Realized
+	}
+
+	var mismatches []PnLMismatch
+	theirs := make(map[string]bool)
+	for _, bp := range positions {
+		key := paperKey(bp.Exchange, bp.TradingSymbol) + "|" + bp.ProductType
+		theirs[key] = true
+		t := ours[key]
+		if t == nil {
+			t = &totals{}
+		}
+		mismatch := func(field string, engine, broker float64) {
+			mismatches = append(mismatches, PnLMismatch{
+				Exchange:      bp.Exchange,
+				TradingSymbol: bp.TradingSymbol,
+				ProductType:   bp.ProductType,
+				Field:         field,
+				Engine:        engine,
+				Broker:        broker,
+			})
+		}
+
+		if t.net != bp.NetQuantity {
+			mismatch("net quantity", float64(t.net), float64(bp.NetQuantity))
+		} else if t.net != 0 && bp.NetAveragePrice > 0 {
+			avg := t.cost / float64(t.net)
+			if math.Abs(avg-bp.NetAveragePrice)*float64(abs(t.net)) > e.Tolerance {
+				mismatch("average price", avg, bp.NetAveragePrice)
+			}
+		}
+		if math.Abs(t.realized-bp.RealizedPnL) > e.Tolerance {
+			mismatch("realized", t.realized, bp.RealizedPnL)
+		}
+	}
+
+	for key, t := range ours {
+		if theirs[key] || (t.net == 0 && math.Abs(t.realized) <= e.Tolerance) {
+			continue
+		}
+		mismatches = append(mismatches, PnLMismatch{
+			Exchange:      t.position.Exchange,
+			TradingSymbol: t.position.TradingSymbol,
+			ProductType:   t.position.ProductType,
+			Field:         "net quantity",
+			Engine:        float64(t.net),
+		})
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].TradingSymbol != mismatches[j].TradingSymbol {
+			return mismatches[i].TradingSymbol < mismatches[j].TradingSymbol
+		}
+		return mismatches[i].Field < mismatches[j].Field
+	})
+	if e.logging {
+		for _, m := range mismatches {
+			logger.Printf("pnl %s: mismatch %s", e.Account, m)
+		}
+	}
+	return mismatches
+}
+
+// ReconcileBroker fetches the broker's positions and reconciles with them.
+func (e *PnL) ReconcileBroker(b Broker) ([]PnLMismatch, error) {
+	r, err := b.Positions()
+	if err != nil {
+		return nil, err
+	}
+	rows := responseRows(r, "positions")
+	positions := make([]Position, len(rows))
+	for i, row := range rows {
+		positions[i] = parsePositionRow(row)
+	}
+	return e.Reconcile(positions), nil
+}
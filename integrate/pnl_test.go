@@ -0,0 +1,137 @@
+package integrate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyQuantity(t *testing.T) {
+	tests := []struct {
+		name   string
+		start  PnLPosition
+		signed int
+		price  float64
+		want   PnLPosition
+	}{
+		{
+			name:   "open long",
+			signed: 10, price: 100,
+			want: PnLPosition{NetQuantity: 10, AvgPrice: 100},
+		},
+		{
+			name:   "add to long averages the price",
+			start:  PnLPosition{NetQuantity: 10, AvgPrice: 100},
+			signed: 10, price: 110,
+			want: PnLPosition{NetQuantity: 20, AvgPrice: 105},
+		},
+		{
+			name:   "partial close keeps the average",
+			start:  PnLPosition{NetQuantity: 20, AvgPrice: 105},
+			signed: -5, price: 115,
+			want: PnLPosition{NetQuantity: 15, AvgPrice: 105, Realized: 50},
+		},
+		{
+			name:   "full close at a loss",
+			start:  PnLPosition{NetQuantity: 10, AvgPrice: 100},
+			signed: -10, price: 90,
+			want: PnLPosition{Realized: -100},
+		},
+		{
+			name:   "long flips short at the fill price",
+			start:  PnLPosition{NetQuantity: 10, AvgPrice: 100},
+			signed: -15, price: 110,
+			want: PnLPosition{NetQuantity: -5, AvgPrice: 110, Realized: 100},
+		},
+		{
+			name:   "short cover below the average",
+			start:  PnLPosition{NetQuantity: -10, AvgPrice: 100},
+			signed: 4, price: 90,
+			want: PnLPosition{NetQuantity: -6, AvgPrice: 100, Realized: 40},
+		},
+		{
+			name:   "short flips long",
+			start:  PnLPosition{NetQuantity: -10, AvgPrice: 100},
+			signed: 12, price: 95,
+			want: PnLPosition{NetQuantity: 2, AvgPrice: 95, Realized: 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.start
+			applyQuantity(&p, tt.signed, tt.price)
+			if p != tt.want {
+				t.Fatalf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestPnLReconcile(t *testing.T) {
+	at := time.Date(2025, 1, 10, 10, 0, 0, 0, IST)
+	fills := []Fill{
+		{FillID: "1", OrderID: "A", Exchange: ExchangeTypeNSE, TradingSymbol: "INFY-EQ", OrderType: OrderTypeBuy,
+			ProductType: ProductTypeIntraday, Quantity: 10, Price: 100, Time: at},
+		{FillID: "2", OrderID: "B", Exchange: ExchangeTypeNSE, TradingSymbol: "INFY-EQ", OrderType: OrderTypeSell,
+			ProductType: ProductTypeIntraday, Quantity: 5, Price: 110, Time: at.Add(time.Minute)},
+	}
+	broker := func(net int, avg, realized float64) Position {
+		return Position{Exchange: ExchangeTypeNSE, TradingSymbol: "INFY-EQ", ProductType: ProductTypeIntraday,
+			NetQuantity: net, NetAveragePrice: avg, RealizedPnL: realized}
+	}
+
+	tests := []struct {
+		name      string
+		positions []Position
+		want      []string
+	}{
+		{
+			name:      "matching position",
+			positions: []Position{broker(5, 100, 50)},
+		},
+		{
+			name:      "differences within tolerance",
+			positions: []Position{broker(5, 100.1, 50.5)},
+		},
+		{
+			name:      "net quantity differs",
+			positions: []Position{broker(4, 100, 50)},
+			want:      []string{"net quantity"},
+		},
+		{
+			name:      "average price differs",
+			positions: []Position{broker(5, 101, 50)},
+			want:      []string{"average price"},
+		},
+		{
+			name:      "realized differs",
+			positions: []Position{broker(5, 100, 40)},
+			want:      []string{"realized"},
+		},
+		{
+			name: "missing at the broker",
+			want: []string{"net quantity"},
+		},
+		{
+			name: "only at the broker",
+			positions: []Position{broker(5, 100, 50),
+				{Exchange: ExchangeTypeNSE, TradingSymbol: "TCS-EQ", ProductType: ProductTypeCNC, NetQuantity: 3}},
+			want: []string{"net quantity"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewPnL("test", false)
+			e.AddFills(fills)
+			var got []string
+			for _, m := range e.Reconcile(tt.positions) {
+				got = append(got, m.Field)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("mismatches %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package integrate
+
+// Position is one entry of the Positions() book. NetQuantity is positive
+// for a long position and negative for a short one.
+type Position struct {
+	Exchange        string
+	TradingSymbol   string
+	Token           string
+	ProductType     string
+	NetQuantity     int
+	NetAveragePrice float64
+	BuyQuantity     int
+	BuyAverage      float64
+	SellQuantity    int
+	SellAverage     float64
+	LastPrice       float64
+	RealizedPnL     float64
+	UnrealizedPnL   float64
+}
+
+// Open reports whether the position has a non-zero net quantity.
+func (p Position) Open() bool {
+	return p.NetQuantity != 0
+}
+
+// DayQuantity returns the net quantity traded today.
+func (p Position) DayQuantity() int {
+	return p.BuyQuantity - p.SellQuantity
+}
+
+// CarriedQuantity returns the net quantity brought forward from earlier
+// sessions.
+func (p Position) CarriedQuantity() int {
+	return p.NetQuantity - p.DayQuantity()
+}
+
+// PnL returns realized plus unrealized profit as reported by the broker.
+func (p Position) PnL() float64 {
+	return p.RealizedPnL + p.UnrealizedPnL
+}
+
+// parsePositionRow decodes one entry of the Positions() book.
+func parsePositionRow(m map[string]interface{}) Position {
+	return Position{
+		Exchange:        fieldString(m, "exchange"),
+		TradingSymbol:   fieldString(m, "tradingsymbol"),
+		Token:           fieldString(m, "token"),
+		ProductType:     fieldString(m, "product_type"),
+		NetQuantity:     fieldInt(m, "net_quantity"),
+		NetAveragePrice: fieldFloat(m, "net_averageprice"),
+		BuyQuantity:     fieldInt(m, "day_buy_quantity"),
+		BuyAverage:      fieldFloat(m, "day_buy_average"),
+		SellQuantity:    fieldInt(m, "day_sell_quantity"),
+		SellAverage:     fieldFloat(m, "day_sell_average"),
+		LastPrice:       fieldFloat(m, "lastPrice"),
+		RealizedPnL:     fieldFloat(m, "realized_pnl"),
+		UnrealizedPnL:   fieldFloat(m, "unrealized_pnl"),
+	}
+}
+
+// ListPositions fetches Positions() and decodes every entry.
+func (io *IntegrateOrders) ListPositions() ([]Position, error) {
+	r, err := io.Positions()
+	if err != nil {
+		return nil, err
+	}
+	rows := responseRows(r, "positions")
+	positions := make([]Position, len(rows))
+	for i, row := range rows {
+		positions[i] = parsePositionRow(row)
+	}
+	return positions, nil
+}
@@ -0,0 +1,215 @@
+package integrate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxQuoteWorkers bounds the number of quote requests in flight at once.
+const maxQuoteWorkers = 8
+
+// defaultQuotePollInterval is used by PollQuotes when no positive interval
+// is given.
+const defaultQuotePollInterval = time.Second
+
+// Instrument identifies a security by exchange and trading symbol.
+type Instrument struct {
+	Exchange      string
+	TradingSymbol string
+}
+
+func (in Instrument) String() string {
+	return in.Exchange + ":" + in.TradingSymbol
+}
+
+// DepthLevel is one price level of market depth.
+type DepthLevel struct {
+	Price    float64
+	Quantity int
+	Orders   int
+}
+
+// Quote is the typed form of a quotes response.
+type Quote struct {
+	Exchange          string
+	Token             string
+	TradingSymbol     string
+	LTP               float64
+	Open              float64
+	High              float64
+	Low               float64
+	Close             float64
+	Volume            int
+	AverageTradePrice float64
+	OpenInterest      int
+	UpperCircuit      float64
+	LowerCircuit      float64
+	TotalBuyQuantity  int
+	TotalSellQuantity int
+	Bids              [5]DepthLevel
+	Asks              [5]DepthLevel
+	Raw               map[string]interface{}
+}
+
+// QuoteResult is the outcome of fetching the quote for one instrument.
+type QuoteResult struct {
+	Instrument Instrument
+	Quote      *Quote
+	Err        error
+}
+
+// parseQuote converts a quotes response into a Quote.
+func parseQuote(exchange, token string, r map[string]interface{}) *Quote {
+	q := &Quote{
+		Exchange:          exchange,
+		Token:             token,
+		TradingSymbol:     fieldString(r, "tradingsymbol"),
+		LTP:               fieldFloat(r, "ltp"),
+		Open:              fieldFloat(r, "open"),
+		High:              fieldFloat(r, "high"),
+		Low:               fieldFloat(r, "low"),
+		Close:             fieldFloat(r, "close"),
+		Volume:            fieldInt(r, "volume"),
+		AverageTradePrice: fieldFloat(r, "average_trade_price"),
+		OpenInterest:      fieldInt(r, "open_interest"),
+		UpperCircuit:      fieldFloat(r, "upper_circuit"),
+		LowerCircuit:      fieldFloat(r, "lower_circuit"),
+		TotalBuyQuantity:  fieldInt(r, "total_buy_quantity"),
+		TotalSellQuantity: fieldInt(r, "total_sell_quantity"),
+		Raw:               r,
+	}
+	for i := range q.Bids {
+		n := i + 1
+		q.Bids[i] = DepthLevel{
+			Price:    fieldFloat(r, fmt.Sprintf("best_bid_price%d", n)),
+			Quantity: fieldInt(r, fmt.Sprintf("best_bid_qty%d", n)),
+			Orders:   fieldInt(r, fmt.Sprintf("best_bid_orders%d", n)),
+		}
+		q.Asks[i] = DepthLevel{
+			Price:    fieldFloat(r, fmt.Sprintf("best_ask_price%d", n)),
+			Quantity: fieldInt(r, fmt.Sprintf("best_ask_qty%d", n)),
+			Orders:   fieldInt(r, fmt.Sprintf("best_ask_orders%d", n)),
+		}
+	}
+	return q
+}
+
+// changedFrom reports whether any market field differs from prev.
+func (q *Quote) changedFrom(prev *Quote) bool {
+	if prev == nil {
+		return true
+	}
+	return q.LTP != prev.LTP ||
+		q.Volume != prev.Volume ||
+		q.Open != prev.Open ||
+		q.High != prev.High ||
+		q.Low != prev.Low ||
+		q.Close != prev.Close ||
+		q.OpenInterest != prev.OpenInterest ||
+		q.Bids != prev.Bids ||
+		q.Asks != prev.Asks
+}
+
+// QuotesMany retrieves quotes for several instruments concurrently.
+// Tokens are resolved through the symbol master and every request waits
+// for the session rate limiter under ctx. The results are in the same
+// order as instruments, and each one carries its own error.
+func (ic *IntegrateData) QuotesMany(ctx context.Context, instruments []Instrument) []QuoteResult {
+	results := make([]QuoteResult, len(instruments))
+	jobs := make(chan int)
+
+	workers := maxQuoteWorkers
+	if len(instruments) < workers {
+		workers = len(instruments)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = ic.quoteOne(ctx, instruments[i])
+			}
+		}()
+	}
+
+	for i := range instruments {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (ic *IntegrateData) quoteOne(ctx context.Context, in Instrument) QuoteResult {
+	res := QuoteResult{Instrument: in}
+
+	if !ic.isValidExchange(in.Exchange) {
+		res.Err = fmt.Errorf("%s: invalid exchange type", in)
+		return res
+	}
+	token, err := ic.getToken(in.Exchange, in.TradingSymbol)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	r, err := ic.WithContext(ctx).quotesByToken(in.Exchange, token)
+	if err != nil {
+		res.Err = fmt.Errorf("%s: %w", in, err)
+		return res
+	}
+	res.Quote = parseQuote(in.Exchange, token, r)
+	if res.Quote.TradingSymbol == "" {
+		res.Quote.TradingSymbol = in.TradingSymbol
+	}
+	return res
+}
+
+// PollQuotes polls quotes for instruments every interval and emits only
+// those that changed since the previous poll, plus any per-item errors.
+// It is a fallback for when the websocket feed is unavailable. The returned
+// channel is closed when ctx is done. An interval <= 0 polls every second.
+func (ic *IntegrateData) PollQuotes(ctx context.Context, instruments []Instrument, interval time.Duration) <-chan QuoteResult {
+	if interval <= 0 {
+		interval = defaultQuotePollInterval
+	}
+	out := make(chan QuoteResult)
+
+	go func() {
+		defer close(out)
+
+		last := make(map[Instrument]*Quote, len(instruments))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, res := range ic.QuotesMany(ctx, instruments) {
+				if res.Err == nil {
+					if !res.Quote.changedFrom(last[res.Instrument]) {
+						continue
+					}
+					last[res.Instrument] = res.Quote
+				} else if ctx.Err() != nil {
+					return
+				}
+				select {
+				case out <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return out
+}
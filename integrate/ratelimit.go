@@ -0,0 +1,93 @@
+package integrate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Default request budget for a ConnectToIntegrate session.
+const (
+	defaultRequestsPerSecond = 10
+	defaultRequestBurst      = 10
+)
+
+// RateLimiter is a token bucket shared by everything that talks to the
+// Integrate REST API through one session. sendRequest waits on it before
+// every request, under the context of the WithContext view it was made
+// through.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter that allows perSecond requests on average
+// with bursts of up to burst requests.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request may be sent or ctx is done. It fails at once
+// if ctx is already done, so a cancelled caller never sends.
+// A nil limiter never blocks.
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rl == nil || rl.rate <= 0 {
+		return nil
+	}
+	for {
+		delay := rl.reserve()
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token if one is available, otherwise it reports how long
+// to wait before the next one is.
+func (rl *RateLimiter) reserve() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return 0
+	}
+	return time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
+
+// Allow takes a token if one is available and reports whether it did,
+// without waiting. A nil limiter always allows.
+func (rl *RateLimiter) Allow() bool {
+	if rl == nil || rl.rate <= 0 {
+		return true
+	}
+	return rl.reserve() == 0
+}
@@ -0,0 +1,311 @@
+package integrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for risk rules
+const (
+	RiskRuleOrderValue    = "MAX_ORDER_VALUE"
+	RiskRuleQuantity      = "MAX_QUANTITY"
+	RiskRuleOrderQuantity = "MAX_ORDER_QUANTITY"
+	RiskRuleOpenPositions = "MAX_OPEN_POSITIONS"
+	RiskRuleDailyLoss     = "DAILY_LOSS_LIMIT"
+	RiskRuleRestricted    = "RESTRICTED_SYMBOL"
+	RiskRulePriceBand     = "PRICE_BAND"
+)
+
+// defaultRiskCheckTimeout bounds the lookups of a check run by the order
+// routes when they are not called through a WithContext view.
+const defaultRiskCheckTimeout = 10 * time.Second
+
+// RiskConfig holds the pre-trade limits. A zero limit disables its rule.
+// MaxQuantity and MaxQuantityPerSymbol limit the net position an order
+// may build in a symbol; MaxOrderQuantity limits the quantity of each
+// order.
+type RiskConfig struct {
+	MaxOrderValue        float64        `json:"max_order_value"`
+	MaxOrderQuantity     int            `json:"max_order_quantity"`
+	MaxQuantity          int            `json:"max_quantity"`
+	MaxQuantityPerSymbol map[string]int `json:"max_quantity_per_symbol"`
+	MaxOpenPositions     int            `json:"max_open_positions"`
+	MaxDailyLoss         float64        `json:"max_daily_loss"`
+	RestrictedSymbols    []string       `json:"restricted_symbols"`
+	PriceBandPercent     float64        `json:"price_band_percent"`
+}
+
+// LoadRiskConfig reads a RiskConfig from a JSON file.
+func LoadRiskConfig(path string) (RiskConfig, error) {
+	var cfg RiskConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid risk config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// maxQuantity returns the quantity limit for a symbol.
+func (c RiskConfig) maxQuantity(tradingSymbol string) int {
+	if n, ok := c.MaxQuantityPerSymbol[tradingSymbol]; ok {
+		return n
+	}
+	return c.MaxQuantity
+}
+
+func (c RiskConfig) restricted(tradingSymbol string) bool {
+	for _, s := range c.RestrictedSymbols {
+		if strings.EqualFold(s, tradingSymbol) {
+			return true
+		}
+	}
+	return false
+}
+
+// RiskRejection is returned when an order breaks a risk rule.
+type RiskRejection struct {
+	Rule    string
+	Order   OrderRequest
+	Message string
+}
+
+func (r *RiskRejection) Error() string {
+	return fmt.Sprintf("risk rejected %s %d %s: %s: %s", r.Order.OrderType, r.Order.Quantity, r.Order.TradingSymbol, r.Rule, r.Message)
+}
+
+// RiskEngine checks orders against RiskConfig before they are sent to
+// placeorder, modify or sliceorder. Once created it gates PlaceOrder,
+// PlaceOrderRequest, ModifyOrder and SliceOrder on its IntegrateOrders;
+// square-off orders sent by the kill switch and AutoSquareOff are not
+// checked.
+type RiskEngine struct {
+	orders    *IntegrateOrders
+	data      *IntegrateData
+	logging   bool
+	quote     func(ctx context.Context, exchange, tradingSymbol string) (map[string]interface{}, error)
+	positions func(ctx context.Context) ([]Position, error)
+
+	mu     sync.RWMutex
+	config RiskConfig
+}
+
+// NewRiskEngine initializes a risk engine with cfg and installs it as the
+// check run by the order routes of orders, replacing any earlier engine.
+func NewRiskEngine(orders *IntegrateOrders, data *IntegrateData, cfg RiskConfig, logging bool) *RiskEngine {
+	r := &RiskEngine{orders: orders, data: data, config: cfg, logging: logging}
+	r.quote = func(ctx context.Context, exchange, tradingSymbol string) (map[string]interface{}, error) {
+		return r.data.WithContext(ctx).Quotes(exchange, tradingSymbol)
+	}
+	r.positions = func(ctx context.Context) ([]Position, error) {
+		return r.orders.WithContext(ctx).ListPositions()
+	}
+	orders.risk.Store(r)
+	return r
+}
+
+// Config returns the limits in force.
+func (r *RiskEngine) Config() RiskConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+// SetConfig replaces the limits.
+func (r *RiskEngine) SetConfig(cfg RiskConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = cfg
+}
+
+// Reload replaces the limits with those in a JSON file.
+func (r *RiskEngine) Reload(path string) error {
+	cfg, err := LoadRiskConfig(path)
+	if err != nil {
+		return err
+	}
+	r.SetConfig(cfg)
+	return nil
+}
+
+// Check runs every rule against req. It returns a *RiskRejection for a
+// rule violation, or another error if the data needed for a rule could not
+// be fetched.
+func (r *RiskEngine) Check(ctx context.Context, req OrderRequest) error {
+	cfg := r.Config()
+	reject := func(rule, format string, args ...interface{}) error {
+		rej := &RiskRejection{Rule: rule, Order: req, Message: fmt.Sprintf(format, args...)}
+		if r.logging {
+			logger.Println(rej)
+		}
+		return rej
+	}
+
+	if cfg.restricted(req.TradingSymbol) {
+		return reject(RiskRuleRestricted, "symbol is restricted")
+	}
+
+	needLTP := cfg.PriceBandPercent > 0 || (cfg.MaxOrderValue > 0 && req.Price == 0)
+	ltp := 0.0
+	if needLTP {
+		q, err := r.quote(ctx, req.Exchange, req.TradingSymbol)
+		if err != nil {
+			return fmt.Errorf("risk check quote failed: %w", err)
+		}
+		ltp = fieldFloat(q, "ltp")
+	}
+
+	if cfg.PriceBandPercent > 0 && ltp > 0 {
+		check := func(name string, p float64) error {
+			if p == 0 {
+				return nil
+			}
+			if dev := math.Abs(p-ltp) / ltp * 100; dev > cfg.PriceBandPercent {
+				return reject(RiskRulePriceBand, "%s %.2f is %.2f%% from LTP %.2f, band is %.2f%%", name, p, dev, ltp, cfg.PriceBandPercent)
+			}
+			return nil
+		}
+		if err := check("price", req.Price); err != nil {
+			return err
+		}
+		if req.TriggerPrice != nil {
+			if err := check("trigger price", *req.TriggerPrice); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.MaxOrderValue > 0 {
+		price := req.Price
+		if price == 0 {
+			price = ltp
+		}
+		if value := price * float64(req.Quantity); value > cfg.MaxOrderValue {
+			return reject(RiskRuleOrderValue, "order value %.2f exceeds %.2f", value, cfg.MaxOrderValue)
+		}
+	}
+
+	if cfg.MaxOrderQuantity > 0 && req.Quantity > cfg.MaxOrderQuantity {
+		return reject(RiskRuleOrderQuantity, "order quantity %d exceeds %d", req.Quantity, cfg.MaxOrderQuantity)
+	}
+
+	maxQty := cfg.maxQuantity(req.TradingSymbol)
+	if maxQty == 0 && cfg.MaxOpenPositions == 0 && cfg.MaxDailyLoss == 0 {
+		return nil
+	}
+
+	positions, err := r.positions(ctx)
+	if err != nil {
+		return fmt.Errorf("risk check positions failed: %w", err)
+	}
+
+	net, open, pnl := 0, 0, 0.0
+	for _, p := range positions {
+		if p.Open() {
+			open++
+		}
+		pnl += p.PnL()
+		if p.Exchange == req.Exchange && p.TradingSymbol == req.TradingSymbol {
+			net += p.NetQuantity
+		}
+	}
+
+	signed := req.Quantity
+	if req.OrderType == OrderTypeSell {
+		signed = -signed
+	}
+	after := net + signed
+	increases := abs(after) > abs(net)
+
+	if maxQty > 0 && increases && abs(after) > maxQty {
+		return reject(RiskRuleQuantity, "resulting position %d exceeds %d", after, maxQty)
+	}
+	if cfg.MaxOpenPositions > 0 && net == 0 && open >= cfg.MaxOpenPositions {
+		return reject(RiskRuleOpenPositions, "%d positions already open, limit is %d", open, cfg.MaxOpenPositions)
+	}
+	if cfg.MaxDailyLoss > 0 && increases && pnl <= -cfg.MaxDailyLoss {
+		return reject(RiskRuleDailyLoss, "day P&L %.2f has reached the loss limit %.2f", pnl, cfg.MaxDailyLoss)
+	}
+	return nil
+}
+
+// PlaceOrder checks req and places it.
+func (r *RiskEngine) PlaceOrder(ctx context.Context, req OrderRequest) (map[string]interface{}, error) {
+	if err := r.precheck(ctx, req); err != nil {
+		return nil, err
+	}
+	return r.orders.WithContext(ctx).PlaceOrderRequest(req)
+}
+
+// ModifyOrder checks the modified order as if it were new and sends it.
+func (r *RiskEngine) ModifyOrder(ctx context.Context, params OrderParams) (map[string]interface{}, error) {
+	if err := r.precheck(ctx, modifyRequest(params)); err != nil {
+		return nil, err
+	}
+	return r.orders.WithContext(ctx).ModifyOrder(params)
+}
+
+// SliceOrder checks the whole order and sends it to the sliceorder route.
+func (r *RiskEngine) SliceOrder(ctx context.Context, req OrderRequest, slices int) (map[string]interface{}, error) {
+	if err := r.precheck(ctx, req); err != nil {
+		return nil, err
+	}
+	return r.orders.WithContext(ctx).SliceOrder(
+		req.Exchange,
+		req.OrderType,
+		req.Price,
+		req.PriceType,
+		req.ProductType,
+		req.Quantity,
+		slices,
+		req.TradingSymbol,
+		req.Amo,
+		req.BookLossPrice,
+		req.BookProfitPrice,
+		req.DisclosedQuantity,
+		req.MarketProtection,
+		req.Remarks,
+		req.TrailingPrice,
+		req.TriggerPrice,
+		req.Validity,
+	)
+}
+
+// precheck runs Check unless r is the engine installed on its orders, in
+// which case the order route runs it.
+func (r *RiskEngine) precheck(ctx context.Context, req OrderRequest) error {
+	if r.orders.risk.Load() == r {
+		return nil
+	}
+	return r.Check(ctx, req)
+}
+
+// modifyRequest returns the order that a modification leaves in place.
+func modifyRequest(params OrderParams) OrderRequest {
+	return OrderRequest{
+		Exchange:      params.Exchange,
+		OrderType:     params.OrderType,
+		Price:         params.Price,
+		PriceType:     params.PriceType,
+		ProductType:   params.ProductType,
+		Quantity:      params.Quantity,
+		TradingSymbol: params.TradingSymbol,
+		TriggerPrice:  params.TriggerPrice,
+		Validity:      params.Validity,
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
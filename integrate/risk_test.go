@@ -0,0 +1,164 @@
+package integrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRiskEngineCheck(t *testing.T) {
+	buy := func(qty int, price float64) OrderRequest {
+		return OrderRequest{Exchange: ExchangeTypeNSE, OrderType: OrderTypeBuy, PriceType: PriceTypeLimit,
+			ProductType: ProductTypeIntraday, Quantity: qty, Price: price, TradingSymbol: "INFY-EQ"}
+	}
+	sell := func(qty int, price float64) OrderRequest {
+		req := buy(qty, price)
+		req.OrderType = OrderTypeSell
+		return req
+	}
+	held := func(symbol string, net int, pnl float64) Position {
+		return Position{Exchange: ExchangeTypeNSE, TradingSymbol: symbol, ProductType: ProductTypeIntraday,
+			NetQuantity: net, RealizedPnL: pnl}
+	}
+	trigger := 90.0
+	stop := buy(10, 100)
+	stop.TriggerPrice = &trigger
+	market := buy(200, 0)
+	market.PriceType = PriceTypeMarket
+
+	tests := []struct {
+		name      string
+		cfg       RiskConfig
+		req       OrderRequest
+		ltp       float64
+		positions []Position
+		lookupErr error
+		wantRule  string
+		wantErr   bool
+	}{
+		{
+			name:     "restricted symbol",
+			cfg:      RiskConfig{RestrictedSymbols: []string{"infy-eq"}},
+			req:      buy(1, 100),
+			wantRule: RiskRuleRestricted,
+		},
+		{
+			name:     "price outside the band",
+			cfg:      RiskConfig{PriceBandPercent: 5},
+			req:      buy(10, 110),
+			ltp:      100,
+			wantRule: RiskRulePriceBand,
+		},
+		{
+			name:     "trigger outside the band",
+			cfg:      RiskConfig{PriceBandPercent: 5},
+			req:      stop,
+			ltp:      100,
+			wantRule: RiskRulePriceBand,
+		},
+		{
+			name: "price inside the band",
+			cfg:  RiskConfig{PriceBandPercent: 5},
+			req:  buy(10, 104),
+			ltp:  100,
+		},
+		{
+			name:     "order value at the limit price",
+			cfg:      RiskConfig{MaxOrderValue: 10000},
+			req:      buy(200, 100),
+			wantRule: RiskRuleOrderValue,
+		},
+		{
+			name:     "market order valued at the last price",
+			cfg:      RiskConfig{MaxOrderValue: 10000},
+			req:      market,
+			ltp:      100,
+			wantRule: RiskRuleOrderValue,
+		},
+		{
+			name:     "order quantity",
+			cfg:      RiskConfig{MaxOrderQuantity: 50},
+			req:      buy(100, 100),
+			wantRule: RiskRuleOrderQuantity,
+		},
+		{
+			name:      "resulting position over the limit",
+			cfg:       RiskConfig{MaxQuantity: 100},
+			req:       buy(30, 100),
+			positions: []Position{held("INFY-EQ", 80, 0)},
+			wantRule:  RiskRuleQuantity,
+		},
+		{
+			name:      "reducing a position over the limit",
+			cfg:       RiskConfig{MaxQuantity: 100},
+			req:       sell(30, 100),
+			positions: []Position{held("INFY-EQ", 150, 0)},
+		},
+		{
+			name:      "per-symbol limit overrides the default",
+			cfg:       RiskConfig{MaxQuantity: 100, MaxQuantityPerSymbol: map[string]int{"INFY-EQ": 500}},
+			req:       buy(30, 100),
+			positions: []Position{held("INFY-EQ", 80, 0)},
+		},
+		{
+			name:      "new position over the open position limit",
+			cfg:       RiskConfig{MaxOpenPositions: 2},
+			req:       buy(10, 100),
+			positions: []Position{held("TCS-EQ", 5, 0), held("SBIN-EQ", -5, 0)},
+			wantRule:  RiskRuleOpenPositions,
+		},
+		{
+			name:      "adding to an open position at the open position limit",
+			cfg:       RiskConfig{MaxOpenPositions: 2},
+			req:       buy(10, 100),
+			positions: []Position{held("INFY-EQ", 5, 0), held("SBIN-EQ", -5, 0)},
+		},
+		{
+			name:      "increasing exposure past the daily loss limit",
+			cfg:       RiskConfig{MaxDailyLoss: 1000},
+			req:       buy(10, 100),
+			positions: []Position{held("INFY-EQ", 10, -600), held("TCS-EQ", 0, -900)},
+			wantRule:  RiskRuleDailyLoss,
+		},
+		{
+			name:      "reducing exposure past the daily loss limit",
+			cfg:       RiskConfig{MaxDailyLoss: 1000},
+			req:       sell(10, 100),
+			positions: []Position{held("INFY-EQ", 10, -600), held("TCS-EQ", 0, -900)},
+		},
+		{
+			name:      "positions lookup failure",
+			cfg:       RiskConfig{MaxOpenPositions: 2},
+			req:       buy(10, 100),
+			lookupErr: errors.New("positions unavailable"),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRiskEngine(NewIntegrateOrders(&ConnectToIntegrate{}, false), nil, tt.cfg, false)
+			r.quote = func(ctx context.Context, exchange, tradingSymbol string) (map[string]interface{}, error) {
+				return map[string]interface{}{"ltp": tt.ltp}, nil
+			}
+			r.positions = func(ctx context.Context) ([]Position, error) {
+				return tt.positions, tt.lookupErr
+			}
+
+			err := r.Check(context.Background(), tt.req)
+			var rej *RiskRejection
+			switch {
+			case tt.wantRule != "":
+				if !errors.As(err, &rej) || rej.Rule != tt.wantRule {
+					t.Fatalf("err = %v, want rule %s", err, tt.wantRule)
+				}
+			case tt.wantErr:
+				if err == nil || errors.As(err, &rej) {
+					t.Fatalf("err = %v, want a lookup error", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected err: %v", err)
+			}
+		})
+	}
+}
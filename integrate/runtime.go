@@ -0,0 +1,817 @@
+package integrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatefulStrategy is implemented by strategies with variables of their own
+// that must survive a restart. The runtime stores the raw JSON alongside the
+// strategy's positions and orders.
+type StatefulStrategy interface {
+	SaveState() (json.RawMessage, error)
+	LoadState(state json.RawMessage) error
+}
+
+// LifecycleStrategy is implemented by strategies that need to act when
+// their session starts and stops.
+type LifecycleStrategy interface {
+	Start(b Broker) error
+	Stop(b Broker)
+}
+
+// StrategyLimits are per-strategy risk limits. A zero limit disables its
+// check. Once the strategy's day P&L reaches -MaxDailyLoss, only orders
+// that reduce its positions are accepted.
+type StrategyLimits struct {
+	MaxOrderValue float64
+	MaxPosition   int
+	MaxDailyLoss  float64
+}
+
+// StrategySpec describes one strategy hosted by a Runtime. The strategy
+// runs during the session of Exchange, or of its first instrument when
+// Exchange is empty. With a BarInterval, OnBar receives bars built from
+// its ticks.
+type StrategySpec struct {
+	Name        string
+	Strategy    Strategy
+	Exchange    string
+	Instruments []Instrument
+	BarInterval time.Duration
+	Limits      StrategyLimits
+}
+
+// StrategyPosition is a position built from the fills of one strategy.
+type StrategyPosition struct {
+	Exchange      string  `json:"exchange"`
+	TradingSymbol string  `json:"tradingsymbol"`
+	ProductType   string  `json:"product_type"`
+	Net           int     `json:"net_quantity"`
+	AvgPrice      float64 `json:"average_price"`
+	Realized      float64 `json:"realized_pnl"`
+}
+
+// add applies a fill and returns the profit it realized.
+func (p *StrategyPosition) add(orderType string, qty int, price float64) float64 {
+	signed := qty
+	if orderType == OrderTypeSell {
+		signed = -qty
+	}
+
+	if p.Net == 0 || (p.Net > 0) == (signed > 0) {
+		p.AvgPrice = (p.AvgPrice*float64(abs(p.Net)) + price*float64(qty)) / float64(abs(p.Net)+qty)
+		p.Net += signed
+		return 0
+	}
+
+	closed := qty
+	if closed > abs(p.Net) {
+		closed = abs(p.Net)
+	}
+	pnl := (price - p.AvgPrice) * float64(closed)
+	if p.Net < 0 {
+		pnl = -pnl
+	}
+	p.Realized += pnl
+	p.Net += signed
+	if p.Net == 0 {
+		p.AvgPrice = 0
+	} else if (p.Net > 0) == (signed > 0) {
+		p.AvgPrice = price
+	}
+	return pnl
+}
+
+// StrategyOrder is an order placed by a strategy and what has filled of it.
+type StrategyOrder struct {
+	OrderID       string  `json:"order_id"`
+	Exchange      string  `json:"exchange"`
+	TradingSymbol string  `json:"tradingsymbol"`
+	OrderType     string  `json:"order_type"`
+	ProductType   string  `json:"product_type"`
+	Status        string  `json:"status"`
+	Filled        int     `json:"filled_qty"`
+	AvgPrice      float64 `json:"average_price"`
+}
+
+// StrategyState is what the runtime persists for one strategy.
+type StrategyState struct {
+	Name      string             `json:"name"`
+	SavedAt   time.Time          `json:"saved_at"`
+	Positions []StrategyPosition `json:"positions"`
+	Orders    []StrategyOrder    `json:"orders"`
+	Custom    json.RawMessage    `json:"custom,omitempty"`
+}
+
+// Defaults for the strategy runtime
+const (
+	defaultStateSaveInterval = 30 * time.Second
+	runtimeEventBuffer       = 1024
+	maxEarlyUpdates          = 1024
+)
+
+// Runtime hosts strategies. It feeds each one ticks from a MarketDataHub
+// subscription and order updates from an OrderTracker, starts and stops it
+// on its exchange session, and saves its state under StateDir so a restart
+// during the day resumes with the same positions and open orders. Every
+// strategy's callbacks run on one goroutine of its own.
+type Runtime struct {
+	broker       Broker
+	data         *IntegrateData
+	hub          *MarketDataHub
+	tracker      *OrderTracker
+	StateDir     string
+	SaveInterval time.Duration
+	Calendar     *TradingCalendar
+	TradingDay   func(day time.Time) bool
+	logging      bool
+	now          func() time.Time
+
+	mu         sync.Mutex
+	strategies []*hostedStrategy
+	owners     map[string]*hostedStrategy
+	early      map[string]OrderUpdate
+}
+
+// NewRuntime initializes a runtime trading through broker. Order updates
+// from the broker must reach the runtime through HandleOrderUpdate.
+// Sessions follow Calendar for each strategy's exchange unless TradingDay
+// is set.
+func NewRuntime(broker Broker, data *IntegrateData, hub *MarketDataHub, stateDir string, logging bool) *Runtime {
+	orders, _ := broker.(*IntegrateOrders)
+	return &Runtime{
+		broker:       broker,
+		data:         data,
+		hub:          hub,
+		tracker:      NewOrderTracker(orders, logging),
+		StateDir:     stateDir,
+		SaveInterval: defaultStateSaveInterval,
+		Calendar:     NewTradingCalendar(),
+		logging:      logging,
+		now:          time.Now,
+		owners:       make(map[string]*hostedStrategy),
+		early:        make(map[string]OrderUpdate),
+	}
+}
+
+// tradingDay reports whether exchange trades on day.
+func (rt *Runtime) tradingDay(exchange string, day time.Time) bool {
+	if rt.TradingDay != nil {
+		return rt.TradingDay(day)
+	}
+	return rt.Calendar.IsTradingDay(exchange, day)
+}
+
+// Tracker returns the tracker following the orders of every strategy. It
+// is fed through HandleOrderUpdate. It can also Poll and SyncTrades when
+// the broker is an *IntegrateOrders; with any other broker those do
+// nothing and return an error respectively.
+func (rt *Runtime) Tracker() *OrderTracker {
+	return rt.tracker
+}
+
+// Add registers a strategy. Tokens for its instruments are looked up in
+// the symbols file. Strategies must be added before Run.
+func (rt *Runtime) Add(spec StrategySpec) error {
+	if spec.Name == "" || spec.Strategy == nil {
+		return errors.New("strategy needs a name and an implementation")
+	}
+	if strings.ContainsAny(spec.Name, `/\:`) {
+		return fmt.Errorf("invalid strategy name %q", spec.Name)
+	}
+	if spec.Exchange == "" && len(spec.Instruments) > 0 {
+		spec.Exchange = spec.Instruments[0].Exchange
+	}
+	if spec.Exchange == "" {
+		return fmt.Errorf("strategy %s has no exchange", spec.Name)
+	}
+
+	h := &hostedStrategy{
+		spec:      spec,
+		rt:        rt,
+		symbols:   make(map[InstrumentToken]string),
+		positions: make(map[string]*StrategyPosition),
+		orders:    make(map[string]*StrategyOrder),
+		marks:     make(map[string]float64),
+		updates:   make(chan OrderUpdate, runtimeEventBuffer),
+	}
+	for _, inst := range spec.Instruments {
+		if rt.data == nil {
+			return errors.New("runtime needs a data client to resolve instruments")
+		}
+		token, err := rt.data.getToken(inst.Exchange, inst.TradingSymbol)
+		if err != nil {
+			return err
+		}
+		key := InstrumentToken{Exchange: inst.Exchange, Token: token}
+		h.tokens = append(h.tokens, key)
+		h.symbols[key] = inst.TradingSymbol
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, other := range rt.strategies {
+		if other.spec.Name == spec.Name {
+			return fmt.Errorf("strategy %s already added", spec.Name)
+		}
+	}
+	rt.strategies = append(rt.strategies, h)
+	return nil
+}
+
+// HandleOrderUpdate feeds an order update from the websocket, a poller or
+// a PaperBroker into the runtime. Updates can arrive before placeorder has
+// returned the order id, so updates for unknown orders are kept until the
+// order is claimed by a strategy.
+func (rt *Runtime) HandleOrderUpdate(u OrderUpdate) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, owned := rt.owners[u.OrderID]; owned {
+		rt.tracker.Apply(u)
+		return
+	}
+	if len(rt.early) >= maxEarlyUpdates {
+		rt.early = make(map[string]OrderUpdate)
+	}
+	rt.early[u.OrderID] = u
+}
+
+// claim records h as the owner of an order and replays any update that
+// arrived before it. Updates are applied under rt.mu so they reach the
+// tracker in the order they arrived.
+func (rt *Runtime) claim(h *hostedStrategy, orderID string) {
+	rt.tracker.Register(orderID)
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.owners[orderID] = h
+	if u, ok := rt.early[orderID]; ok {
+		delete(rt.early, orderID)
+		rt.tracker.Apply(u)
+	}
+}
+
+// Run feeds order updates from updates, which may be nil, and runs every
+// strategy on its session until ctx is done.
+func (rt *Runtime) Run(ctx context.Context, updates <-chan OrderUpdate) error {
+	if rt.StateDir != "" {
+		if err := os.MkdirAll(rt.StateDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	transitions, unsubscribe := rt.tracker.Subscribe(runtimeEventBuffer)
+	defer unsubscribe()
+
+	rt.mu.Lock()
+	strategies := append([]*hostedStrategy(nil), rt.strategies...)
+	rt.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, h := range strategies {
+		wg.Add(1)
+		go func(h *hostedStrategy) {
+			defer wg.Done()
+			h.run(ctx)
+		}(h)
+	}
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case u, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			rt.HandleOrderUpdate(u)
+		case tr := <-transitions:
+			rt.mu.Lock()
+			h := rt.owners[tr.OrderID]
+			rt.mu.Unlock()
+			if h != nil {
+				select {
+				case h.updates <- tr.Update:
+				default:
+					if rt.logging {
+						logger.Printf("strategy %s: order update buffer full, dropped %s", h.spec.Name, tr.OrderID)
+					}
+				}
+			}
+		}
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// hostedStrategy is the runtime's view of one strategy.
+type hostedStrategy struct {
+	spec    StrategySpec
+	rt      *Runtime
+	tokens  []InstrumentToken
+	symbols map[InstrumentToken]string
+	updates chan OrderUpdate
+
+	mu        sync.Mutex
+	positions map[string]*StrategyPosition
+	orders    map[string]*StrategyOrder
+	marks     map[string]float64
+	dirty     bool
+}
+
+// window returns the next session of the strategy that has not ended.
+func (h *hostedStrategy) window(now time.Time) (time.Time, time.Time) {
+	session := SessionFor(h.spec.Exchange)
+	day := now.In(IST)
+	for i := 0; i < 366; i++ {
+		if h.rt.tradingDay(h.spec.Exchange, day) {
+			open, close := session.OpenOn(day), session.CloseOn(day)
+			if now.Before(close) {
+				return open, close
+			}
+		}
+		day = istMidnight(day).AddDate(0, 0, 1)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// run waits for each session, serves it and saves state when it closes.
+func (h *hostedStrategy) run(ctx context.Context) {
+	for {
+		open, close := h.window(h.rt.now())
+		if open.IsZero() {
+			return
+		}
+		if wait := open.Sub(h.rt.now()); wait > 0 {
+			if h.rt.logging {
+				logger.Printf("strategy %s: waiting %s for session open", h.spec.Name, wait.Round(time.Second))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if err := h.serve(ctx, close); err != nil && h.rt.logging {
+			logger.Printf("strategy %s: %v", h.spec.Name, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// serve runs one session until sessionClose or ctx is done.
+func (h *hostedStrategy) serve(ctx context.Context, sessionClose time.Time) error {
+	b := &strategyBroker{h: h}
+
+	if err := h.restore(); err != nil {
+		return fmt.Errorf("restoring state: %w", err)
+	}
+	if ls, ok := h.spec.Strategy.(LifecycleStrategy); ok {
+		if err := ls.Start(b); err != nil {
+			return fmt.Errorf("start: %w", err)
+		}
+	}
+	if h.rt.logging {
+		logger.Printf("strategy %s: started", h.spec.Name)
+	}
+
+	var ticks <-chan Tick
+	if h.rt.hub != nil && len(h.tokens) > 0 {
+		sub, err := h.rt.hub.NewSubscription(h.spec.Name, runtimeEventBuffer, OverflowDrop)
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+		if err := sub.Subscribe(SubscriptionTypeTick, h.tokens...); err != nil {
+			return err
+		}
+		ticks = sub.Ticks()
+	}
+
+	var bars *BarBuilder
+	if h.spec.BarInterval > 0 {
+		var err error
+		if bars, err = NewBarBuilder(h.spec.BarInterval); err != nil {
+			return err
+		}
+		bars.OnClose = func(bar Bar) {
+			if bar.TradingSymbol == "" {
+				bar.TradingSymbol = h.symbols[InstrumentToken{Exchange: bar.Exchange, Token: bar.Token}]
+			}
+			h.spec.Strategy.OnBar(b, bar)
+		}
+	}
+
+	saveInterval := h.rt.SaveInterval
+	if saveInterval <= 0 {
+		saveInterval = defaultStateSaveInterval
+	}
+	saveTicker := time.NewTicker(saveInterval)
+	defer saveTicker.Stop()
+	barTicker := time.NewTicker(time.Second)
+	defer barTicker.Stop()
+	end := time.NewTimer(sessionClose.Sub(h.rt.now()))
+	defer end.Stop()
+
+	stop := func() error {
+		if bars != nil {
+			bars.CloseExpired(sessionClose)
+		}
+		if ls, ok := h.spec.Strategy.(LifecycleStrategy); ok {
+			ls.Stop(b)
+		}
+		if h.rt.logging {
+			logger.Printf("strategy %s: stopped, P&L %.2f", h.spec.Name, h.PnL())
+		}
+		return h.save()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return stop()
+		case <-end.C:
+			return stop()
+		case t, ok := <-ticks:
+			if !ok {
+				ticks = nil
+				continue
+			}
+			if t.TradingSymbol == "" {
+				t.TradingSymbol = h.symbols[InstrumentToken{Exchange: t.Exchange, Token: t.Token}]
+			}
+			h.mark(t)
+			h.spec.Strategy.OnTick(b, t)
+			if bars != nil {
+				bars.AddTick(t)
+			}
+		case now := <-barTicker.C:
+			if bars != nil {
+				bars.CloseExpired(now)
+			}
+		case u := <-h.updates:
+			h.applyFill(u)
+			h.spec.Strategy.OnOrderUpdate(b, u)
+		case <-saveTicker.C:
+			if err := h.saveIfDirty(); err != nil && h.rt.logging {
+				logger.Printf("strategy %s: saving state failed: %v", h.spec.Name, err)
+			}
+		}
+	}
+}
+
+func (h *hostedStrategy) mark(t Tick) {
+	if t.LTP == 0 {
+		return
+	}
+	h.mu.Lock()
+	h.marks[paperKey(t.Exchange, t.TradingSymbol)] = t.LTP
+	h.mu.Unlock()
+}
+
+// applyFill updates the strategy's positions from the filled quantity and
+// average price of an order update.
+func (h *hostedStrategy) applyFill(u OrderUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	o, ok := h.orders[u.OrderID]
+	if !ok {
+		return
+	}
+	o.Status = u.Status
+	h.dirty = true
+
+	delta := u.FilledQuantity - o.Filled
+	if delta <= 0 {
+		return
+	}
+	price := u.AveragePrice
+	if price > 0 && o.Filled > 0 {
+		price = (u.AveragePrice*float64(u.FilledQuantity) - o.AvgPrice*float64(o.Filled)) / float64(delta)
+	}
+	if price <= 0 {
+		price = u.Price
+	}
+	o.Filled = u.FilledQuantity
+	o.AvgPrice = u.AveragePrice
+
+	key := paperKey(o.Exchange, o.TradingSymbol) + "|" + o.ProductType
+	p, ok := h.positions[key]
+	if !ok {
+		p = &StrategyPosition{Exchange: o.Exchange, TradingSymbol: o.TradingSymbol, ProductType: o.ProductType}
+		h.positions[key] = p
+	}
+	p.add(o.OrderType, delta, price)
+}
+
+// PnL returns realized plus marked-to-market profit of the strategy.
+func (h *hostedStrategy) PnL() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pnl()
+}
+
+func (h *hostedStrategy) pnl() float64 {
+	total := 0.0
+	for _, p := range h.positions {
+		total += p.Realized
+		if mark, ok := h.marks[paperKey(p.Exchange, p.TradingSymbol)]; ok && p.Net != 0 {
+			total += (mark - p.AvgPrice) * float64(p.Net)
+		}
+	}
+	return total
+}
+
+// net returns the strategy's net quantity in an instrument across products.
+func (h *hostedStrategy) net(exchange, tradingSymbol string) int {
+	n := 0
+	for _, p := range h.positions {
+		if p.Exchange == exchange && p.TradingSymbol == tradingSymbol {
+			n += p.Net
+		}
+	}
+	return n
+}
+
+// check applies the strategy's limits to req.
+func (h *hostedStrategy) check(req OrderRequest) error {
+	lim := h.spec.Limits
+	h.mu.Lock()
+	net := h.net(req.Exchange, req.TradingSymbol)
+	mark := h.marks[paperKey(req.Exchange, req.TradingSymbol)]
+	pnl := h.pnl()
+	h.mu.Unlock()
+
+	signed := req.Quantity
+	if req.OrderType == OrderTypeSell {
+		signed = -signed
+	}
+	after := net + signed
+	increases := abs(after) > abs(net)
+
+	reject := func(rule, format string, args ...interface{}) error {
+		rej := &RiskRejection{Rule: rule, Order: req, Message: h.spec.Name + ": " + fmt.Sprintf(format, args...)}
+		if h.rt.logging {
+			logger.Println(rej)
+		}
+		return rej
+	}
+
+	if lim.MaxDailyLoss > 0 && increases && pnl <= -lim.MaxDailyLoss {
+		return reject(RiskRuleDailyLoss, "P&L %.2f has reached the loss limit %.2f", pnl, lim.MaxDailyLoss)
+	}
+	if lim.MaxPosition > 0 && increases && abs(after) > lim.MaxPosition {
+		return reject(RiskRuleQuantity, "resulting position %d exceeds %d", after, lim.MaxPosition)
+	}
+	if lim.MaxOrderValue > 0 {
+		price := req.Price
+		if price == 0 {
+			price = mark
+		}
+		if value := price * float64(req.Quantity); value > lim.MaxOrderValue {
+			return reject(RiskRuleOrderValue, "order value %.2f exceeds %.2f", value, lim.MaxOrderValue)
+		}
+	}
+	return nil
+}
+
+func (h *hostedStrategy) statePath() string {
+	return filepath.Join(h.rt.StateDir, h.spec.Name+".json")
+}
+
+// save writes the strategy's state to StateDir.
+func (h *hostedStrategy) save() error {
+	if h.rt.StateDir == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	state := StrategyState{Name: h.spec.Name, SavedAt: h.rt.now()}
+	for _, p := range h.positions {
+		state.Positions = append(state.Positions, *p)
+	}
+	for _, o := range h.orders {
+		state.Orders = append(state.Orders, *o)
+	}
+	h.dirty = false
+	h.mu.Unlock()
+
+	sort.Slice(state.Positions, func(i, j int) bool {
+		return state.Positions[i].TradingSymbol < state.Positions[j].TradingSymbol
+	})
+	sort.Slice(state.Orders, func(i, j int) bool { return state.Orders[i].OrderID < state.Orders[j].OrderID })
+
+	if ss, ok := h.spec.Strategy.(StatefulStrategy); ok {
+		custom, err := ss.SaveState()
+		if err != nil {
+			return err
+		}
+		state.Custom = custom
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.statePath())
+}
+
+func (h *hostedStrategy) saveIfDirty() error {
+	h.mu.Lock()
+	dirty := h.dirty
+	h.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return h.save()
+}
+
+// restore loads saved state. Orders, and positions in products squared
+// off every day, are only restored from a save made on the same day;
+// NORMAL and CNC positions carry overnight and are restored from any save,
+// with their realized profit reset. Custom state is always restored.
+// Orders that were still open are tracked again, and their current state
+// is fetched so fills made while the strategy was down are counted.
+func (h *hostedStrategy) restore() error {
+	h.mu.Lock()
+	h.positions = make(map[string]*StrategyPosition)
+	h.orders = make(map[string]*StrategyOrder)
+	h.mu.Unlock()
+
+	if h.rt.StateDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(h.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state StrategyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", h.statePath(), err)
+	}
+
+	if ss, ok := h.spec.Strategy.(StatefulStrategy); ok && len(state.Custom) > 0 {
+		if err := ss.LoadState(state.Custom); err != nil {
+			return err
+		}
+	}
+	sameDay := istMidnight(state.SavedAt).Equal(istMidnight(h.rt.now()))
+
+	var open []string
+	restored := 0
+	h.mu.Lock()
+	for i := range state.Positions {
+		p := state.Positions[i]
+		if !sameDay {
+			if p.Net == 0 || (p.ProductType != ProductTypeNormal && p.ProductType != ProductTypeCNC) {
+				continue
+			}
+			p.Realized = 0
+		}
+		h.positions[paperKey(p.Exchange, p.TradingSymbol)+"|"+p.ProductType] = &p
+		restored++
+	}
+	if !sameDay {
+		state.Orders = nil
+	}
+	for i := range state.Orders {
+		o := state.Orders[i]
+		h.orders[o.OrderID] = &o
+		if !isTerminalStatus(o.Status) {
+			open = append(open, o.OrderID)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, id := range open {
+		h.rt.claim(h, id)
+		r, err := h.rt.broker.Order(id)
+		if err != nil {
+			if h.rt.logging {
+				logger.Printf("strategy %s: order %s status failed: %v", h.spec.Name, id, err)
+			}
+			continue
+		}
+		u := parseOrderRow(r)
+		u.OrderID = id
+		h.applyFill(u)
+	}
+	if h.rt.logging {
+		logger.Printf("strategy %s: restored %d positions and %d orders (%d open)", h.spec.Name, restored, len(state.Orders), len(open))
+	}
+	return nil
+}
+
+// strategyBroker is the Broker handed to a hosted strategy. It enforces the
+// strategy's limits and records the orders it places.
+type strategyBroker struct {
+	h *hostedStrategy
+}
+
+func (b *strategyBroker) PlaceOrderRequest(req OrderRequest) (map[string]interface{}, error) {
+	h := b.h
+	if err := h.check(req); err != nil {
+		return nil, err
+	}
+	r, err := h.rt.broker.PlaceOrderRequest(req)
+	if err != nil {
+		return r, err
+	}
+	id, err := orderIDFrom(r)
+	if err != nil {
+		return r, err
+	}
+
+	h.mu.Lock()
+	h.orders[id] = &StrategyOrder{
+		OrderID:       id,
+		Exchange:      req.Exchange,
+		TradingSymbol: req.TradingSymbol,
+		OrderType:     req.OrderType,
+		ProductType:   req.ProductType,
+		Status:        OrderStatusNew,
+	}
+	h.dirty = true
+	h.mu.Unlock()
+
+	h.rt.claim(h, id)
+	return r, nil
+}
+
+func (b *strategyBroker) ModifyOrder(params OrderParams) (map[string]interface{}, error) {
+	h := b.h
+	h.mu.Lock()
+	o, ok := h.orders[params.OrderID]
+	h.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("order %s does not belong to strategy %s", params.OrderID, h.spec.Name)
+	}
+
+	// Only the unfilled part of the order adds to the position.
+	req := OrderRequest{
+		Exchange:      o.Exchange,
+		OrderType:     o.OrderType,
+		Price:         params.Price,
+		PriceType:     params.PriceType,
+		ProductType:   o.ProductType,
+		Quantity:      params.Quantity - o.Filled,
+		TradingSymbol: o.TradingSymbol,
+		TriggerPrice:  params.TriggerPrice,
+	}
+	if err := h.check(req); err != nil {
+		return nil, err
+	}
+	return h.rt.broker.ModifyOrder(params)
+}
+
+func (b *strategyBroker) CancelOrder(orderID string) (map[string]interface{}, error) {
+	return b.h.rt.broker.CancelOrder(orderID)
+}
+
+func (b *strategyBroker) Order(orderID string) (map[string]interface{}, error) {
+	return b.h.rt.broker.Order(orderID)
+}
+
+func (b *strategyBroker) Orders() (map[string]interface{}, error) {
+	return b.h.rt.broker.Orders()
+}
+
+func (b *strategyBroker) Trades() (map[string]interface{}, error) {
+	return b.h.rt.broker.Trades()
+}
+
+func (b *strategyBroker) Positions() (map[string]interface{}, error) {
+	return b.h.rt.broker.Positions()
+}
+
+func (b *strategyBroker) Holdings() (map[string]interface{}, error) {
+	return b.h.rt.broker.Holdings()
+}
+
+func (b *strategyBroker) Limits() (map[string]interface{}, error) {
+	return b.h.rt.broker.Limits()
+}
@@ -0,0 +1,554 @@
+package integrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants for condition types
+const (
+	ConditionLTPAbove        = "LTP_ABOVE"
+	ConditionLTPBelow        = "LTP_BELOW"
+	ConditionLTPCrossesAbove = "LTP_CROSSES_ABOVE"
+	ConditionLTPCrossesBelow = "LTP_CROSSES_BELOW"
+	ConditionSpreadBelow     = "SPREAD_BELOW"
+	ConditionVWAPAbove       = "VWAP_ABOVE"
+	ConditionVWAPBelow       = "VWAP_BELOW"
+	ConditionTimeAfter       = "TIME_AFTER"
+)
+
+// Constants for scheduled order status
+const (
+	ScheduleStatusPending   = "PENDING"
+	ScheduleStatusPlaced    = "PLACED"
+	ScheduleStatusFailed    = "FAILED"
+	ScheduleStatusCancelled = "CANCELLED"
+	ScheduleStatusExpired   = "EXPIRED"
+)
+
+// Defaults for the order scheduler
+const (
+	defaultSchedulePoll     = time.Second
+	defaultScheduleMaxDelay = 5 * time.Minute
+)
+
+// OrderCondition is one test on market data or the clock. Exchange and
+// TradingSymbol default to those of the order. Value is the price level,
+// the spread for SPREAD_BELOW, and unused for TIME_AFTER.
+type OrderCondition struct {
+	Type          string    `json:"type"`
+	Exchange      string    `json:"exchange,omitempty"`
+	TradingSymbol string    `json:"tradingsymbol,omitempty"`
+	Value         float64   `json:"value,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// ScheduledOrder is an order held back until At, until every one of
+// Conditions holds, or both. A pending order lapses at Expires when set.
+type ScheduledOrder struct {
+	ID         string           `json:"id"`
+	Request    OrderRequest     `json:"request"`
+	At         time.Time        `json:"at"`
+	Conditions []OrderCondition `json:"conditions,omitempty"`
+	Expires    time.Time        `json:"expires"`
+	Status     string           `json:"status"`
+	Created    time.Time        `json:"created"`
+	Fired      time.Time        `json:"fired"`
+	OrderID    string           `json:"order_id,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// marketSnapshot is the latest market data seen for an instrument.
+type marketSnapshot struct {
+	ltp  float64
+	vwap float64
+	bid  float64
+	ask  float64
+}
+
+// OrderScheduler places orders at a set time or when conditions on market
+// data hold. Schedules are saved to a JSON file on every change, so pending
+// ones survive a restart.
+//
+// A scheduled time that falls on a holiday or outside the exchange session
+// is moved to the next session open, unless the order is an AMO.
+// Conditions are only evaluated while the session is open.
+//
+// A schedule with a time, no conditions and no expiry lapses when it is
+// more than MaxDelay past due without having fired, so one missed while the
+// process was down is not placed hours late after a restart. Zero MaxDelay
+// places it however late.
+type OrderScheduler struct {
+	broker       Broker
+	data         *IntegrateData
+	Calendar     *TradingCalendar
+	PollInterval time.Duration
+	MaxDelay     time.Duration
+	OnPlaced     func(ScheduledOrder)
+	path         string
+	logging      bool
+	now          func() time.Time
+
+	mu       sync.Mutex
+	saveMu   sync.Mutex
+	orders   map[string]*ScheduledOrder
+	market   map[string]marketSnapshot
+	previous map[conditionKey]float64
+	seq      uint64
+}
+
+// conditionKey identifies one condition of one schedule.
+type conditionKey struct {
+	id    string
+	index int
+}
+
+// NewOrderScheduler initializes a scheduler that keeps its schedules in
+// path and loads any saved there. calendar may be nil to close only on
+// weekends.
+func NewOrderScheduler(broker Broker, data *IntegrateData, calendar *TradingCalendar, path string, logging bool) (*OrderScheduler, error) {
+	s := &OrderScheduler{
+		broker:       broker,
+		data:         data,
+		Calendar:     calendar,
+		PollInterval: defaultSchedulePoll,
+		MaxDelay:     defaultScheduleMaxDelay,
+		path:         path,
+		logging:      logging,
+		now:          time.Now,
+		orders:       make(map[string]*ScheduledOrder),
+		market:       make(map[string]marketSnapshot),
+		previous:     make(map[conditionKey]float64),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedule adds o and returns its id.
+func (s *OrderScheduler) Schedule(o ScheduledOrder) (string, error) {
+	if o.Request.Exchange == "" || o.Request.TradingSymbol == "" || o.Request.Quantity <= 0 {
+		return "", errors.New("scheduled order needs an exchange, symbol and quantity")
+	}
+	if o.At.IsZero() && len(o.Conditions) == 0 {
+		return "", errors.New("scheduled order needs a time or a condition")
+	}
+	for _, c := range o.Conditions {
+		if err := validateCondition(c); err != nil {
+			return "", err
+		}
+	}
+	if !o.Expires.IsZero() && !o.Expires.After(s.now()) {
+		return "", errors.New("expiry is in the past")
+	}
+
+	s.mu.Lock()
+	s.seq++
+	o.ID = "sch" + strconv.FormatInt(s.now().UnixMilli(), 36) + strconv.FormatUint(s.seq, 36)
+	o.Status = ScheduleStatusPending
+	o.Created = s.now()
+	o.Fired, o.OrderID, o.Error = time.Time{}, "", ""
+	s.orders[o.ID] = &o
+	s.mu.Unlock()
+
+	if s.logging {
+		logger.Printf("scheduler: %s %s %d %s due %s", o.ID, o.Request.OrderType, o.Request.Quantity, o.Request.TradingSymbol, s.due(o).Format(time.RFC3339))
+	}
+	return o.ID, s.save()
+}
+
+func validateCondition(c OrderCondition) error {
+	switch c.Type {
+	case ConditionLTPAbove, ConditionLTPBelow, ConditionLTPCrossesAbove, ConditionLTPCrossesBelow,
+		ConditionVWAPAbove, ConditionVWAPBelow:
+		if c.Value <= 0 {
+			return fmt.Errorf("%s needs a positive price", c.Type)
+		}
+	case ConditionSpreadBelow:
+		if c.Value <= 0 {
+			return errors.New("SPREAD_BELOW needs a positive spread")
+		}
+	case ConditionTimeAfter:
+		if c.Time.IsZero() {
+			return errors.New("TIME_AFTER needs a time")
+		}
+	default:
+		return fmt.Errorf("unknown condition type %q", c.Type)
+	}
+	return nil
+}
+
+// List returns every schedule, pending or not, oldest first.
+func (s *OrderScheduler) List() []ScheduledOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]ScheduledOrder, 0, len(s.orders))
+	for _, o := range s.orders {
+		list = append(list, *o)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Get returns the schedule with id.
+func (s *OrderScheduler) Get(id string) (ScheduledOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[id]
+	if !ok {
+		return ScheduledOrder{}, false
+	}
+	return *o, true
+}
+
+// Cancel cancels a pending schedule.
+func (s *OrderScheduler) Cancel(id string) error {
+	s.mu.Lock()
+	o, ok := s.orders[id]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown schedule %s", id)
+	}
+	if o.Status != ScheduleStatusPending {
+		status := o.Status
+		s.mu.Unlock()
+		return fmt.Errorf("schedule %s is %s", id, status)
+	}
+	o.Status = ScheduleStatusCancelled
+	s.mu.Unlock()
+
+	if s.logging {
+		logger.Printf("scheduler: %s cancelled", id)
+	}
+	return s.save()
+}
+
+// Prune drops schedules that are no longer pending.
+func (s *OrderScheduler) Prune() error {
+	s.mu.Lock()
+	for id, o := range s.orders {
+		if o.Status != ScheduleStatusPending {
+			delete(s.orders, id)
+		}
+	}
+	s.mu.Unlock()
+	return s.save()
+}
+
+// due returns the earliest time o may be placed.
+func (s *OrderScheduler) due(o ScheduledOrder) time.Time {
+	at := o.At
+	if at.IsZero() {
+		at = o.Created
+	}
+	if o.Request.Amo != nil && *o.Request.Amo == "YES" {
+		return at
+	}
+	return s.Calendar.NextOpen(o.Request.Exchange, at)
+}
+
+// OnTick records market data for the conditions and evaluates them.
+func (s *OrderScheduler) OnTick(t Tick) {
+	s.mu.Lock()
+	s.market[paperKey(t.Exchange, t.TradingSymbol)] = marketSnapshot{
+		ltp:  t.LTP,
+		vwap: t.AveragePrice,
+		bid:  t.BestBid.Price,
+		ask:  t.BestAsk.Price,
+	}
+	s.mu.Unlock()
+	s.evaluate()
+}
+
+// Run evaluates the schedules every PollInterval until ctx is done. Market
+// data comes from ticks when given; with nil ticks the instruments named
+// in pending conditions are polled with QuotesMany. A PollInterval <= 0
+// evaluates every second.
+func (s *OrderScheduler) Run(ctx context.Context, ticks <-chan Tick) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = defaultSchedulePoll
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case t, ok := <-ticks:
+			if !ok {
+				ticks = nil
+				continue
+			}
+			s.OnTick(t)
+		case <-ticker.C:
+			if ticks == nil {
+				s.poll(ctx)
+			}
+			s.evaluate()
+		}
+	}
+}
+
+// poll refreshes market data for pending conditions from quotes.
+func (s *OrderScheduler) poll(ctx context.Context) {
+	now := s.now()
+	seen := make(map[Instrument]bool)
+	var instruments []Instrument
+
+	s.mu.Lock()
+	for _, o := range s.orders {
+		if o.Status != ScheduleStatusPending || !s.Calendar.IsOpen(o.Request.Exchange, now) {
+			continue
+		}
+		for _, c := range o.Conditions {
+			if c.Type == ConditionTimeAfter {
+				continue
+			}
+			in := conditionInstrument(o.Request, c)
+			if !seen[in] {
+				seen[in] = true
+				instruments = append(instruments, in)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if len(instruments) == 0 {
+		return
+	}
+	for _, r := range s.data.QuotesMany(ctx, instruments) {
+		if r.Err != nil {
+			if s.logging {
+				logger.Printf("scheduler: quote for %s failed: %v", r.Instrument.TradingSymbol, r.Err)
+			}
+			continue
+		}
+		s.mu.Lock()
+		s.market[paperKey(r.Instrument.Exchange, r.Instrument.TradingSymbol)] = marketSnapshot{
+			ltp:  r.Quote.LTP,
+			vwap: r.Quote.AverageTradePrice,
+			bid:  r.Quote.Bids[0].Price,
+			ask:  r.Quote.Asks[0].Price,
+		}
+		s.mu.Unlock()
+	}
+}
+
+func conditionInstrument(req OrderRequest, c OrderCondition) Instrument {
+	in := Instrument{Exchange: c.Exchange, TradingSymbol: c.TradingSymbol}
+	if in.Exchange == "" {
+		in.Exchange = req.Exchange
+	}
+	if in.TradingSymbol == "" {
+		in.TradingSymbol = req.TradingSymbol
+	}
+	return in
+}
+
+// evaluate places the schedules that are due and whose conditions hold,
+// and expires the ones past their expiry. Fired schedules are saved as
+// PLACED before their orders are sent, so a crash in between cannot send
+// an order twice after a restart.
+func (s *OrderScheduler) evaluate() {
+	now := s.now()
+	var fire []ScheduledOrder
+	changed := false
+
+	s.mu.Lock()
+	for _, o := range s.orders {
+		if o.Status != ScheduleStatusPending {
+			continue
+		}
+		if !o.Expires.IsZero() && !now.Before(o.Expires) {
+			o.Status = ScheduleStatusExpired
+			changed = true
+			if s.logging {
+				logger.Printf("scheduler: %s expired", o.ID)
+			}
+			continue
+		}
+		due := s.due(*o)
+		if now.Before(due) {
+			continue
+		}
+		if s.MaxDelay > 0 && !o.At.IsZero() && len(o.Conditions) == 0 && o.Expires.IsZero() && now.Sub(due) > s.MaxDelay {
+			o.Status = ScheduleStatusExpired
+			o.Error = fmt.Sprintf("missed by %s", now.Sub(due).Round(time.Second))
+			changed = true
+			if s.logging {
+				logger.Printf("scheduler: %s expired, %s", o.ID, o.Error)
+			}
+			continue
+		}
+		if len(o.Conditions) > 0 && !s.Calendar.IsOpen(o.Request.Exchange, now) {
+			continue
+		}
+		if !s.holds(o, now) {
+			continue
+		}
+		o.Status = ScheduleStatusPlaced
+		o.Fired = now
+		fire = append(fire, *o)
+	}
+	s.mu.Unlock()
+
+	if changed || len(fire) > 0 {
+		if err := s.save(); err != nil && s.logging {
+			logger.Printf("scheduler: save failed: %v", err)
+		}
+	}
+	for _, o := range fire {
+		s.place(o)
+	}
+}
+
+// holds reports whether every condition of o holds. Crossing conditions
+// compare against the LTP seen on the previous evaluation, so the first
+// evaluation after a restart only records it. s.mu must be held.
+func (s *OrderScheduler) holds(o *ScheduledOrder, now time.Time) bool {
+	ok := true
+	for i, c := range o.Conditions {
+		if c.Type == ConditionTimeAfter {
+			if now.Before(c.Time) {
+				ok = false
+			}
+			continue
+		}
+
+		in := conditionInstrument(o.Request, c)
+		m, seen := s.market[paperKey(in.Exchange, in.TradingSymbol)]
+		if !seen || m.ltp == 0 {
+			ok = false
+			continue
+		}
+
+		switch c.Type {
+		case ConditionLTPAbove:
+			ok = ok && m.ltp > c.Value
+		case ConditionLTPBelow:
+			ok = ok && m.ltp < c.Value
+		case ConditionLTPCrossesAbove, ConditionLTPCrossesBelow:
+			key := conditionKey{id: o.ID, index: i}
+			prev, had := s.previous[key]
+			s.previous[key] = m.ltp
+			if c.Type == ConditionLTPCrossesAbove {
+				ok = ok && had && prev <= c.Value && m.ltp > c.Value
+			} else {
+				ok = ok && had && prev >= c.Value && m.ltp < c.Value
+			}
+		case ConditionSpreadBelow:
+			ok = ok && m.bid > 0 && m.ask > 0 && m.ask-m.bid < c.Value
+		case ConditionVWAPAbove:
+			ok = ok && m.vwap > c.Value
+		case ConditionVWAPBelow:
+			ok = ok && m.vwap > 0 && m.vwap < c.Value
+		}
+	}
+	return ok
+}
+
+// place sends a fired schedule and records the outcome.
+func (s *OrderScheduler) place(o ScheduledOrder) {
+	var id string
+	r, err := s.broker.PlaceOrderRequest(o.Request)
+	if err == nil {
+		id, err = orderIDFrom(r)
+	}
+
+	s.mu.Lock()
+	cur := s.orders[o.ID]
+	if err != nil {
+		cur.Status = ScheduleStatusFailed
+		cur.Error = err.Error()
+	} else {
+		cur.OrderID = id
+	}
+	for i := range cur.Conditions {
+		delete(s.previous, conditionKey{id: o.ID, index: i})
+	}
+	done := *cur
+	s.mu.Unlock()
+
+	if s.logging {
+		if err != nil {
+			logger.Printf("scheduler: %s failed: %v", o.ID, err)
+		} else {
+			logger.Printf("scheduler: %s placed as order %s", o.ID, id)
+		}
+	}
+	if err := s.save(); err != nil && s.logging {
+		logger.Printf("scheduler: save failed: %v", err)
+	}
+	if s.OnPlaced != nil {
+		s.OnPlaced(done)
+	}
+}
+
+// save writes every schedule to the scheduler's file.
+func (s *OrderScheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	list := s.List()
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// load reads the schedules saved in the scheduler's file.
+func (s *OrderScheduler) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []ScheduledOrder
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid schedule file %s: %w", s.path, err)
+	}
+
+	pending := 0
+	for i := range list {
+		o := list[i]
+		s.orders[o.ID] = &o
+		if o.Status == ScheduleStatusPending {
+			pending++
+		}
+	}
+	if s.logging {
+		logger.Printf("scheduler: loaded %d schedules (%d pending)", len(list), pending)
+	}
+	return nil
+}
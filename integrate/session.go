@@ -0,0 +1,76 @@
+package integrate
+
+import "time"
+
+// IST is the time zone all Indian exchanges trade in.
+var IST = time.FixedZone("IST", 5*60*60+30*60)
+
+// TradingSession is the normal market session of an exchange, as offsets
+// from midnight IST.
+type TradingSession struct {
+	Open  time.Duration
+	Close time.Duration
+}
+
+// ExchangeSessions holds the regular session of each exchange.
+var ExchangeSessions = map[string]TradingSession{
+	ExchangeTypeNSE: {Open: 9*time.Hour + 15*time.Minute, Close: 15*time.Hour + 30*time.Minute},
+	ExchangeTypeBSE: {Open: 9*time.Hour + 15*time.Minute, Close: 15*time.Hour + 30*time.Minute},
+	ExchangeTypeNFO: {Open: 9*time.Hour + 15*time.Minute, Close: 15*time.Hour + 30*time.Minute},
+	ExchangeTypeCDS: {Open: 9 * time.Hour, Close: 17 * time.Hour},
+	ExchangeTypeMCX: {Open: 9 * time.Hour, Close: 23*time.Hour + 30*time.Minute},
+}
+
+// SquareOffCutoffs holds the time, as an offset from midnight IST, at which
+// open INTRADAY positions of each exchange are squared off by the broker.
+var SquareOffCutoffs = map[string]time.Duration{
+	ExchangeTypeNSE: 15*time.Hour + 20*time.Minute,
+	ExchangeTypeBSE: 15*time.Hour + 20*time.Minute,
+	ExchangeTypeNFO: 15*time.Hour + 25*time.Minute,
+	ExchangeTypeCDS: 16*time.Hour + 45*time.Minute,
+	ExchangeTypeMCX: 23*time.Hour + 25*time.Minute,
+}
+
+// SquareOffCutoff returns the intraday square-off time of exchange on the
+// IST calendar day of t. Exchanges without a cutoff use the session close.
+func SquareOffCutoff(exchange string, t time.Time) time.Time {
+	if d, ok := SquareOffCutoffs[exchange]; ok {
+		return istMidnight(t).Add(d)
+	}
+	return SessionFor(exchange).CloseOn(t)
+}
+
+// SessionFor returns the session of exchange, defaulting to the equity
+// session for unknown exchanges.
+func SessionFor(exchange string) TradingSession {
+	if s, ok := ExchangeSessions[exchange]; ok {
+		return s
+	}
+	return ExchangeSessions[ExchangeTypeNSE]
+}
+
+// OpenOn returns the session open on the IST calendar day of t.
+func (s TradingSession) OpenOn(t time.Time) time.Time {
+	return istMidnight(t).Add(s.Open)
+}
+
+// CloseOn returns the session close on the IST calendar day of t.
+func (s TradingSession) CloseOn(t time.Time) time.Time {
+	return istMidnight(t).Add(s.Close)
+}
+
+// Contains reports whether t falls inside the session on its day.
+func (s TradingSession) Contains(t time.Time) bool {
+	return !t.Before(s.OpenOn(t)) && t.Before(s.CloseOn(t))
+}
+
+func istMidnight(t time.Time) time.Time {
+	t = t.In(IST)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, IST)
+}
+
+// asIST reinterprets the wall clock of t as IST. The history API returns
+// IST timestamps without a zone, which parse as UTC.
+func asIST(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), IST)
+}
@@ -0,0 +1,359 @@
+package integrate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KillActionEscalate marks a square-off limit order converted to market.
+const KillActionEscalate = "ESCALATE"
+
+// Defaults for the auto square-off
+const (
+	defaultSquareOffLead      = 5 * time.Minute
+	defaultSquareOffLimitWait = 20 * time.Second
+	defaultSquareOffBuffer    = 0.1
+)
+
+// SquareOffReport lists what a square-off did and the INTRADAY positions
+// still open when it finished.
+type SquareOffReport struct {
+	Exchanges []string
+	Started   time.Time
+	Finished  time.Time
+	Actions   []KillSwitchAction
+	Errors    []error
+	Remaining []Position
+}
+
+// Failed returns the actions that did not succeed.
+func (r *SquareOffReport) Failed() []KillSwitchAction {
+	var failed []KillSwitchAction
+	for _, a := range r.Actions {
+		if a.Err != nil {
+			failed = append(failed, a)
+		}
+	}
+	return failed
+}
+
+// OK reports whether every step succeeded and nothing is left open.
+func (r *SquareOffReport) OK() bool {
+	return len(r.Errors) == 0 && len(r.Failed()) == 0 && len(r.Remaining) == 0
+}
+
+func (r *SquareOffReport) add(a KillSwitchAction) {
+	r.Actions = append(r.Actions, a)
+}
+
+// AutoSquareOff closes INTRADAY positions before the broker does. At the
+// time set in Times for an exchange it cancels the pending INTRADAY orders
+// on it and closes its INTRADAY positions with limit orders LimitBuffer
+// percent through the last price. Limit orders still open after LimitWait
+// are modified to market protected orders. Exchanges with the same time
+// are squared off together.
+//
+// Times holds offsets from midnight IST. The defaults are five minutes
+// before SquareOffCutoffs.
+type AutoSquareOff struct {
+	orders      *IntegrateOrders
+	Times       map[string]time.Duration
+	LimitWait   time.Duration
+	LimitBuffer float64
+	TickSize    float64
+	Calendar    *TradingCalendar
+	OnReport    func(*SquareOffReport)
+	logging     bool
+}
+
+// NewAutoSquareOff initializes a square-off routine for every exchange in
+// SquareOffCutoffs.
+func NewAutoSquareOff(orders *IntegrateOrders, logging bool) *AutoSquareOff {
+	times := make(map[string]time.Duration, len(SquareOffCutoffs))
+	for exchange, cutoff := range SquareOffCutoffs {
+		times[exchange] = cutoff - defaultSquareOffLead
+	}
+	return &AutoSquareOff{
+		orders:      orders,
+		Times:       times,
+		LimitWait:   defaultSquareOffLimitWait,
+		LimitBuffer: defaultSquareOffBuffer,
+		TickSize:    defaultTickSize,
+		logging:     logging,
+	}
+}
+
+// next returns the next run time after now and the exchanges due then.
+func (a *AutoSquareOff) next(now time.Time) (time.Time, []string) {
+	var at time.Time
+	var exchanges []string
+	for exchange, offset := range a.Times {
+		day := istMidnight(now)
+		t := day.Add(offset)
+		if !t.After(now) || !a.Calendar.IsTradingDay(exchange, day) {
+			t = a.Calendar.NextTradingDay(exchange, now).Add(offset)
+		}
+		switch {
+		case at.IsZero() || t.Before(at):
+			at, exchanges = t, []string{exchange}
+		case t.Equal(at):
+			exchanges = append(exchanges, exchange)
+		}
+	}
+	sort.Strings(exchanges)
+	return at, exchanges
+}
+
+// Run squares off each exchange at its time on every trading day until ctx
+// is done. Reports are passed to OnReport.
+func (a *AutoSquareOff) Run(ctx context.Context) error {
+	for {
+		at, exchanges := a.next(time.Now())
+		if len(exchanges) == 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if a.logging {
+			logger.Printf("auto square-off: next run for %s at %s", strings.Join(exchanges, ","), at.Format(time.RFC3339))
+		}
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		report := a.SquareOff(ctx, exchanges...)
+		if a.OnReport != nil {
+			a.OnReport(report)
+		}
+	}
+}
+
+// SquareOff cancels the pending INTRADAY orders and closes the INTRADAY
+// positions on exchanges now. Positions are sized once the cancelled
+// orders are final, so fills that land during the cancel are closed too.
+func (a *AutoSquareOff) SquareOff(ctx context.Context, exchanges ...string) *SquareOffReport {
+	report := &SquareOffReport{Exchanges: exchanges, Started: time.Now()}
+	in := make(map[string]bool, len(exchanges))
+	for _, e := range exchanges {
+		in[e] = true
+	}
+	if a.logging {
+		logger.Printf("auto square-off started for %s", strings.Join(exchanges, ","))
+	}
+
+	a.cancelOrders(ctx, in, report)
+	a.settle(ctx, report)
+	placed := a.closePositions(ctx, in, report)
+	if len(placed) > 0 {
+		a.escalate(ctx, placed, report)
+	}
+	a.remaining(context.WithoutCancel(ctx), in, report)
+
+	report.Finished = time.Now()
+	if a.logging {
+		logger.Printf("auto square-off finished for %s: %d actions, %d failed, %d left open",
+			strings.Join(exchanges, ","), len(report.Actions), len(report.Failed()), len(report.Remaining))
+	}
+	return report
+}
+
+func (a *AutoSquareOff) cancelOrders(ctx context.Context, in map[string]bool, report *SquareOffReport) {
+	io := a.orders.WithContext(ctx)
+	orders, err := io.ListOrders()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("orders: %w", err))
+		return
+	}
+
+	for _, o := range orders {
+		if isTerminalStatus(o.Status) || o.ProductType != ProductTypeIntraday || !in[o.Exchange] {
+			continue
+		}
+		act := KillSwitchAction{
+			Action:        KillActionCancelOrder,
+			ID:            o.OrderID,
+			TradingSymbol: o.TradingSymbol,
+			Quantity:      o.PendingQuantity,
+		}
+		_, act.Err = io.CancelOrder(o.OrderID)
+		report.add(act)
+	}
+}
+
+// settle waits for the cancelled orders to reach a final state. Orders
+// that do not are reported as errors.
+func (a *AutoSquareOff) settle(ctx context.Context, report *SquareOffReport) {
+	for _, act := range report.Actions {
+		if act.Action != KillActionCancelOrder || act.Err != nil {
+			continue
+		}
+		if _, err := awaitTerminal(ctx, a.orders, act.ID, defaultKillPoll, defaultKillTimeout); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+}
+
+// closePositions places the limit orders that close the positions and
+// returns them by order id.
+func (a *AutoSquareOff) closePositions(ctx context.Context, in map[string]bool, report *SquareOffReport) map[string]OrderRequest {
+	io := a.orders
+	positions, err := io.WithContext(ctx).ListPositions()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("positions: %w", err))
+		return nil
+	}
+
+	placed := make(map[string]OrderRequest)
+	slicer := NewOrderSlicer(io, io.logging)
+	protection := killSwitchMarketProtection
+	for _, p := range positions {
+		if !p.Open() || p.ProductType != ProductTypeIntraday || !in[p.Exchange] {
+			continue
+		}
+		req := OrderRequest{
+			Exchange:      p.Exchange,
+			OrderType:     OrderTypeSell,
+			PriceType:     PriceTypeLimit,
+			Price:         a.limitPrice(p),
+			ProductType:   p.ProductType,
+			Quantity:      abs(p.NetQuantity),
+			TradingSymbol: p.TradingSymbol,
+			Validity:      ValidityTypeDay,
+		}
+		if p.NetQuantity < 0 {
+			req.OrderType = OrderTypeBuy
+		}
+		if req.Price <= 0 {
+			req.PriceType = PriceTypeMarket
+			req.MarketProtection = &protection
+		}
+
+		children, err := slicer.Plan(req)
+		if err != nil {
+			children = []OrderRequest{req}
+		}
+		for _, child := range children {
+			act := io.squareOff(ctx, child)
+			report.add(act)
+			if act.Err == nil && child.PriceType == PriceTypeLimit {
+				placed[act.OrderID] = child
+			}
+		}
+	}
+	return placed
+}
+
+// limitPrice returns the closing limit price for p, LimitBuffer percent
+// through its last price and rounded to TickSize in the direction of the
+// buffer. It is zero when the last price is unknown.
+func (a *AutoSquareOff) limitPrice(p Position) float64 {
+	if p.LastPrice <= 0 {
+		return 0
+	}
+	tick := a.TickSize
+	if tick <= 0 {
+		tick = defaultTickSize
+	}
+	var price float64
+	if p.NetQuantity > 0 {
+		price = math.Floor(p.LastPrice*(1-a.LimitBuffer/100)/tick+1e-9) * tick
+	} else {
+		price = math.Ceil(p.LastPrice*(1+a.LimitBuffer/100)/tick-1e-9) * tick
+	}
+	return math.Round(price*100) / 100
+}
+
+// escalate waits LimitWait, then converts the limit orders that are still
+// open to market orders.
+func (a *AutoSquareOff) escalate(ctx context.Context, placed map[string]OrderRequest, report *SquareOffReport) {
+	io := a.orders.WithContext(ctx)
+	protection := killSwitchMarketProtection
+	timer := time.NewTimer(a.LimitWait)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		report.Errors = append(report.Errors, ctx.Err())
+		return
+	case <-timer.C:
+	}
+
+	ids := make([]string, 0, len(placed))
+	for id := range placed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		req := placed[id]
+		o, err := orderState(ctx, a.orders, id)
+		if err != nil {
+			report.Errors = append(report.Errors, err)
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		if isTerminalStatus(o.Status) {
+			continue
+		}
+
+		act := KillSwitchAction{
+			Action:        KillActionEscalate,
+			ID:            id,
+			TradingSymbol: req.TradingSymbol,
+			Quantity:      o.PendingQuantity,
+			OrderID:       id,
+		}
+		_, act.Err = io.modifyOrder(OrderParams{
+			Exchange:         req.Exchange,
+			OrderID:          id,
+			OrderType:        req.OrderType,
+			PriceType:        PriceTypeMarket,
+			ProductType:      req.ProductType,
+			Quantity:         req.Quantity,
+			TradingSymbol:    req.TradingSymbol,
+			MarketProtection: &protection,
+			Validity:         req.Validity,
+		})
+		if a.logging {
+			if act.Err != nil {
+				logger.Printf("auto square-off: escalating %s %s failed: %v", id, req.TradingSymbol, act.Err)
+			} else {
+				logger.Printf("auto square-off: %s %s escalated to market, %d pending", id, req.TradingSymbol, o.PendingQuantity)
+			}
+		}
+		report.add(act)
+	}
+
+	timer = time.NewTimer(a.LimitWait)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+}
+
+// remaining records the INTRADAY positions that are still open.
+func (a *AutoSquareOff) remaining(ctx context.Context, in map[string]bool, report *SquareOffReport) {
+	positions, err := a.orders.WithContext(ctx).ListPositions()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("positions: %w", err))
+		return
+	}
+	for _, p := range positions {
+		if p.Open() && p.ProductType == ProductTypeIntraday && in[p.Exchange] {
+			report.Remaining = append(report.Remaining, p)
+			if a.logging {
+				logger.Printf("auto square-off: %s %s still open, net %d", p.Exchange, p.TradingSymbol, p.NetQuantity)
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package integrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults for the trailing stop manager
+const (
+	defaultTickSize          = 0.05
+	defaultTrailInterval     = 2 * time.Second
+	defaultTrailModifyPerSec = 2
+)
+
+// TrailingStop describes a resting SL-MARKET or SL-LIMIT order that
+// protects a position. The stop follows the best price since it was added
+// at a distance of TrailAmount, or TrailPercent of that price when
+// TrailAmount is zero. For SL-LIMIT stops the limit price is set
+// LimitOffset beyond the trigger.
+type TrailingStop struct {
+	OrderID       string
+	Exchange      string
+	TradingSymbol string
+	Token         string
+	OrderType     string
+	PriceType     string
+	ProductType   string
+	Quantity      int
+	TriggerPrice  float64
+	TrailAmount   float64
+	TrailPercent  float64
+	LimitOffset   float64
+	MinStep       float64
+}
+
+// TrailingStopRatchet is the audit record of one attempt to move a stop.
+type TrailingStopRatchet struct {
+	Time          time.Time `json:"time"`
+	OrderID       string    `json:"order_id"`
+	TradingSymbol string    `json:"tradingsymbol"`
+	LTP           float64   `json:"ltp"`
+	BestPrice     float64   `json:"best_price"`
+	From          float64   `json:"from_trigger"`
+	To            float64   `json:"to_trigger"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type trailState struct {
+	stop       TrailingStop
+	best       float64
+	lastModify time.Time
+	inFlight   bool
+}
+
+// TrailingStopManager ratchets stop orders with ModifyOrder as ticks move
+// in favour of the position. A stop is only moved when the new trigger is
+// at least MinStep better, no sooner than MinInterval after its previous
+// move, and while Limiter allows, so a fast market does not flood the
+// modify route. Every move is written to Audit as a JSON line.
+type TrailingStopManager struct {
+	broker      Broker
+	TickSize    float64
+	MinInterval time.Duration
+	Limiter     *RateLimiter
+	Audit       io.Writer
+	OnRatchet   func(TrailingStopRatchet)
+	logging     bool
+
+	mu      sync.Mutex
+	auditMu sync.Mutex
+	stops   map[string]*trailState
+}
+
+// NewTrailingStopManager initializes a manager that modifies orders
+// through broker.
+func NewTrailingStopManager(broker Broker, logging bool) *TrailingStopManager {
+	return &TrailingStopManager{
+		broker:      broker,
+		TickSize:    defaultTickSize,
+		MinInterval: defaultTrailInterval,
+		Limiter:     NewRateLimiter(defaultTrailModifyPerSec, defaultTrailModifyPerSec),
+		logging:     logging,
+		stops:       make(map[string]*trailState),
+	}
+}
+
+// Add starts trailing a stop order. OrderType is the side of the stop
+// order: SELL protects a long position and BUY a short one.
+func (m *TrailingStopManager) Add(stop TrailingStop) error {
+	if stop.OrderID == "" {
+		return errors.New("trailing stop needs an order id")
+	}
+	if stop.OrderType != OrderTypeBuy && stop.OrderType != OrderTypeSell {
+		return errors.New("invalid order type")
+	}
+	if stop.PriceType != PriceTypeSlMkt && stop.PriceType != PriceTypeSlLmt {
+		return errors.New("trailing stop must be an SL-MARKET or SL-LIMIT order")
+	}
+	if stop.TrailAmount <= 0 && stop.TrailPercent <= 0 {
+		return errors.New("trailing stop needs a trail amount or percentage")
+	}
+	if stop.Quantity <= 0 || stop.TriggerPrice <= 0 {
+		return errors.New("trailing stop needs a quantity and a trigger price")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops[stop.OrderID] = &trailState{stop: stop}
+	return nil
+}
+
+// Remove stops trailing an order.
+func (m *TrailingStopManager) Remove(orderID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stops, orderID)
+}
+
+// Stops returns the stops being trailed with their current triggers.
+func (m *TrailingStopManager) Stops() []TrailingStop {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stops := make([]TrailingStop, 0, len(m.stops))
+	for _, st := range m.stops {
+		stops = append(stops, st.stop)
+	}
+	return stops
+}
+
+// HandleOrderUpdate drops stops whose order has triggered, filled or been
+// cancelled.
+func (m *TrailingStopManager) HandleOrderUpdate(u OrderUpdate) {
+	if isTerminalStatus(u.Status) {
+		m.Remove(u.OrderID)
+	}
+}
+
+// trail returns the trigger the stop should have for the best price.
+func (m *TrailingStopManager) trail(stop TrailingStop, best float64) float64 {
+	distance := stop.TrailAmount
+	if distance <= 0 {
+		distance = best * stop.TrailPercent / 100
+	}
+	tick := m.TickSize
+	if tick <= 0 {
+		tick = defaultTickSize
+	}
+
+	var trigger float64
+	if stop.OrderType == OrderTypeSell {
+		trigger = math.Floor((best-distance)/tick+1e-9) * tick
+	} else {
+		trigger = math.Ceil((best+distance)/tick-1e-9) * tick
+	}
+	return math.Round(trigger*100) / 100
+}
+
+// OnTick moves the stops on the tick's instrument if the price has moved
+// far enough. Modifies are sent synchronously.
+func (m *TrailingStopManager) OnTick(t Tick) {
+	if t.LTP == 0 {
+		return
+	}
+
+	type move struct {
+		st   *trailState
+		stop TrailingStop
+		to   float64
+	}
+	var moves []move
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, st := range m.stops {
+		s := st.stop
+		if s.Exchange != t.Exchange {
+			continue
+		}
+		if s.TradingSymbol != t.TradingSymbol && (s.Token == "" || s.Token != t.Token) {
+			continue
+		}
+
+		long := s.OrderType == OrderTypeSell
+		if st.best == 0 || (long && t.LTP > st.best) || (!long && t.LTP < st.best) {
+			st.best = t.LTP
+		}
+		if st.inFlight || now.Sub(st.lastModify) < m.MinInterval {
+			continue
+		}
+
+		to := m.trail(s, st.best)
+		gain := to - s.TriggerPrice
+		if !long {
+			gain = -gain
+		}
+		if gain <= 0 || gain < s.MinStep {
+			continue
+		}
+		if !m.Limiter.Allow() {
+			break
+		}
+		st.inFlight = true
+		moves = append(moves, move{st: st, stop: s, to: to})
+	}
+	m.mu.Unlock()
+
+	for _, mv := range moves {
+		err := m.modify(mv.stop, mv.to)
+
+		m.mu.Lock()
+		mv.st.inFlight = false
+		mv.st.lastModify = time.Now()
+		if err == nil {
+			mv.st.stop.TriggerPrice = mv.to
+		}
+		best := mv.st.best
+		m.mu.Unlock()
+
+		m.audit(TrailingStopRatchet{
+			Time:          time.Now(),
+			OrderID:       mv.stop.OrderID,
+			TradingSymbol: mv.stop.TradingSymbol,
+			LTP:           t.LTP,
+			BestPrice:     best,
+			From:          mv.stop.TriggerPrice,
+			To:            mv.to,
+		}, err)
+	}
+}
+
+func (m *TrailingStopManager) modify(stop TrailingStop, trigger float64) error {
+	params := OrderParams{
+		Exchange:      stop.Exchange,
+		OrderID:       stop.OrderID,
+		OrderType:     stop.OrderType,
+		PriceType:     stop.PriceType,
+		ProductType:   stop.ProductType,
+		Quantity:      stop.Quantity,
+		TradingSymbol: stop.TradingSymbol,
+		TriggerPrice:  &trigger,
+		Validity:      ValidityTypeDay,
+	}
+	if stop.PriceType == PriceTypeSlLmt {
+		if stop.OrderType == OrderTypeSell {
+			params.Price = trigger - stop.LimitOffset
+		} else {
+			params.Price = trigger + stop.LimitOffset
+		}
+	}
+	_, err := m.broker.ModifyOrder(params)
+	return err
+}
+
+func (m *TrailingStopManager) audit(r TrailingStopRatchet, err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if m.logging {
+		if err != nil {
+			logger.Printf("trailing stop %s %s: %.2f -> %.2f failed: %v", r.OrderID, r.TradingSymbol, r.From, r.To, err)
+		} else {
+			logger.Printf("trailing stop %s %s: %.2f -> %.2f (ltp %.2f)", r.OrderID, r.TradingSymbol, r.From, r.To, r.LTP)
+		}
+	}
+	if m.Audit != nil {
+		line, _ := json.Marshal(r)
+		m.auditMu.Lock()
+		if _, werr := m.Audit.Write(append(line, '\n')); werr != nil && m.logging {
+			logger.Printf("trailing stop audit write failed: %v", werr)
+		}
+		m.auditMu.Unlock()
+	}
+	if m.OnRatchet != nil {
+		m.OnRatchet(r)
+	}
+}
+
+// Run feeds ticks and order updates into the manager until ctx is done.
+// updates may be nil.
+func (m *TrailingStopManager) Run(ctx context.Context, ticks <-chan Tick, updates <-chan OrderUpdate) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t, ok := <-ticks:
+			if !ok {
+				return
+			}
+			m.OnTick(t)
+		case u, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			m.HandleOrderUpdate(u)
+		}
+	}
+}
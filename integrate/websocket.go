@@ -0,0 +1,652 @@
+package integrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWSURL = "wss://trade.definedgesecurities.com/NorenWSTRTP/"
+
+// Defaults for the websocket connection
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultReconnectDelay    = time.Second
+	defaultMaxReconnectDelay = 30 * time.Second
+	wsWriteTimeout           = 10 * time.Second
+	wsEventBuffer            = 1024
+)
+
+// InstrumentToken identifies a feed by exchange and symbol-master token.
+type InstrumentToken struct {
+	Exchange string
+	Token    string
+}
+
+func (t InstrumentToken) String() string {
+	return t.Exchange + "|" + t.Token
+}
+
+// Tick is a touchline update.
+type Tick struct {
+	Exchange          string
+	Token             string
+	TradingSymbol     string
+	LTP               float64
+	LastTradeQuantity int
+	PercentChange     float64
+	Open              float64
+	High              float64
+	Low               float64
+	Close             float64
+	AveragePrice      float64
+	Volume            int
+	OpenInterest      int
+	BestBid           DepthLevel
+	BestAsk           DepthLevel
+	Time              time.Time
+}
+
+// Depth is a five level market depth update.
+type Depth struct {
+	Exchange          string
+	Token             string
+	TradingSymbol     string
+	LTP               float64
+	Bids              [5]DepthLevel
+	Asks              [5]DepthLevel
+	TotalBuyQuantity  int
+	TotalSellQuantity int
+	Time              time.Time
+}
+
+// IntegrateWebSocket streams market data and order updates over the
+// Integrate websocket using the session's WSSessionKey. Events are
+// delivered to the On* callbacks when they are set, otherwise on the
+// Ticks, Depths and OrderUpdates channels.
+// Consumers of the channels must keep up; a full channel stalls the feed.
+type IntegrateWebSocket struct {
+	c2i     *ConnectToIntegrate
+	logging bool
+
+	URL               string
+	HeartbeatInterval time.Duration
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	OnTick        func(Tick)
+	OnDepth       func(Depth)
+	OnOrderUpdate func(OrderUpdate)
+	OnError       func(error)
+	OnConnect     func()
+
+	ticks        chan Tick
+	depths       chan Depth
+	orderUpdates chan OrderUpdate
+
+	mu         sync.Mutex
+	conn       *wsConn
+	subs       map[string]map[InstrumentToken]struct{}
+	orders     bool
+	touchlines map[InstrumentToken]map[string]interface{}
+	depthState map[InstrumentToken]map[string]interface{}
+	cancel     context.CancelFunc
+	done       chan struct{}
+	closed     bool
+}
+
+// NewIntegrateWebSocket initializes a new websocket client for a logged in session.
+func NewIntegrateWebSocket(c2i *ConnectToIntegrate, logging bool) *IntegrateWebSocket {
+	return &IntegrateWebSocket{
+		c2i:               c2i,
+		logging:           logging,
+		URL:               defaultWSURL,
+		HeartbeatInterval: defaultHeartbeatInterval,
+		ReconnectDelay:    defaultReconnectDelay,
+		MaxReconnectDelay: defaultMaxReconnectDelay,
+		ticks:             make(chan Tick, wsEventBuffer),
+		depths:            make(chan Depth, wsEventBuffer),
+		orderUpdates:      make(chan OrderUpdate, wsEventBuffer),
+		subs:              make(map[string]map[InstrumentToken]struct{}),
+		touchlines:        make(map[InstrumentToken]map[string]interface{}),
+		depthState:        make(map[InstrumentToken]map[string]interface{}),
+	}
+}
+
+// Ticks returns the channel of touchline updates. It is closed when the
+// client stops; a later Connect opens a new one.
+func (ws *IntegrateWebSocket) Ticks() <-chan Tick {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.ticks
+}
+
+// Depths returns the channel of depth updates. It is closed when the
+// client stops; a later Connect opens a new one.
+func (ws *IntegrateWebSocket) Depths() <-chan Depth {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.depths
+}
+
+// OrderUpdates returns the channel of order updates. It is closed when the
+// client stops; a later Connect opens a new one.
+func (ws *IntegrateWebSocket) OrderUpdates() <-chan OrderUpdate {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.orderUpdates
+}
+
+// Connect dials the websocket, logs in with the session keys and starts
+// reading. If the connection drops afterwards it is re-established with
+// backoff and every active subscription is sent again. The client runs
+// until ctx is done or Close is called, and can be connected again after.
+func (ws *IntegrateWebSocket) Connect(ctx context.Context) error {
+	// The cancel func is in place before dialing, so a Close while the
+	// dial is in flight stops it.
+	runCtx, cancel := context.WithCancel(ctx)
+	ws.mu.Lock()
+	if ws.done != nil {
+		ws.mu.Unlock()
+		cancel()
+		return errors.New("websocket already connected")
+	}
+	ws.done = make(chan struct{})
+	ws.cancel = cancel
+	done := ws.done
+	if ws.closed {
+		ws.ticks = make(chan Tick, wsEventBuffer)
+		ws.depths = make(chan Depth, wsEventBuffer)
+		ws.orderUpdates = make(chan OrderUpdate, wsEventBuffer)
+		ws.closed = false
+	}
+	ws.mu.Unlock()
+
+	fail := func(err error) error {
+		cancel()
+		ws.reset()
+		close(done)
+		return err
+	}
+	if ws.c2i.WSSessionKey == "" {
+		return fail(errors.New("websocket session key is not set, login first"))
+	}
+	conn, err := ws.dial(runCtx)
+	if err != nil {
+		return fail(err)
+	}
+
+	go ws.run(runCtx, conn, done)
+	return nil
+}
+
+// reset marks the client as stopped so Connect can be called again.
+func (ws *IntegrateWebSocket) reset() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn = nil
+	ws.cancel = nil
+	ws.done = nil
+}
+
+// Close stops the client and closes the event channels.
+func (ws *IntegrateWebSocket) Close() error {
+	ws.mu.Lock()
+	cancel, done, conn := ws.cancel, ws.done, ws.conn
+	ws.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	if conn != nil {
+		conn.close()
+	}
+	<-done
+	return nil
+}
+
+// Subscribe starts the given feed for tokens. SubscriptionTypeOrder takes
+// no tokens and follows every order of the account. Subscriptions made
+// before Connect are sent once the connection is up.
+func (ws *IntegrateWebSocket) Subscribe(subscriptionType string, tokens ...InstrumentToken) error {
+	if subscriptionType == SubscriptionTypeOrder {
+		return ws.setOrderSubscription(true)
+	}
+
+	msgType, _, err := wsFeedMessageTypes(subscriptionType)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	set := ws.subs[subscriptionType]
+	if set == nil {
+		set = make(map[InstrumentToken]struct{})
+		ws.subs[subscriptionType] = set
+	}
+	for _, t := range tokens {
+		set[t] = struct{}{}
+	}
+	conn := ws.conn
+	ws.mu.Unlock()
+
+	if conn == nil || len(tokens) == 0 {
+		return nil
+	}
+	return ws.send(conn, map[string]interface{}{"t": msgType, "k": joinTokens(tokens)})
+}
+
+// Unsubscribe stops the given feed for tokens.
+func (ws *IntegrateWebSocket) Unsubscribe(subscriptionType string, tokens ...InstrumentToken) error {
+	if subscriptionType == SubscriptionTypeOrder {
+		return ws.setOrderSubscription(false)
+	}
+
+	_, msgType, err := wsFeedMessageTypes(subscriptionType)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	for _, t := range tokens {
+		delete(ws.subs[subscriptionType], t)
+		if subscriptionType == SubscriptionTypeTick {
+			delete(ws.touchlines, t)
+		} else {
+			delete(ws.depthState, t)
+		}
+	}
+	conn := ws.conn
+	ws.mu.Unlock()
+
+	if conn == nil || len(tokens) == 0 {
+		return nil
+	}
+	return ws.send(conn, map[string]interface{}{"t": msgType, "k": joinTokens(tokens)})
+}
+
+func (ws *IntegrateWebSocket) setOrderSubscription(on bool) error {
+	ws.mu.Lock()
+	ws.orders = on
+	conn := ws.conn
+	ws.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return ws.send(conn, ws.orderSubscriptionMessage(on))
+}
+
+func (ws *IntegrateWebSocket) orderSubscriptionMessage(on bool) map[string]interface{} {
+	if on {
+		return map[string]interface{}{"t": "o", "actid": ws.c2i.Actid}
+	}
+	return map[string]interface{}{"t": "uo"}
+}
+
+// wsFeedMessageTypes maps a subscription type to its subscribe and
+// unsubscribe message types.
+func wsFeedMessageTypes(subscriptionType string) (string, string, error) {
+	switch subscriptionType {
+	case SubscriptionTypeTick:
+		return "t", "u", nil
+	case SubscriptionTypeDepth:
+		return "d", "ud", nil
+	}
+	return "", "", fmt.Errorf("invalid subscription type %q", subscriptionType)
+}
+
+func joinTokens(tokens []InstrumentToken) string {
+	keys := make([]string, len(tokens))
+	for i, t := range tokens {
+		keys[i] = t.String()
+	}
+	return strings.Join(keys, "#")
+}
+
+// dial connects, logs in and replays the current subscriptions.
+func (ws *IntegrateWebSocket) dial(ctx context.Context) (*wsConn, error) {
+	conn, err := dialWebSocket(ctx, ws.URL)
+	if err != nil {
+		return nil, err
+	}
+	// Login reads are bounded only by the read timeout, so the connection
+	// is closed if ctx is done first.
+	stop := context.AfterFunc(ctx, func() { conn.conn.Close() })
+	defer stop()
+	conn.readTimeout = 3 * ws.heartbeatInterval()
+	conn.writeTimeout = wsWriteTimeout
+
+	login := map[string]interface{}{
+		"t":          "c",
+		"uid":        ws.c2i.Uid,
+		"actid":      ws.c2i.Actid,
+		"source":     "TRTP",
+		"susertoken": ws.c2i.WSSessionKey,
+	}
+	if err := ws.send(conn, login); err != nil {
+		conn.close()
+		return nil, err
+	}
+
+	for {
+		msg, err := readWSJSON(conn)
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+		if fieldString(msg, "t") != "ck" {
+			continue
+		}
+		if s := fieldString(msg, "s"); s != "OK" {
+			conn.close()
+			return nil, fmt.Errorf("websocket login failed: %s", s)
+		}
+		break
+	}
+
+	ws.mu.Lock()
+	ws.conn = conn
+	var pending []map[string]interface{}
+	for subscriptionType, set := range ws.subs {
+		if len(set) == 0 {
+			continue
+		}
+		msgType, _, err := wsFeedMessageTypes(subscriptionType)
+		if err != nil {
+			continue
+		}
+		tokens := make([]InstrumentToken, 0, len(set))
+		for t := range set {
+			tokens = append(tokens, t)
+		}
+		pending = append(pending, map[string]interface{}{"t": msgType, "k": joinTokens(tokens)})
+	}
+	if ws.orders {
+		pending = append(pending, ws.orderSubscriptionMessage(true))
+	}
+	ws.mu.Unlock()
+
+	for _, msg := range pending {
+		if err := ws.send(conn, msg); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+
+	if ws.logging {
+		logger.Printf("websocket connected to %s", ws.URL)
+	}
+	if ws.OnConnect != nil {
+		ws.OnConnect()
+	}
+	return conn, nil
+}
+
+// run serves conn until it fails, then reconnects until ctx is cancelled.
+func (ws *IntegrateWebSocket) run(ctx context.Context, conn *wsConn, done chan struct{}) {
+	defer func() {
+		ws.mu.Lock()
+		ws.cancel()
+		close(ws.ticks)
+		close(ws.depths)
+		close(ws.orderUpdates)
+		ws.closed = true
+		ws.mu.Unlock()
+		ws.reset()
+		close(done)
+	}()
+
+	for {
+		err := ws.serve(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+		ws.reportError(fmt.Errorf("websocket disconnected: %w", err))
+
+		conn = ws.reconnect(ctx)
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials again with exponential backoff. It returns nil once ctx is done.
+func (ws *IntegrateWebSocket) reconnect(ctx context.Context) *wsConn {
+	ws.mu.Lock()
+	ws.conn = nil
+	ws.mu.Unlock()
+
+	delay := ws.ReconnectDelay
+	if delay <= 0 {
+		delay = defaultReconnectDelay
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := ws.dial(ctx)
+		if err == nil {
+			return conn
+		}
+		ws.reportError(fmt.Errorf("websocket reconnect failed: %w", err))
+
+		delay *= 2
+		if ws.MaxReconnectDelay > 0 && delay > ws.MaxReconnectDelay {
+			delay = ws.MaxReconnectDelay
+		}
+	}
+}
+
+// serve reads and dispatches messages from conn while sending heartbeats.
+func (ws *IntegrateWebSocket) serve(ctx context.Context, conn *wsConn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go ws.heartbeat(conn, stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		msg, err := readWSJSON(conn)
+		if err != nil {
+			conn.conn.Close()
+			return err
+		}
+		ws.dispatch(ctx, msg)
+	}
+}
+
+func (ws *IntegrateWebSocket) heartbeat(conn *wsConn, stop <-chan struct{}) {
+	ticker := time.NewTicker(ws.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := conn.writeMessage(wsOpPing, nil); err != nil {
+				return
+			}
+			if err := ws.send(conn, map[string]interface{}{"t": "h"}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ws *IntegrateWebSocket) heartbeatInterval() time.Duration {
+	if ws.HeartbeatInterval <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return ws.HeartbeatInterval
+}
+
+// dispatch decodes one message and delivers the resulting event.
+func (ws *IntegrateWebSocket) dispatch(ctx context.Context, msg map[string]interface{}) {
+	switch t := fieldString(msg, "t"); t {
+	case "tk", "tf":
+		fields := ws.merge(ws.touchlines, msg, t == "tk")
+		tick := parseTick(fields)
+		if ws.OnTick != nil {
+			ws.OnTick(tick)
+			return
+		}
+		select {
+		case ws.ticks <- tick:
+		case <-ctx.Done():
+		}
+	case "dk", "df":
+		fields := ws.merge(ws.depthState, msg, t == "dk")
+		depth := parseDepth(fields)
+		if ws.OnDepth != nil {
+			ws.OnDepth(depth)
+			return
+		}
+		select {
+		case ws.depths <- depth:
+		case <-ctx.Done():
+		}
+	case "om":
+		update := parseWSOrderUpdate(msg)
+		if ws.OnOrderUpdate != nil {
+			ws.OnOrderUpdate(update)
+			return
+		}
+		select {
+		case ws.orderUpdates <- update:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// merge folds a feed message into the last known fields for its token.
+// Feed updates only carry the fields that changed since the previous
+// message, while an acknowledgement carries the full snapshot.
+func (ws *IntegrateWebSocket) merge(state map[InstrumentToken]map[string]interface{}, msg map[string]interface{}, reset bool) map[string]interface{} {
+	key := InstrumentToken{Exchange: fieldString(msg, "e"), Token: fieldString(msg, "tk")}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	fields := state[key]
+	if fields == nil || reset {
+		fields = make(map[string]interface{}, len(msg))
+		state[key] = fields
+	}
+	for k, v := range msg {
+		fields[k] = v
+	}
+
+	merged := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (ws *IntegrateWebSocket) send(conn *wsConn, msg map[string]interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if ws.logging {
+		logger.Printf("websocket send: %s", data)
+	}
+	return conn.writeMessage(wsOpText, data)
+}
+
+func (ws *IntegrateWebSocket) reportError(err error) {
+	if ws.logging {
+		logger.Println(err)
+	}
+	if ws.OnError != nil {
+		ws.OnError(err)
+	}
+}
+
+// readWSJSON reads the next message from conn as a JSON object.
+func readWSJSON(conn *wsConn) (map[string]interface{}, error) {
+	for {
+		_, data, err := conn.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func parseTick(m map[string]interface{}) Tick {
+	return Tick{
+		Exchange:          fieldString(m, "e"),
+		Token:             fieldString(m, "tk"),
+		TradingSymbol:     fieldString(m, "ts"),
+		LTP:               fieldFloat(m, "lp"),
+		LastTradeQuantity: fieldInt(m, "ltq"),
+		PercentChange:     fieldFloat(m, "pc"),
+		Open:              fieldFloat(m, "o"),
+		High:              fieldFloat(m, "h"),
+		Low:               fieldFloat(m, "l"),
+		Close:             fieldFloat(m, "c"),
+		AveragePrice:      fieldFloat(m, "ap"),
+		Volume:            fieldInt(m, "v"),
+		OpenInterest:      fieldInt(m, "oi"),
+		BestBid:           DepthLevel{Price: fieldFloat(m, "bp1"), Quantity: fieldInt(m, "bq1")},
+		BestAsk:           DepthLevel{Price: fieldFloat(m, "sp1"), Quantity: fieldInt(m, "sq1")},
+		Time:              feedTime(m),
+	}
+}
+
+func parseDepth(m map[string]interface{}) Depth {
+	d := Depth{
+		Exchange:          fieldString(m, "e"),
+		Token:             fieldString(m, "tk"),
+		TradingSymbol:     fieldString(m, "ts"),
+		LTP:               fieldFloat(m, "lp"),
+		TotalBuyQuantity:  fieldInt(m, "tbq"),
+		TotalSellQuantity: fieldInt(m, "tsq"),
+		Time:              feedTime(m),
+	}
+	for i := range d.Bids {
+		n := strconv.Itoa(i + 1)
+		d.Bids[i] = DepthLevel{
+			Price:    fieldFloat(m, "bp"+n),
+			Quantity: fieldInt(m, "bq"+n),
+			Orders:   fieldInt(m, "bo"+n),
+		}
+		d.Asks[i] = DepthLevel{
+			Price:    fieldFloat(m, "sp"+n),
+			Quantity: fieldInt(m, "sq"+n),
+			Orders:   fieldInt(m, "so"+n),
+		}
+	}
+	return d
+}
+
+// feedTime reads the exchange feed time (epoch seconds), falling back to
+// the local clock when the message has none.
+func feedTime(m map[string]interface{}) time.Time {
+	if ft := fieldInt(m, "ft"); ft > 0 {
+		return time.Unix(int64(ft), 0)
+	}
+	return time.Now()
+}
@@ -0,0 +1,364 @@
+package integrate
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// LocalWSServer is an in-process stand-in for the Integrate websocket. It
+// speaks the same JSON protocol as the live feed, so IntegrateWebSocket can
+// be exercised without a session.
+type LocalWSServer struct {
+	// SessionKey, when set, is the only susertoken accepted at login.
+	SessionKey string
+
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	clients   map[*localWSClient]struct{}
+	snapshots map[string]map[string]interface{}
+	logins    int
+	beats     int
+}
+
+type localWSClient struct {
+	conn    *wsConn
+	authed  bool
+	orders  bool
+	stalled bool
+	subs    map[string]map[string]struct{}
+}
+
+// NewLocalWSServer starts a local websocket server.
+func NewLocalWSServer() *LocalWSServer {
+	s := &LocalWSServer{
+		clients:   make(map[*localWSClient]struct{}),
+		snapshots: make(map[string]map[string]interface{}),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the ws:// address to set as IntegrateWebSocket.URL.
+func (s *LocalWSServer) URL() string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http")
+}
+
+// Close disconnects every client and stops the server.
+func (s *LocalWSServer) Close() {
+	s.DropConnections()
+	s.srv.Close()
+}
+
+// DropConnections closes every client connection without a close frame,
+// the way a network failure would.
+func (s *LocalWSServer) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		c.conn.conn.Close()
+		delete(s.clients, c)
+	}
+}
+
+// Stall stops the server reading from the connected clients, so their
+// pings go unanswered, the way a hung peer would behave. Clients that
+// connect afterwards are served normally.
+func (s *LocalWSServer) Stall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		c.stalled = true
+	}
+}
+
+// Heartbeats returns the number of heartbeat messages received so far.
+func (s *LocalWSServer) Heartbeats() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.beats
+}
+
+// Logins returns the number of successful logins so far.
+func (s *LocalWSServer) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Subscribed reports whether any connected client subscribes to the feed.
+func (s *LocalWSServer) Subscribed(subscriptionType, exchange, token string) bool {
+	key := exchange + "|" + token
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		if _, ok := c.subs[subscriptionType][key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OrdersSubscribed reports whether any connected client follows order updates.
+func (s *LocalWSServer) OrdersSubscribed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		if c.orders {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishOrderUpdate sends an order update to the clients following orders.
+// Fields use the feed's keys ("norenordno", "status", "fillshares", ...).
+func (s *LocalWSServer) PublishOrderUpdate(fields map[string]interface{}) {
+	msg := map[string]interface{}{"t": "om"}
+	for k, v := range fields {
+		msg[k] = v
+	}
+
+	s.mu.Lock()
+	var targets []*localWSClient
+	for c := range s.clients {
+		if c.orders {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		s.write(c, msg)
+	}
+}
+
+// PublishTick sends a touchline update to the clients subscribed to it.
+// Fields use the feed's short keys ("lp", "v", "bp1", ...).
+func (s *LocalWSServer) PublishTick(exchange, token string, fields map[string]interface{}) {
+	s.publish(SubscriptionTypeTick, "tf", exchange, token, fields)
+}
+
+// PublishDepth sends a depth update to the clients subscribed to it.
+func (s *LocalWSServer) PublishDepth(exchange, token string, fields map[string]interface{}) {
+	s.publish(SubscriptionTypeDepth, "df", exchange, token, fields)
+}
+
+func (s *LocalWSServer) publish(subscriptionType, msgType, exchange, token string, fields map[string]interface{}) {
+	key := exchange + "|" + token
+
+	msg := map[string]interface{}{"t": msgType, "e": exchange, "tk": token}
+	for k, v := range fields {
+		msg[k] = v
+	}
+
+	s.mu.Lock()
+	snap := s.snapshots[key]
+	if snap == nil {
+		snap = make(map[string]interface{})
+		s.snapshots[key] = snap
+	}
+	for k, v := range fields {
+		snap[k] = v
+	}
+	var targets []*localWSClient
+	for c := range s.clients {
+		if _, ok := c.subs[subscriptionType][key]; ok {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		s.write(c, msg)
+	}
+}
+
+// Broadcast sends msg to every logged in client.
+func (s *LocalWSServer) Broadcast(msg map[string]interface{}) {
+	s.mu.Lock()
+	var targets []*localWSClient
+	for c := range s.clients {
+		if c.authed {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		s.write(c, msg)
+	}
+}
+
+func (s *LocalWSServer) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := acceptWebSocket(w, r)
+	if err != nil {
+		return
+	}
+
+	c := &localWSClient{conn: conn, subs: make(map[string]map[string]struct{})}
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		conn.conn.Close()
+	}()
+
+	for {
+		msg, err := readWSJSON(conn)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		stalled := c.stalled
+		s.mu.Unlock()
+		if stalled {
+			io.Copy(io.Discard, conn.conn)
+			return
+		}
+		s.receive(c, msg)
+	}
+}
+
+// receive handles one client request.
+func (s *LocalWSServer) receive(c *localWSClient, msg map[string]interface{}) {
+	t := fieldString(msg, "t")
+	if t == "c" {
+		if s.SessionKey != "" && fieldString(msg, "susertoken") != s.SessionKey {
+			s.write(c, map[string]interface{}{"t": "ck", "s": "NOT_OK"})
+			return
+		}
+		s.mu.Lock()
+		c.authed = true
+		s.logins++
+		s.mu.Unlock()
+		s.write(c, map[string]interface{}{"t": "ck", "s": "OK", "uid": fieldString(msg, "uid")})
+		return
+	}
+
+	s.mu.Lock()
+	authed := c.authed
+	s.mu.Unlock()
+	if !authed {
+		return
+	}
+
+	switch t {
+	case "h":
+		s.mu.Lock()
+		s.beats++
+		s.mu.Unlock()
+	case "t":
+		s.subscribe(c, SubscriptionTypeTick, "tk", fieldString(msg, "k"))
+	case "u":
+		s.unsubscribe(c, SubscriptionTypeTick, fieldString(msg, "k"))
+	case "d":
+		s.subscribe(c, SubscriptionTypeDepth, "dk", fieldString(msg, "k"))
+	case "ud":
+		s.unsubscribe(c, SubscriptionTypeDepth, fieldString(msg, "k"))
+	case "o":
+		s.mu.Lock()
+		c.orders = true
+		s.mu.Unlock()
+		s.write(c, map[string]interface{}{"t": "ok"})
+	case "uo":
+		s.mu.Lock()
+		c.orders = false
+		s.mu.Unlock()
+		s.write(c, map[string]interface{}{"t": "uok"})
+	}
+}
+
+// subscribe records the keys and acknowledges each with its last snapshot.
+func (s *LocalWSServer) subscribe(c *localWSClient, subscriptionType, ackType, keys string) {
+	var acks []map[string]interface{}
+
+	s.mu.Lock()
+	set := c.subs[subscriptionType]
+	if set == nil {
+		set = make(map[string]struct{})
+		c.subs[subscriptionType] = set
+	}
+	for _, key := range strings.Split(keys, "#") {
+		exchange, token, ok := strings.Cut(key, "|")
+		if !ok {
+			continue
+		}
+		set[key] = struct{}{}
+
+		ack := map[string]interface{}{"t": ackType, "e": exchange, "tk": token}
+		for k, v := range s.snapshots[key] {
+			ack[k] = v
+		}
+		acks = append(acks, ack)
+	}
+	s.mu.Unlock()
+
+	for _, ack := range acks {
+		s.write(c, ack)
+	}
+}
+
+func (s *LocalWSServer) unsubscribe(c *localWSClient, subscriptionType, keys string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range strings.Split(keys, "#") {
+		delete(c.subs[subscriptionType], key)
+	}
+}
+
+func (s *LocalWSServer) write(c *localWSClient, msg map[string]interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.conn.writeMessage(wsOpText, data)
+}
+
+// acceptWebSocket upgrades an incoming HTTP request to a server connection.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
@@ -0,0 +1,160 @@
+package integrate
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWebSocket(t *testing.T, srv *LocalWSServer) *IntegrateWebSocket {
+	t.Helper()
+	ws := NewIntegrateWebSocket(&ConnectToIntegrate{Uid: "u", Actid: "a", WSSessionKey: "k"}, false)
+	ws.URL = srv.URL()
+	ws.HeartbeatInterval = 50 * time.Millisecond
+	ws.ReconnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestWebSocketReconnectResubscribes(t *testing.T) {
+	srv := NewLocalWSServer()
+	srv.SessionKey = "k"
+	defer srv.Close()
+
+	ws := newTestWebSocket(t, srv)
+	errs := make(chan error, 10)
+	ws.OnError = func(err error) { errs <- err }
+	ws.Subscribe(SubscriptionTypeTick, InstrumentToken{"NSE", "22"})
+	ws.Subscribe(SubscriptionTypeOrder)
+	if err := ws.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return srv.Subscribed(SubscriptionTypeTick, "NSE", "22") && srv.OrdersSubscribed() })
+
+	srv.DropConnections()
+	waitFor(t, func() bool {
+		return srv.Logins() == 2 && srv.Subscribed(SubscriptionTypeTick, "NSE", "22") && srv.OrdersSubscribed()
+	})
+	select {
+	case <-errs:
+	default:
+		t.Fatal("disconnect was not reported")
+	}
+
+	srv.PublishTick("NSE", "22", map[string]interface{}{"lp": "101.5"})
+	for tick := range ws.Ticks() {
+		if tick.LTP == 101.5 {
+			return
+		}
+	}
+	t.Fatal("tick channel closed before the tick arrived")
+}
+
+func TestWebSocketHeartbeatKeepsConnection(t *testing.T) {
+	srv := NewLocalWSServer()
+	defer srv.Close()
+
+	ws := newTestWebSocket(t, srv)
+	if err := ws.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return srv.Heartbeats() >= 3 })
+
+	// The read timeout is three heartbeats; answered pings keep it alive.
+	time.Sleep(4 * ws.HeartbeatInterval)
+	if n := srv.Logins(); n != 1 {
+		t.Fatalf("logins = %d, want 1", n)
+	}
+}
+
+func TestWebSocketHeartbeatDetectsHungPeer(t *testing.T) {
+	srv := NewLocalWSServer()
+	defer srv.Close()
+
+	ws := newTestWebSocket(t, srv)
+	if err := ws.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return srv.Logins() == 1 })
+
+	srv.Stall()
+	waitFor(t, func() bool { return srv.Logins() == 2 })
+}
+
+func TestWebSocketConnectContextAndReconnectAfterClose(t *testing.T) {
+	srv := NewLocalWSServer()
+	defer srv.Close()
+
+	ws := newTestWebSocket(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := ws.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ticks := ws.Ticks()
+	cancel()
+	select {
+	case _, ok := <-ticks:
+		if ok {
+			t.Fatal("unexpected tick")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client kept running after its context was cancelled")
+	}
+
+	waitFor(t, func() bool { return ws.Connect(context.Background()) == nil })
+	ws.Subscribe(SubscriptionTypeTick, InstrumentToken{"NSE", "22"})
+	waitFor(t, func() bool { return srv.Subscribed(SubscriptionTypeTick, "NSE", "22") })
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Connect(context.Background()); err != nil {
+		t.Fatalf("connect after close: %v", err)
+	}
+}
+
+func TestWebSocketCloseDuringLogin(t *testing.T) {
+	accepted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := acceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.conn.Close()
+		close(accepted)
+		io.Copy(io.Discard, conn.conn)
+	}))
+	defer srv.Close()
+
+	ws := NewIntegrateWebSocket(&ConnectToIntegrate{Uid: "u", Actid: "a", WSSessionKey: "k"}, false)
+	ws.URL = "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws.HeartbeatInterval = time.Minute
+
+	connected := make(chan error, 1)
+	go func() { connected <- ws.Connect(context.Background()) }()
+	<-accepted
+	ws.Close()
+
+	select {
+	case err := <-connected:
+		if err == nil {
+			t.Fatal("Connect succeeded after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect still waiting for login after Close")
+	}
+}